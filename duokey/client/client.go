@@ -2,33 +2,53 @@ package client
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/duokey/duokey-sdk-go/duokey"
 	"github.com/duokey/duokey-sdk-go/duokey/credentials"
 	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/duokey/duokey-sdk-go/duokey/tokencache"
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
 	"golang.org/x/oauth2"
 )
 
 const (
-	httpClientTimeout time.Duration = time.Second * 10
-	context_api_id    string        = "appid"
-	context_tenant_id string        = "tenantid"
+	context_api_id    string = "appid"
+	context_tenant_id string = "tenantid"
+)
+
+// Environment variables enabling the token cache of New (see package
+// tokencache). The cache is only used if the key is set.
+const (
+	EnvTokenCacheKey = "DUOKEY_TOKEN_CACHE_KEY" // Hex-encoded 32-byte key
+	EnvTokenCacheDir = "DUOKEY_TOKEN_CACHE_DIR" // tokencache.DefaultDir if empty
 )
 
 // Client implements the base client request and response handling. All
 // services rely on this client.
 type Client struct {
 	Config duokey.Config
+
+	// Handlers are copied to each new request. Add, remove or replace
+	// handlers to customize the requests (headers, auditing, ...). A client
+	// without handlers uses request.DefaultHandlers.
+	Handlers request.Handlers
+
+	tokens *tokenManager
 }
 
 // Wrap http.RoundTripper to log HTTP requests
 type transportWithLogger struct {
 	Transport http.RoundTripper
-	Logger    duokey.Logger
+	Logger    duokey.LeveledLogger
 }
 
 // Ensure that transportWithLogger implements the http.RoundTripper interface
@@ -38,105 +58,310 @@ func (twl *transportWithLogger) RoundTrip(req *http.Request) (*http.Response, er
 
 	// Start the timer and log the event
 	start := time.Now()
-	msg := fmt.Sprintf("request to %v", req.URL)
-	defer duokey.LogExecutionTime(twl.Logger, msg, start)
+	resp, err := twl.Transport.RoundTrip(req)
+	logRequest(twl.Logger, "API request", req, resp, err, start)
 
-	// Send the request
-	return twl.Transport.RoundTrip(req)
+	return resp, err
+}
+
+// logRequest logs an HTTP request at debug level
+func logRequest(logger duokey.LeveledLogger, msg string, req *http.Request, resp *http.Response, err error, start time.Time) {
+	keysAndValues := []interface{}{"method", req.Method, "url", req.URL.String(), "duration", time.Since(start)}
+	if resp != nil {
+		keysAndValues = append(keysAndValues, "status", resp.StatusCode)
+	}
+	if err != nil {
+		keysAndValues = append(keysAndValues, "error", err)
+	}
+	logger.Debug(msg, keysAndValues...)
 }
 
 type duoKeyTransport struct {
 	TenantID       uint32
 	HeaderTenantID string
-	Logger         duokey.Logger
+	Logger         duokey.LeveledLogger
+	Tracer         duokey.Tracer // Propagates the trace context (optional)
+
+	// Transport sends the requests (http.DefaultTransport if nil)
+	Transport http.RoundTripper
+	// Assertion returns the client assertion for a token endpoint
+	// (private_key_jwt). It is nil if the client authenticates with its secret.
+	Assertion func(audience string) (string, error)
 }
 
 var _ http.RoundTripper = (*duoKeyTransport)(nil)
 
-// RoundTrip adds the tenant ID to the PasswordCredentialsToken request.
+// RoundTrip adds the tenant ID to the token requests (password grant or token
+// exchange).
 // Remark: we shouln't mutate a request this way. However, it seems that it's the
 // only solution to modify the header when calling PasswordCredentialsToken (see
 // https://developer20.com/add-header-to-every-request-in-go/ and
 // https://rakyll.medium.com/context-propagation-over-http-in-go-d4540996e9b0).
+// The same goes for the client assertion, which cannot be passed to
+// PasswordCredentialsToken: it is added to the form of the token requests.
 func (t *duoKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Set(t.HeaderTenantID, fmt.Sprint(t.TenantID))
+	if t.Tracer != nil {
+		t.Tracer.Inject(req.Context(), req.Header)
+	}
+	if t.Assertion != nil && req.Method == http.MethodPost && req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		if err := t.addAssertion(req); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
 	start := time.Now()
-	msg := fmt.Sprintf("request to %v", req.URL)
-	defer duokey.LogExecutionTime(t.Logger, msg, start)
+	resp, err := transport.RoundTrip(req)
+	logRequest(t.Logger, "token request", req, resp, err, start)
+
+	return resp, err
+}
+
+// authTransport adds the access token to the API requests. Unlike
+// oauth2.Transport, it renews an expired token with the context of the
+// request, so that the renewal can be cancelled and traced.
+type authTransport struct {
+	tokens *tokenManager
+	base   http.RoundTripper
+}
+
+var _ http.RoundTripper = (*authTransport)(nil)
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.tokenContext(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the request
+	authReq := req.Clone(req.Context())
+	token.SetAuthHeader(authReq)
+
+	return t.base.RoundTrip(authReq)
+}
+
+// addAssertion adds the client assertion to the form of a token request. The
+// audience is the token endpoint.
+func (t *duoKeyTransport) addAssertion(req *http.Request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+
+	audience := *req.URL
+	audience.RawQuery = ""
+	assertion, err := t.Assertion(audience.String())
+	if err != nil {
+		return err
+	}
+
+	form.Set("client_assertion_type", credentials.ClientAssertionType)
+	form.Set("client_assertion", assertion)
+
+	encoded := form.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(encoded))
+	req.ContentLength = int64(len(encoded))
 
-	return http.DefaultTransport.RoundTrip(req)
+	return nil
 }
 
 // New returns a pointer to a new DuoKey client. If the credentials are correct, we obtain a DuoKey access token.
-// Then we configure an HTTP client using the token. The token will auto-refresh as necessary.
+// Then we configure an HTTP client using the token. The token is renewed when a request finds it expired; use
+// NewWithConfig for a background refresh. If EnvTokenCacheKey is set, a valid token cached by a previous
+// process is reused.
 func New(creds credentials.Config, logger duokey.Logger) (*Client, error) {
+	cache, err := tokenCacheFromEnv()
+	if err != nil {
+		return nil, err
+	}
 
-	var clientConfig duokey.Config
+	return NewWithConfig(duokey.Config{
+		Credentials:  creds,
+		Logger:       logger,
+		TokenRefresh: duokey.TokenRefreshConfig{Disabled: true},
+		TokenCache:   cache,
+	})
+}
 
-	// Logger
-	if logger == nil {
-		clientConfig.Logger = duokey.NewDefaultLogger()
-	} else {
-		clientConfig.Logger = logger
+// tokenCacheFromEnv returns the token cache configured by EnvTokenCacheKey and
+// EnvTokenCacheDir, or nil if the key is not set
+func tokenCacheFromEnv() (duokey.TokenCache, error) {
+	value := os.Getenv(EnvTokenCacheKey)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: not hex-encoded", EnvTokenCacheKey)
 	}
+	defer sensitive.Zero(key)
 
-	// Read the discovery document
-	oauth2Config, err := credentials.GetOauth2Config(creds)
+	cache, err := tokencache.New(tokencache.Options{Dir: os.Getenv(EnvTokenCacheDir), Key: key})
 	if err != nil {
-		clientConfig.Logger.Infof("could not read the token and authorization URLs from the discovery document: %v", err)
 		return nil, err
 	}
 
+	return cache, nil
+}
+
+// NewWithConfig is like New but reads the credentials, the logger, the token
+// refresh settings, the token cache and the transport options from config. The
+// transport options apply to both the token and the API requests. If the cache
+// holds a valid token, neither the discovery document nor a new token are
+// requested. config.HTTPClient is replaced by a client authenticating the
+// requests. Call Close to stop the background refresh of the token.
+func NewWithConfig(config duokey.Config) (*Client, error) {
+
+	clientConfig := config
+	creds := config.Credentials
+
+	// Logger, redacting the secrets
+	logger := duokey.LoggerFor(config)
+	clientConfig.LeveledLogger = logger
+
+	// Read the discovery document (cached for the HTTP client of ctx) when a token is needed
+	oauth2Config := func(ctx context.Context) (*oauth2.Config, error) {
+		c, err := credentials.GetOauth2ConfigWithContext(ctx, creds)
+		if err != nil {
+			logger.Warn("could not read the token and authorization URLs from the discovery document", "error", err)
+		}
+		return c, err
+	}
+
+	baseTransport, err := newBaseTransport(creds, config.Transport)
+	if err != nil {
+		logger.Error("could not configure the transport", "error", err)
+		return nil, err
+	}
+	if config.WireLog.Enabled {
+		baseTransport = &wireLogTransport{
+			Transport: baseTransport,
+			Logger: duokey.RedactWith(logger, duokey.RedactOptions{
+				ShowPayloads: config.WireLog.ShowPayloads,
+				ShowSecrets:  config.WireLog.ShowSecrets,
+			}),
+		}
+	}
+
 	// The custom transport adds the tenant ID to the header
 	transport := &duoKeyTransport{
 		TenantID:       creds.TenantID,
 		HeaderTenantID: creds.HeaderTenantID,
-		Logger:         clientConfig.Logger,
+		Logger:         logger,
+		Tracer:         config.Tracer,
+		Transport:      baseTransport,
 	}
 
-	httpClient := &http.Client{Transport: transport, Timeout: httpClientTimeout}
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	if credentials.UsesClientAssertion(creds) {
+		transport.Assertion = func(audience string) (string, error) {
+			return credentials.GetClientAssertion(creds, audience)
+		}
+	}
 
-	// Password credentials call
-	token, err := oauth2Config.PasswordCredentialsToken(ctx, creds.UserName, creds.Password)
-	if err != nil {
-		clientConfig.Logger.Infof("could not get the token: %v", err)
-		return nil, err
+	tokenTimeout := duokey.DefaultTokenTimeout
+	if config.Transport.Timeout > 0 {
+		tokenTimeout = config.Transport.Timeout
 	}
 
-	// Token validation
-	if !token.Valid() {
-		return nil, fmt.Errorf("failed to check the token")
+	httpClient := &http.Client{Transport: transport, Timeout: tokenTimeout}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+
+	// Password credentials call, or token exchange for workload identities
+	grantType := "password"
+	grant := func(ctx context.Context) (*oauth2.Token, error) {
+		c, err := oauth2Config(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.PasswordCredentialsToken(ctx, creds.UserName, creds.Password)
 	}
 
-	if token.TokenType != "Bearer" {
-		return nil, fmt.Errorf("bad token: expected 'Bearer', got '%s'", token.TokenType)
+	if credentials.UsesTokenExchange(creds) {
+		grantType = credentials.TokenExchangeGrantType
+		grant = func(ctx context.Context) (*oauth2.Token, error) {
+			c, err := oauth2Config(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return exchangeToken(ctx, c, creds)
+		}
 	}
 
-	// Get an OAuth 2 client
-	oauth2Client := oauth2Config.Client(context.Background(), token)
+	tokens := newTokenManager(ctx, oauth2Config, grantType, grant, config.TokenRefresh, logger)
+	tokens.creds = creds
+	tokens.tracer = config.Tracer
+	tokens.metrics = config.Metrics
+	if config.TokenCache != nil {
+		tokens.cache = config.TokenCache
+		tokens.cacheKey = duokey.NewTokenCacheKey(creds)
+	}
+	if err := tokens.init(); err != nil {
+		logger.Error("could not get the token", "error", err)
+		return nil, err
+	}
 
-	// Wrap oauth2Client.Transport to log all requests
+	// Wrap the OAuth 2 transport to log all requests
 	transportWithLogger := &transportWithLogger{
-		Transport: oauth2Client.Transport,
-		Logger:    clientConfig.Logger,
+		Transport: &authTransport{tokens: tokens, base: baseTransport},
+		Logger:    logger,
 	}
 
 	// Configure the new DuoKey client
-	clientConfig.Credentials = creds
 	clientConfig.HTTPClient = &http.Client{
 		Transport: transportWithLogger,
+		Timeout:   config.Transport.Timeout,
 	}
+	clientConfig.Authenticator = tokens
 
-	client := &Client{Config: clientConfig}
+	handlers := request.DefaultHandlers()
+	if config.Tracer != nil {
+		addTracing(&handlers, config.Tracer)
+	}
+	if config.Metrics != nil {
+		addMetrics(&handlers, config.Metrics, creds.TenantID)
+	}
+	if !config.RateLimit.IsZero() {
+		addRateLimit(&handlers, config.RateLimit)
+	}
+
+	client := &Client{Config: clientConfig, Handlers: handlers, tokens: tokens}
 
 	return client, nil
 }
 
+// Close stops the background refresh of the access token. The client can
+// still be used: the token is then renewed when a request finds it expired.
+func (c *Client) Close() error {
+	if c.tokens != nil {
+		c.tokens.close()
+	}
+	return nil
+}
+
 // NewRequest returns a request pointer. The tenant ID is added to the HTTP header.
 func (c *Client) NewRequest(operation *request.Operation, params interface{}, data interface{}) *request.Request {
 
-	return request.New(c.Config, operation, params, data)
+	req := request.New(c.Config, operation, params, data)
+	if !c.Handlers.IsEmpty() {
+		req.Handlers = c.Handlers.Copy()
+	}
+
+	return req
 }
 
 // GetMandatoryContext returns a map storing the context required by the DuoKey server. At the moment, this function is
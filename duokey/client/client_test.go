@@ -0,0 +1,856 @@
+package client_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/client"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeytest"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/duokey/duokey-sdk-go/duokey/tokencache"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type silentLogger struct{}
+
+func (silentLogger) Info(...interface{})          {}
+func (silentLogger) Infof(string, ...interface{}) {}
+
+func TestNew(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	c, err := client.New(server.Credentials(), silentLogger{})
+	require.NoError(t, err)
+
+	// The HTTP client authenticates the KMS requests
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.Calls(duokeytest.DiscoveryPath))
+	assert.Equal(t, 1, server.Calls(duokeytest.TokenPath))
+}
+
+func TestNewWithConfig(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	var events []duokey.TokenEvent
+	c, err := client.NewWithConfig(duokey.Config{
+		Credentials: server.Credentials(),
+		Logger:      silentLogger{},
+		TokenRefresh: duokey.TokenRefreshConfig{
+			OnTokenRefresh: func(e duokey.TokenEvent) { events = append(events, e) },
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// No refresh is needed for a fresh token
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Close stops the background refresh and can be called twice
+	assert.NoError(t, c.Close())
+	assert.NoError(t, (&client.Client{}).Close())
+}
+
+func TestNewWithoutDiscovery(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+	server.InjectFault(duokeytest.DiscoveryPath, duokeytest.Fault{StatusCode: http.StatusServiceUnavailable})
+
+	creds := server.Credentials()
+	creds.TokenURL = server.URL + duokeytest.TokenPath
+
+	c, err := client.New(creds, silentLogger{})
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, 0, server.Calls(duokeytest.DiscoveryPath))
+	assert.Equal(t, 1, server.Calls(duokeytest.TokenPath))
+}
+
+func TestReauthentication(t *testing.T) {
+
+	testCases := []struct {
+		name       string
+		fault      *duokeytest.Fault // Injected on the KMS route
+		requests   int
+		tokenFault bool
+		wantErr    string
+	}{
+		{name: "Revoked token", requests: 1},
+		{name: "Concurrent requests share one renewal", requests: 10},
+		{name: "Unauthorized envelope with status 200",
+			fault:    &duokeytest.Fault{StatusCode: http.StatusOK, Body: `{"success":false,"unAuthorizedRequest":true}`, Count: 1},
+			requests: 1,
+		},
+		{name: "Renewal failure", requests: 1, tokenFault: true, wantErr: "failed to renew the access token"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := duokeytest.NewServer(nil)
+			defer server.Close()
+
+			c, err := client.NewWithConfig(duokey.Config{Credentials: server.Credentials(), Logger: silentLogger{}})
+			require.NoError(t, err)
+			defer c.Close()
+
+			endpoints := server.Endpoints()
+			kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+			keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+			if tc.fault != nil {
+				server.InjectFault(duokeytest.EncryptRoute, *tc.fault)
+			} else {
+				server.RevokeTokens()
+			}
+			if tc.tokenFault {
+				server.InjectFault(duokeytest.TokenPath, duokeytest.Fault{StatusCode: http.StatusServiceUnavailable})
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tc.requests)
+			for i := 0; i < tc.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if tc.wantErr != "" {
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), tc.wantErr)
+					continue
+				}
+				assert.NoError(t, err)
+			}
+
+			if tc.wantErr == "" {
+				assert.Equal(t, 2, server.Calls(duokeytest.TokenPath), "a single renewal")
+			}
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	cache, err := tokencache.New(tokencache.Options{Dir: t.TempDir(), Key: make([]byte, 32)})
+	require.NoError(t, err)
+
+	config := duokey.Config{Credentials: server.Credentials(), Logger: silentLogger{}, TokenCache: cache}
+	endpoints := server.Endpoints()
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	// The second client reuses the token of the first one: no discovery, no grant
+	for i := 0; i < 2; i++ {
+		c, err := client.NewWithConfig(config)
+		require.NoError(t, err)
+
+		kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+		_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+		assert.NoError(t, err)
+		c.Close()
+	}
+	assert.Equal(t, 1, server.Calls(duokeytest.DiscoveryPath))
+	assert.Equal(t, 1, server.Calls(duokeytest.TokenPath))
+
+	// A rejected cached token is replaced
+	server.RevokeTokens()
+	c, err := client.NewWithConfig(config)
+	require.NoError(t, err)
+	defer c.Close()
+
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.Calls(duokeytest.TokenPath))
+
+	token, err := cache.Load(duokey.NewTokenCacheKey(server.Credentials()))
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	assert.True(t, token.Valid(), "the new token is cached")
+}
+
+func TestTokenCacheFromEnv(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	t.Setenv(client.EnvTokenCacheKey, strings.Repeat("00", 32))
+	t.Setenv(client.EnvTokenCacheDir, t.TempDir())
+
+	// The second client reuses the token of the first one
+	for i := 0; i < 2; i++ {
+		_, err := client.New(server.Credentials(), silentLogger{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, server.Calls(duokeytest.TokenPath))
+
+	t.Setenv(client.EnvTokenCacheKey, "not hex")
+	_, err := client.New(server.Credentials(), silentLogger{})
+	assert.EqualError(t, err, "invalid DUOKEY_TOKEN_CACHE_KEY: not hex-encoded")
+}
+
+func TestTokenInfo(t *testing.T) {
+
+	server := duokeytest.NewServer(&duokeytest.Config{Roles: []string{"Admin", "KeyUser"}})
+	defer server.Close()
+
+	c, err := client.New(server.Credentials(), silentLogger{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	info, err := c.TokenInfo(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, server.URL, info.Issuer)
+	assert.Equal(t, duokeytest.DefaultUserName, info.Subject)
+	assert.Equal(t, duokeytest.DefaultClientID, info.ClientID)
+	assert.Equal(t, "1", info.TenantID)
+	assert.True(t, info.HasScope(duokeytest.DefaultScope))
+	assert.False(t, info.HasScope("admin"))
+	assert.Equal(t, []string{"Admin", "KeyUser"}, info.Roles)
+	assert.WithinDuration(t, time.Now().Add(duokeytest.DefaultTokenLifetime), info.Expiry, time.Minute)
+
+	// The signature is checked against the JWKS
+	assert.Equal(t, 1, server.Calls(duokeytest.JWKSPath))
+
+	_, err = (&client.Client{}).TokenInfo(context.Background())
+	assert.Error(t, err)
+}
+
+func TestNewErrors(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		setup   func(*duokeytest.Server, *credentials.Config)
+		wantErr string
+	}{
+		{name: "Discovery failure",
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.InjectFault(duokeytest.DiscoveryPath, duokeytest.Fault{StatusCode: http.StatusInternalServerError})
+			},
+			wantErr: "500",
+		},
+		{name: "Issuer mismatch",
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.SetTokenOptions(duokeytest.TokenOptions{Issuer: "https://issuer.example.com"})
+			},
+			wantErr: "issuer did not match",
+		},
+		{name: "Token endpoint failure",
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.InjectFault(duokeytest.TokenPath, duokeytest.Fault{StatusCode: http.StatusServiceUnavailable})
+			},
+			wantErr: "503",
+		},
+		{name: "Wrong password",
+			setup: func(_ *duokeytest.Server, creds *credentials.Config) {
+				creds.Password = "wrong"
+			},
+			wantErr: "invalid_grant",
+		},
+		{name: "Wrong client secret",
+			setup: func(_ *duokeytest.Server, creds *credentials.Config) {
+				creds.ClientSecret = "wrong"
+			},
+			wantErr: "invalid_client",
+		},
+		{name: "Wrong tenant",
+			setup: func(_ *duokeytest.Server, creds *credentials.Config) {
+				creds.TenantID = 42
+			},
+			wantErr: "invalid_request",
+		},
+		{name: "Expired token",
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.SetTokenOptions(duokeytest.TokenOptions{Lifetime: -time.Minute})
+			},
+			wantErr: "failed to check the token",
+		},
+		{name: "Wrong token type",
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.SetTokenOptions(duokeytest.TokenOptions{TokenType: "mac"})
+			},
+			wantErr: "bad token: expected 'Bearer', got 'mac'",
+		},
+		{name: "Scope not granted",
+			setup: func(_ *duokeytest.Server, creds *credentials.Config) {
+				creds.Scope += " admin"
+			},
+			wantErr: "scope not granted: 'admin'",
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+			server := duokeytest.NewServer(nil)
+			defer server.Close()
+
+			creds := server.Credentials()
+			testCase.setup(server, &creds)
+
+			c, err := client.New(creds, silentLogger{})
+			assert.Nil(t, c)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetMandatoryContext(t *testing.T) {
+
+	c := &client.Client{}
+	c.Config.Credentials.AppID = "app"
+	c.Config.Credentials.TenantID = 7
+
+	assert.Equal(t, map[string]string{"appid": "app", "tenantid": "7"}, c.GetMandatoryContext())
+}
+
+func TestClientAssertion(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		signer    crypto.Signer
+		serverKey crypto.PublicKey
+		wantErr   bool
+	}{
+		{name: "RS256", signer: rsaKey, serverKey: rsaKey.Public()},
+		{name: "ES256", signer: ecKey, serverKey: ecKey.Public()},
+		{name: "EdDSA", signer: edKey, serverKey: edKey.Public()},
+		{name: "Unknown key", signer: ecKey, serverKey: rsaKey.Public(), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := duokeytest.NewServer(&duokeytest.Config{ClientPublicKey: tc.serverKey})
+			defer server.Close()
+
+			// The client authenticates without its secret
+			creds := server.Credentials()
+			creds.ClientSecret = ""
+			creds.ClientAssertionSigner = tc.signer
+
+			c, err := client.NewWithConfig(duokey.Config{Credentials: creds, Logger: silentLogger{}})
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer c.Close()
+
+			info, err := c.TokenInfo(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, creds.ClientID, info.ClientID)
+		})
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+
+	server := duokeytest.NewServer(&duokeytest.Config{SubjectTokens: []string{"first"}})
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+
+	// The fake server also checks the tenant header of the token requests
+	creds := server.Credentials()
+	creds.UserName, creds.Password = "", ""
+	creds.SubjectTokenFile = path
+
+	var events []duokey.TokenEvent
+	c, err := client.NewWithConfig(duokey.Config{
+		Credentials: creds,
+		Logger:      silentLogger{},
+		TokenRefresh: duokey.TokenRefreshConfig{
+			Disabled:       true,
+			OnTokenRefresh: func(e duokey.TokenEvent) { events = append(events, e) },
+		},
+	})
+	require.NoError(t, err)
+
+	info, err := c.TokenInfo(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, creds.ClientID, info.Subject)
+
+	// The rotated token is read when a new access token is needed
+	require.NoError(t, ioutil.WriteFile(path, []byte("second\n"), 0600))
+	server.SetSubjectTokens("second")
+	server.RevokeTokens()
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.Calls(duokeytest.TokenPath))
+	require.Len(t, events, 1)
+	assert.Equal(t, credentials.TokenExchangeGrantType, events[0].Grant)
+
+	// A token that cannot be read or exchanged is an error
+	creds.SubjectTokenFile = filepath.Join(t.TempDir(), "missing")
+	_, err = client.New(creds, silentLogger{})
+	assert.Error(t, err)
+
+	server.SetSubjectTokens()
+	creds.SubjectTokenFile = path
+	_, err = client.New(creds, silentLogger{})
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+
+	ca, caKey := newCertificate(t, "DuoKey test CA", nil, nil)
+	clientCert, clientKey := newCertificate(t, "client", ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server := duokeytest.NewTLSServer(&duokeytest.Config{ClientCAs: pool})
+	defer server.Close()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+	config := duokey.Config{
+		Credentials: server.Credentials(),
+		Logger:      silentLogger{},
+		Transport:   duokey.TransportConfig{RootCAs: serverCAs},
+	}
+
+	// The server requires a client certificate
+	_, err := client.NewWithConfig(config)
+	assert.Error(t, err)
+
+	config.Credentials.ClientSecret = ""
+	config.Credentials.ClientCertificate = &tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}
+
+	c, err := client.NewWithConfig(config)
+	require.NoError(t, err)
+	defer c.Close()
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.NoError(t, err)
+}
+
+func TestTransportConfig(t *testing.T) {
+
+	t.Run("Root CA file", func(t *testing.T) {
+		server := duokeytest.NewTLSServer(nil)
+		defer server.Close()
+
+		path := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+		// The server certificate is not trusted by default
+		config := duokey.Config{Credentials: server.Credentials(), Logger: silentLogger{}}
+		_, err := client.NewWithConfig(config)
+		assert.Error(t, err)
+
+		config.Transport = duokey.TransportConfig{RootCAFile: path, DisableHTTP2: true}
+		c, err := client.NewWithConfig(config)
+		require.NoError(t, err)
+		defer c.Close()
+
+		endpoints := server.Endpoints()
+		kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+		keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+		_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Proxy", func(t *testing.T) {
+		server := duokeytest.NewServer(nil)
+		defer server.Close()
+
+		// A forward proxy counting the requests
+		var proxied int32
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&proxied, 1)
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+		defer proxy.Close()
+
+		// The discovery and token requests, then the API request, go through the proxy
+		config := duokey.Config{
+			Credentials: server.Credentials(),
+			Logger:      silentLogger{},
+			Transport:   duokey.TransportConfig{Proxy: proxy.URL, Timeout: 5 * time.Second},
+		}
+		c, err := client.NewWithConfig(config)
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, 5*time.Second, c.Config.HTTPClient.Timeout)
+
+		endpoints := server.Endpoints()
+		kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+		keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+		_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+		require.NoError(t, err)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&proxied))
+
+		// The hosts of NoProxy are reached directly
+		config.Transport.NoProxy = "127.0.0.1"
+		c, err = client.NewWithConfig(config)
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, int32(3), atomic.LoadInt32(&proxied))
+	})
+}
+
+func TestPinnedKeys(t *testing.T) {
+
+	server := duokeytest.NewTLSServer(nil)
+	defer server.Close()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+
+	pin := client.PublicKeyPin(server.Certificate())
+	other, _ := newCertificate(t, "other", nil, nil)
+	otherPin := client.PublicKeyPin(other)
+
+	endpoints := server.Endpoints()
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	testCases := []struct {
+		name         string
+		pins         []string
+		wantMismatch bool
+	}{
+		{name: "Pinned key", pins: []string{pin}},
+		{name: "Rotation", pins: []string{otherPin, "sha256/" + pin}},
+		{name: "Other key", pins: []string{otherPin}, wantMismatch: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := duokey.Config{
+				Credentials: server.Credentials(),
+				Logger:      silentLogger{},
+				Transport:   duokey.TransportConfig{RootCAs: serverCAs, PinnedKeys: tc.pins},
+			}
+
+			c, err := client.NewWithConfig(config)
+			if tc.wantMismatch {
+				var pinErr *client.PinMismatchError
+				require.True(t, errors.As(err, &pinErr), "got %v", err)
+				assert.Contains(t, pinErr.Presented, "sha256/"+pin)
+				return
+			}
+			require.NoError(t, err)
+			defer c.Close()
+
+			kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+			_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+			assert.NoError(t, err)
+		})
+	}
+
+	// The API requests are checked too, even if no token is requested
+	cache, err := tokencache.New(tokencache.Options{Dir: t.TempDir(), Key: make([]byte, 32)})
+	require.NoError(t, err)
+
+	config := duokey.Config{
+		Credentials: server.Credentials(),
+		Logger:      silentLogger{},
+		TokenCache:  cache,
+		Transport:   duokey.TransportConfig{RootCAs: serverCAs, PinnedKeys: []string{pin}},
+	}
+	c, err := client.NewWithConfig(config)
+	require.NoError(t, err)
+	c.Close()
+
+	config.Transport.PinnedKeys = []string{otherPin}
+	c, err = client.NewWithConfig(config)
+	require.NoError(t, err)
+	defer c.Close()
+
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	var pinErr *client.PinMismatchError
+	assert.True(t, errors.As(err, &pinErr), "got %v", err)
+
+	// Invalid pins are rejected
+	config.Transport.PinnedKeys = []string{"not a pin"}
+	_, err = client.NewWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestHandlers(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	c, err := client.New(server.Credentials(), silentLogger{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Audit the operations and inject a fault in the send phase
+	var audit []string
+	c.Handlers.Complete.PushBack(func(r *request.Request) {
+		audit = append(audit, fmt.Sprintf("%s %v", r.Operation.Name, r.Error == nil))
+	})
+	c.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "test.Header", Fn: func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Audit-ID", "42")
+	}})
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+	input := &kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+
+	fault := errors.New("injected fault")
+	c.Handlers.Send.SwapNamed(request.NamedHandler{Name: request.SendHandler.Name, Fn: func(r *request.Request) {
+		r.Error = fault
+	}})
+	_, err = kmsClient.Encrypt(input)
+	assert.ErrorIs(t, err, fault)
+	assert.Equal(t, []string{"Encrypt true", "Encrypt false"}, audit)
+
+	// The handlers are copied: changing those of a request leaves the client unchanged
+	req := c.NewRequest(&request.Operation{Name: "Test"}, nil, nil)
+	req.Handlers.Sign.RemoveByName("test.Header")
+	assert.Equal(t, []string{"test.Header"}, c.Handlers.Sign.Names())
+
+	// A client built without New uses the default handlers
+	defaults := request.DefaultHandlers()
+	req = (&client.Client{}).NewRequest(&request.Operation{Name: "Test"}, nil, nil)
+	assert.Equal(t, defaults.Send.Names(), req.Handlers.Send.Names())
+}
+
+// newCertificate returns a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil
+func newCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+// recordingLogger records all the messages with their fields
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(msg string, keysAndValues []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(append([]interface{}{msg}, keysAndValues...)...))
+}
+
+func (l *recordingLogger) Debug(msg string, kv ...interface{}) { l.record(msg, kv) }
+func (l *recordingLogger) Info(msg string, kv ...interface{})  { l.record(msg, kv) }
+func (l *recordingLogger) Warn(msg string, kv ...interface{})  { l.record(msg, kv) }
+func (l *recordingLogger) Error(msg string, kv ...interface{}) { l.record(msg, kv) }
+
+func (l *recordingLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprint(l.lines)
+}
+
+func TestWireLog(t *testing.T) {
+
+	testCases := []struct {
+		name         string
+		wireLog      duokey.WireLogConfig
+		showPayloads bool
+		showSecrets  bool
+	}{
+		{name: "Disabled"},
+		{name: "Masked", wireLog: duokey.WireLogConfig{Enabled: true}},
+		{name: "Payloads", wireLog: duokey.WireLogConfig{Enabled: true, ShowPayloads: true}, showPayloads: true},
+		{name: "Secrets", wireLog: duokey.WireLogConfig{Enabled: true, ShowSecrets: true}, showSecrets: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := duokeytest.NewServer(nil)
+			defer server.Close()
+
+			logger := &recordingLogger{}
+			creds := server.Credentials()
+			c, err := client.NewWithConfig(duokey.Config{Credentials: creds, LeveledLogger: logger, WireLog: tc.wireLog})
+			require.NoError(t, err)
+			defer c.Close()
+
+			endpoints := server.Endpoints()
+			kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+			keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+			payload := []byte("Lorem ipsum dolor sit amet")
+			encrypted, err := kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: payload})
+			require.NoError(t, err)
+
+			log := logger.String()
+			if !tc.wireLog.Enabled {
+				assert.NotContains(t, log, "HTTP request")
+				return
+			}
+
+			assert.Contains(t, log, "HTTP request")
+			assert.Contains(t, log, "HTTP response")
+			assert.Contains(t, log, keyID, "the other fields are shown")
+
+			// The password, the tokens (JWTs) and the Authorization header
+			assert.Equal(t, tc.showSecrets, strings.Contains(log, url.Values{"password": {creds.Password}}.Encode()), "password")
+			assert.Equal(t, tc.showSecrets, strings.Contains(log, "eyJ"), "tokens")
+			assert.Equal(t, tc.showSecrets, strings.Contains(log, "Authorization:[Bearer ey"), "authorization header")
+
+			payloads := []string{base64.StdEncoding.EncodeToString(payload), encrypted.Result.EncryptedPayload}
+			for _, p := range payloads {
+				assert.Equal(t, tc.showPayloads, strings.Contains(log, p), p)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	c, err := client.NewWithConfig(duokey.Config{
+		Credentials: server.Credentials(),
+		Logger:      silentLogger{},
+		RateLimit: duokey.RateLimitConfig{
+			Global:     duokey.Limit{MaxInFlight: 4},
+			Operations: map[string]duokey.Limit{"Encrypt": {Rate: 20}},
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+	input := &kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	// One request every 50ms after the first one
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := kmsClient.Encrypt(input)
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+
+	// A caller with a short deadline fails fast
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = kmsClient.EncryptWithContext(ctx, input)
+	assert.ErrorIs(t, err, client.ErrRateLimited)
+
+	// A request throttled by the server is retried
+	server.InjectFault(duokeytest.EncryptRoute, duokeytest.Fault{StatusCode: http.StatusTooManyRequests, Count: 1})
+	time.Sleep(50 * time.Millisecond)
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+
+	// The server-side throttling is reported as such once the retries are
+	// exhausted
+	server.InjectFault(duokeytest.EncryptRoute, duokeytest.Fault{StatusCode: http.StatusTooManyRequests, Count: 3})
+	_, err = kmsClient.Encrypt(input)
+	var errResp *request.ErrorResponse
+	require.ErrorAs(t, err, &errResp)
+	assert.Equal(t, http.StatusTooManyRequests, errResp.StatusCode)
+}
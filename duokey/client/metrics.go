@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// Name of the metrics handler
+const observeRequestHandlerName = "duokey.ObserveRequest"
+
+// addMetrics adds the handler recording the requests with metrics
+func addMetrics(h *request.Handlers, metrics duokey.Metrics, tenantID uint32) {
+	h.Complete.PushBackNamed(request.NamedHandler{Name: observeRequestHandlerName, Fn: func(r *request.Request) {
+		observation := duokey.RequestObservation{
+			Operation:    r.Operation.Name,
+			TenantID:     tenantID,
+			ErrorKind:    requestErrorKind(r),
+			Duration:     time.Since(r.SendTime),
+			Retries:      r.RetryCount,
+			RequestSize:  len(r.Body),
+			ResponseSize: -1,
+		}
+		if r.HTTPResponse != nil {
+			observation.StatusCode = r.HTTPResponse.StatusCode
+			observation.ResponseSize = r.HTTPResponse.ContentLength
+		}
+		metrics.ObserveRequest(observation)
+	}})
+}
+
+// requestErrorKind classifies the error of a request, with the phase it
+// failed in when the error itself is not telling
+func requestErrorKind(r *request.Request) string {
+	kind := errorKind(r.Error)
+	if kind != duokey.ErrorKindOther {
+		return kind
+	}
+
+	switch {
+	case r.HTTPResponse != nil:
+		return duokey.ErrorKindInvalidResponse
+	case r.AttemptTime.IsZero():
+		// The request failed in the Build phase
+		return duokey.ErrorKindInvalidRequest
+	}
+	return kind
+}
+
+// errorKind classifies err (see the duokey.ErrorKind constants)
+func errorKind(err error) string {
+	var errResp *request.ErrorResponse
+	var retrieveErr *oauth2.RetrieveError
+	var netErr net.Error
+	var urlErr *url.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrRateLimited):
+		return duokey.ErrorKindRateLimited
+	case errors.Is(err, context.Canceled):
+		return duokey.ErrorKindCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return duokey.ErrorKindTimeout
+	case errors.As(err, &errResp):
+		if errResp.Unauthorized() {
+			return duokey.ErrorKindUnauthorized
+		}
+		return statusErrorKind(errResp.StatusCode)
+	case errors.As(err, &retrieveErr):
+		if retrieveErr.Response == nil {
+			return duokey.ErrorKindOther
+		}
+		return statusErrorKind(retrieveErr.Response.StatusCode)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return duokey.ErrorKindTimeout
+	case errors.As(err, &urlErr):
+		return duokey.ErrorKindNetwork
+	}
+	return duokey.ErrorKindOther
+}
+
+// statusErrorKind classifies an error status
+func statusErrorKind(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return duokey.ErrorKindUnauthorized
+	case status == http.StatusTooManyRequests:
+		return duokey.ErrorKindRateLimited
+	case status >= http.StatusInternalServerError:
+		return duokey.ErrorKindServer
+	}
+	return duokey.ErrorKindClient
+}
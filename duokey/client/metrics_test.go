@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorKind(t *testing.T) {
+
+	testCases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"No error", nil, ""},
+		{"Canceled", errors.Wrap(context.Canceled, "failed to make HTTP request"), duokey.ErrorKindCanceled},
+		{"Deadline", &url.Error{Op: "Post", URL: "https://duokey.example", Err: context.DeadlineExceeded}, duokey.ErrorKindTimeout},
+		{"Network timeout", &url.Error{Op: "Post", URL: "https://duokey.example", Err: timeoutError{}}, duokey.ErrorKindTimeout},
+		{"Connection refused", errors.Wrap(&url.Error{Op: "Post", URL: "https://duokey.example", Err: errors.New("connection refused")}, "failed"), duokey.ErrorKindNetwork},
+		{"Unauthorized", &request.ErrorResponse{StatusCode: http.StatusUnauthorized}, duokey.ErrorKindUnauthorized},
+		{"Unauthorized envelope", &request.ErrorResponse{StatusCode: http.StatusOK, Body: []byte(`{"unAuthorizedRequest":true}`)}, duokey.ErrorKindUnauthorized},
+		{"Not found", &request.ErrorResponse{StatusCode: http.StatusNotFound}, duokey.ErrorKindClient},
+		{"Throttled", &request.ErrorResponse{StatusCode: http.StatusTooManyRequests}, duokey.ErrorKindRateLimited},
+		{"Client-side rate limit", errors.Wrap(ErrRateLimited, "Encrypt would wait 1s"), duokey.ErrorKindRateLimited},
+		{"Server error", errors.Wrap(&request.ErrorResponse{StatusCode: http.StatusBadGateway}, "encrypt"), duokey.ErrorKindServer},
+		{"Token rejected", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, duokey.ErrorKindUnauthorized},
+		{"Token endpoint down", &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}}, duokey.ErrorKindServer},
+		{"Other", errors.New("invalid token"), duokey.ErrorKindOther},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, errorKind(tc.err))
+		})
+	}
+}
+
+// recordingMetrics keeps the observations
+type recordingMetrics struct {
+	requests []duokey.RequestObservation
+}
+
+func (m *recordingMetrics) ObserveRequest(o duokey.RequestObservation) {
+	m.requests = append(m.requests, o)
+}
+
+func (m *recordingMetrics) ObserveToken(duokey.TokenObservation) {}
+
+func TestObserveInvalidRequest(t *testing.T) {
+
+	metrics := &recordingMetrics{}
+	handlers := request.DefaultHandlers()
+	addMetrics(&handlers, metrics, 42)
+	c := &Client{Handlers: handlers}
+
+	var params struct {
+		KeyID string `validate:"nonzero"`
+	}
+	err := c.NewRequest(&request.Operation{Name: "Encrypt", HTTPMethod: http.MethodPost}, &params, &struct{}{}).Send()
+	assert.Error(t, err)
+
+	// The request is observed although it was never sent
+	if assert.Len(t, metrics.requests, 1) {
+		observation := metrics.requests[0]
+		assert.Equal(t, "Encrypt", observation.Operation)
+		assert.Equal(t, uint32(42), observation.TenantID)
+		assert.Equal(t, duokey.ErrorKindInvalidRequest, observation.ErrorKind)
+		assert.Zero(t, observation.StatusCode)
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// pinPrefix is the optional prefix of the pins
+const pinPrefix = "sha256/"
+
+// PinMismatchError is returned when no certificate presented by a server
+// matches the pinned keys (see duokey.TransportConfig.PinnedKeys).
+type PinMismatchError struct {
+	Host string
+	// Presented are the pins of the certificates presented by the server
+	Presented []string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("public key pinning failed for %s: none of the presented keys (%s) is pinned", e.Host, strings.Join(e.Presented, ", "))
+}
+
+// PublicKeyPin returns the pin of a certificate: the base64-encoded SHA-256
+// hash of its subject public key info.
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPins returns a tls.Config.VerifyConnection function checking that a
+// verified chain of the server contains a pinned key. It runs after the usual
+// verification of the certificates.
+func verifyPins(pins []string) (func(tls.ConnectionState) error, error) {
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix)
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin: %s", pin)
+		}
+		pinned[pin] = true
+	}
+
+	return func(cs tls.ConnectionState) error {
+		// The other certificates sent by the server are not trusted: anyone
+		// can append the pinned certificate to its chain. Without verified
+		// chains (InsecureSkipVerify), only the leaf is checked.
+		chains := cs.VerifiedChains
+		if len(chains) == 0 && len(cs.PeerCertificates) > 0 {
+			chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+		}
+
+		var presented []string
+		seen := make(map[string]bool)
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := PublicKeyPin(cert)
+				if pinned[pin] {
+					return nil
+				}
+				if !seen[pin] {
+					seen[pin] = true
+					presented = append(presented, pinPrefix+pin)
+				}
+			}
+		}
+
+		return &PinMismatchError{Host: cs.ServerName, Presented: presented}
+	}, nil
+}
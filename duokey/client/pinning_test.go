@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPins(t *testing.T) {
+
+	leaf, ca, rogue := testCertificate(t), testCertificate(t), testCertificate(t)
+
+	testCases := []struct {
+		name    string
+		pins    []string
+		state   tls.ConnectionState
+		wantErr bool
+	}{
+		{name: "Leaf",
+			pins:  []string{PublicKeyPin(leaf)},
+			state: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca}}},
+		},
+		{name: "CA",
+			pins:  []string{"sha256/" + PublicKeyPin(ca)},
+			state: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca}}},
+		},
+		{name: "Unverified certificate appended by the server",
+			pins:    []string{PublicKeyPin(ca)},
+			state:   tls.ConnectionState{PeerCertificates: []*x509.Certificate{rogue, ca}, VerifiedChains: [][]*x509.Certificate{{rogue}}},
+			wantErr: true,
+		},
+		{name: "No verified chain",
+			pins:    []string{PublicKeyPin(ca)},
+			state:   tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			verify, err := verifyPins(tc.pins)
+			require.NoError(t, err)
+
+			err = verify(tc.state)
+			if !tc.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			var pinErr *PinMismatchError
+			assert.True(t, errors.As(err, &pinErr))
+		})
+	}
+
+	// A pin must be a base64-encoded SHA-256 hash
+	_, err := verifyPins([]string{"sha256/c2hvcnQ="})
+	assert.Error(t, err)
+}
+
+// testCertificate returns a certificate with a new key. The signature is not
+// checked by verifyPins.
+func testCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
@@ -0,0 +1,327 @@
+package client
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+)
+
+// ErrRateLimited is returned when a request could not be sent before the
+// deadline of its context because of the client-side rate limits
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// Names of the rate limiting handlers
+const (
+	acquireLimitHandlerName   = "duokey.AcquireLimit"
+	releaseLimitHandlerName   = "duokey.ReleaseLimit"
+	retryThrottledHandlerName = "duokey.RetryThrottled"
+)
+
+// Bounds of the adaptation of the rates to the 429 responses: the rate is
+// halved down to 1/minRateDivisor of the configured rate, and recovers by
+// 1/recoverySteps of the configured rate on each accepted request.
+const (
+	minRateDivisor = 16
+	recoverySteps  = 20
+)
+
+// maxThrottledRetries is the number of times a request rejected with a 429
+// response is retried
+const maxThrottledRetries = 2
+
+// limitKey is the context key of the limitState of a request
+type limitKey struct{}
+
+// limitState tracks the limits taken by the attempts of a request
+type limitState struct {
+	release   func() // Set while an attempt holds the limits
+	throttled int    // Number of retries after a 429 response
+}
+
+// addRateLimit adds the handlers limiting the requests. Each attempt takes
+// its own token and slot, so that the retries after a renewal of the token,
+// a failover or a 429 response are limited as well.
+func addRateLimit(h *request.Handlers, config duokey.RateLimitConfig) {
+	limiter := newRateLimiter(config, time.Now)
+
+	// endAttempt releases the limits of the attempt in progress and adapts the
+	// rates to its response
+	endAttempt := func(r *request.Request) {
+		state, ok := r.HTTPRequest.Context().Value(limitKey{}).(*limitState)
+		if !ok || state.release == nil {
+			return
+		}
+		state.release()
+		state.release = nil
+
+		if r.HTTPResponse != nil {
+			limiter.observe(r.Operation.Name, r.HTTPResponse)
+		}
+	}
+
+	h.Sign.PushBackNamed(request.NamedHandler{Name: acquireLimitHandlerName, Fn: func(r *request.Request) {
+		ctx := r.HTTPRequest.Context()
+		state, ok := ctx.Value(limitKey{}).(*limitState)
+		if !ok {
+			state = &limitState{}
+			r.HTTPRequest = r.HTTPRequest.WithContext(context.WithValue(ctx, limitKey{}, state))
+		}
+
+		release, err := limiter.acquire(ctx, r.Operation.Name)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		state.release = release
+	}})
+
+	h.Retry.PushFrontNamed(request.NamedHandler{Name: releaseLimitHandlerName, Fn: endAttempt})
+
+	// The 429 responses are retried once the pause set by Retry-After is over
+	// (acquire fails fast if the deadline of the request is too short)
+	h.Retry.PushBackNamed(request.NamedHandler{Name: retryThrottledHandlerName, Fn: func(r *request.Request) {
+		state, ok := r.HTTPRequest.Context().Value(limitKey{}).(*limitState)
+		if !ok || r.Retryable || r.HTTPResponse == nil || r.HTTPResponse.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		if state.throttled < maxThrottledRetries && r.HTTPRequest.Context().Err() == nil {
+			state.throttled++
+			r.Retryable = true
+		}
+	}})
+
+	h.Complete.PushFrontNamed(request.NamedHandler{Name: releaseLimitHandlerName, Fn: endAttempt})
+}
+
+// rateLimiter applies the global limit and the limits of the operations
+type rateLimiter struct {
+	global     *limit
+	operations map[string]*limit
+	now        func() time.Time
+
+	mu          sync.Mutex
+	pausedUntil time.Time // Set by Retry-After
+}
+
+func newRateLimiter(config duokey.RateLimitConfig, now func() time.Time) *rateLimiter {
+	l := &rateLimiter{
+		global:     newLimit(config.Global, now()),
+		operations: make(map[string]*limit),
+		now:        now,
+	}
+	for name, operation := range config.Operations {
+		l.operations[name] = newLimit(operation, now())
+	}
+	return l
+}
+
+// acquire waits until a request of operation can be sent, and returns the
+// function to call once it completes
+func (l *rateLimiter) acquire(ctx context.Context, operation string) (func(), error) {
+	limits := []*limit{l.global}
+	if op, ok := l.operations[operation]; ok {
+		limits = append(limits, op)
+	}
+
+	// Slots first, so that waiting requests do not consume the rate
+	var acquired []*limit
+	release := func() {
+		for _, lim := range acquired {
+			lim.release()
+		}
+	}
+	for _, lim := range limits {
+		if err := lim.acquireSlot(ctx); err != nil {
+			release()
+			return nil, errors.Wrap(err, "failed to wait for the rate limit")
+		}
+		acquired = append(acquired, lim)
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	delay := l.pausedUntil.Sub(now)
+	l.mu.Unlock()
+
+	var reserved []*limit
+	for _, lim := range limits {
+		if d, ok := lim.reserve(now); ok {
+			reserved = append(reserved, lim)
+			if d > delay {
+				delay = d
+			}
+		}
+	}
+	cancel := func() {
+		for _, lim := range reserved {
+			lim.cancel(now)
+		}
+		release()
+	}
+
+	if delay <= 0 {
+		return release, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		cancel()
+		return nil, errors.Wrapf(ErrRateLimited, "%s would wait %v", operation, delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return release, nil
+	case <-ctx.Done():
+		cancel()
+		return nil, errors.Wrap(ctx.Err(), "failed to wait for the rate limit")
+	}
+}
+
+// observe adapts the rates to the response of a request of operation
+func (l *rateLimiter) observe(operation string, resp *http.Response) {
+	now := l.now()
+	limits := []*limit{l.global}
+	if op, ok := l.operations[operation]; ok {
+		limits = append(limits, op)
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		for _, lim := range limits {
+			lim.restore(now)
+		}
+		return
+	}
+
+	for _, lim := range limits {
+		lim.throttle(now)
+	}
+	if delay, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok {
+		l.mu.Lock()
+		if until := now.Add(delay); until.After(l.pausedUntil) {
+			l.pausedUntil = until
+		}
+		l.mu.Unlock()
+	}
+}
+
+// retryAfter parses a Retry-After header: a number of seconds or an HTTP date
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// limit is a token bucket and a number of slots. A limit with zero values
+// does not limit.
+type limit struct {
+	slots chan struct{} // nil if MaxInFlight is not set
+
+	mu         sync.Mutex
+	configured float64 // Configured rate (0 if not set)
+	rate       float64 // Current rate
+	burst      float64
+	tokens     float64
+	last       time.Time // Last refill of the bucket
+}
+
+func newLimit(config duokey.Limit, now time.Time) *limit {
+	l := &limit{configured: config.Rate, rate: config.Rate, burst: math.Max(1, float64(config.Burst)), last: now}
+	l.tokens = l.burst
+	if config.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, config.MaxInFlight)
+	}
+	return l
+}
+
+func (l *limit) acquireSlot(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limit) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// reserve takes a token, possibly in advance, and returns the delay until it
+// is available. It reports false if the rate is not limited.
+func (l *limit) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0, false
+	}
+	l.refill(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// cancel gives back a reserved token
+func (l *limit) cancel(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	l.tokens = math.Min(l.tokens+1, l.burst)
+}
+
+// throttle halves the rate after a 429 response
+func (l *limit) throttle(now time.Time) {
+	l.setRate(now, func(rate float64) float64 {
+		return math.Max(rate/2, l.configured/minRateDivisor)
+	})
+}
+
+// restore increases the rate back to the configured one
+func (l *limit) restore(now time.Time) {
+	l.setRate(now, func(rate float64) float64 {
+		return math.Min(rate+l.configured/recoverySteps, l.configured)
+	})
+}
+
+func (l *limit) setRate(now time.Time, update func(float64) float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.configured == 0 {
+		return
+	}
+	l.refill(now)
+	l.rate = update(l.rate)
+}
+
+// refill adds the tokens accumulated since the last refill
+func (l *limit) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.tokens+elapsed.Seconds()*l.rate, l.burst)
+		l.last = now
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLimitReserve(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLimit(duokey.Limit{Rate: 10, Burst: 2}, clock.Now())
+
+	// The burst, then one token every 100ms
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		delay, ok := l.reserve(clock.Now())
+		require.True(t, ok)
+		assert.Equal(t, want, delay, "request %d", i)
+	}
+
+	// Three tokens later, the bucket is back to one
+	clock.Advance(300 * time.Millisecond)
+	delay, _ := l.reserve(clock.Now())
+	assert.Zero(t, delay)
+	delay, _ = l.reserve(clock.Now())
+	assert.Equal(t, 100*time.Millisecond, delay)
+
+	// A cancelled reservation is given back
+	l.cancel(clock.Now())
+	delay, _ = l.reserve(clock.Now())
+	assert.Equal(t, 100*time.Millisecond, delay)
+
+	// No rate
+	_, ok := newLimit(duokey.Limit{MaxInFlight: 1}, clock.Now()).reserve(clock.Now())
+	assert.False(t, ok)
+}
+
+func TestLimitAdaptation(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLimit(duokey.Limit{Rate: 32}, clock.Now())
+
+	for i := 0; i < 10; i++ {
+		l.throttle(clock.Now())
+	}
+	assert.Equal(t, 2.0, l.rate, "halved down to 1/16 of the configured rate")
+
+	for i := 0; i < 100; i++ {
+		l.restore(clock.Now())
+	}
+	assert.Equal(t, 32.0, l.rate, "recovered up to the configured rate")
+}
+
+func TestRetryAfter(t *testing.T) {
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"Fri, 01 Mar 2024 12:00:05 GMT", 5 * time.Second, true},
+		{"soon", 0, false},
+		{"-1", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			delay, ok := retryAfter(tc.value, now)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.want, delay)
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	t.Run("Max in flight", func(t *testing.T) {
+		limiter := newRateLimiter(duokey.RateLimitConfig{
+			Global:     duokey.Limit{MaxInFlight: 3},
+			Operations: map[string]duokey.Limit{"Encrypt": {MaxInFlight: 2}},
+		}, time.Now)
+
+		var inFlight, maxInFlight int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := limiter.acquire(context.Background(), "Encrypt")
+				if !assert.NoError(t, err) {
+					return
+				}
+				n := atomic.AddInt32(&inFlight, 1)
+				for {
+					max := atomic.LoadInt32(&maxInFlight)
+					if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				release()
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(2), maxInFlight)
+	})
+
+	t.Run("Fail fast", func(t *testing.T) {
+		limiter := newRateLimiter(duokey.RateLimitConfig{Global: duokey.Limit{Rate: 1}}, time.Now)
+
+		release, err := limiter.acquire(context.Background(), "Encrypt")
+		require.NoError(t, err)
+		release()
+
+		// The next token is a second away
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = limiter.acquire(ctx, "Encrypt")
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Less(t, time.Since(start), 50*time.Millisecond, "no wait")
+	})
+
+	t.Run("Canceled while waiting for a slot", func(t *testing.T) {
+		limiter := newRateLimiter(duokey.RateLimitConfig{Global: duokey.Limit{MaxInFlight: 1}}, time.Now)
+
+		release, err := limiter.acquire(context.Background(), "Decrypt")
+		require.NoError(t, err)
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = limiter.acquire(ctx, "Decrypt")
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("Retry-After", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		limiter := newRateLimiter(duokey.RateLimitConfig{Global: duokey.Limit{MaxInFlight: 10}}, clock.Now)
+
+		limiter.observe("Encrypt", &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"2"}}})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := limiter.acquire(ctx, "Decrypt")
+		assert.ErrorIs(t, err, ErrRateLimited, "all the operations are paused")
+
+		clock.Advance(2 * time.Second)
+		release, err := limiter.acquire(ctx, "Decrypt")
+		require.NoError(t, err)
+		release()
+	})
+}
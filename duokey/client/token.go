@@ -0,0 +1,430 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"golang.org/x/oauth2"
+)
+
+// Bounds of the delay between two attempts when a background refresh fails
+const (
+	minRefreshRetry = time.Second
+	maxRefreshRetry = time.Minute
+)
+
+// grantFunc obtains a new token from the issuer
+type grantFunc func(ctx context.Context) (*oauth2.Token, error)
+
+// configFunc returns the OAuth 2 configuration. It is only called when a token
+// is needed, so that a cached token spares the OIDC discovery.
+type configFunc func(ctx context.Context) (*oauth2.Config, error)
+
+// tokenManager is the token source of the DuoKey client. It caches the access
+// token, renews it when a request finds it expired and, unless disabled,
+// refreshes it in the background before it expires.
+type tokenManager struct {
+	ctx       context.Context // Carries the HTTP client of the token requests
+	config    configFunc
+	grantType string
+	grant     grantFunc
+	refresh   duokey.TokenRefreshConfig
+	logger    duokey.LeveledLogger
+	tracer    duokey.Tracer  // Optional
+	metrics   duokey.Metrics // Optional
+
+	cache    duokey.TokenCache // Optional
+	cacheKey duokey.TokenCacheKey
+
+	creds         credentials.Config
+	verifierMutex sync.Mutex
+	tokenVerifier *oidc.IDTokenVerifier // See verifier
+
+	mu         sync.Mutex
+	token      *oauth2.Token
+	obtained   time.Time     // When token was obtained
+	refreshing chan struct{} // Closed when the background refresh in progress, if any, ends
+
+	renewed  chan struct{} // Signaled when a request renews the token
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	after func(time.Duration) <-chan time.Time // Injectable for tests
+}
+
+// Ensure that tokenManager implements the oauth2.TokenSource and
+// duokey.Authenticator interfaces
+var (
+	_ oauth2.TokenSource   = (*tokenManager)(nil)
+	_ duokey.Authenticator = (*tokenManager)(nil)
+)
+
+func newTokenManager(ctx context.Context, config configFunc, grantType string, grant grantFunc, refresh duokey.TokenRefreshConfig, logger duokey.LeveledLogger) *tokenManager {
+	if refresh.Before <= 0 {
+		refresh.Before = duokey.DefaultRefreshBefore
+	}
+	if refresh.Jitter <= 0 {
+		refresh.Jitter = duokey.DefaultRefreshJitter
+	}
+
+	return &tokenManager{
+		ctx:       ctx,
+		config:    config,
+		grantType: grantType,
+		grant:     grant,
+		refresh:   refresh,
+		logger:    logger,
+		renewed:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		after:     time.After,
+	}
+}
+
+// init obtains the first token, from the cache if it holds a valid one, and
+// starts the background refresh. An expired cached token is renewed with its
+// refresh token, if any.
+func (m *tokenManager) init() error {
+	token, expired := m.load()
+
+	if token == nil {
+		var err error
+		if token, _, err = m.fetch(m.ctx, expired); err != nil {
+			return err
+		}
+
+		m.store(token)
+	}
+
+	m.token = token
+	m.obtained = time.Now()
+
+	if m.refresh.Disabled {
+		close(m.done)
+	} else {
+		go m.run()
+	}
+
+	return nil
+}
+
+// Token returns the cached token, or a new one if it has expired. Concurrent
+// callers wait for a single renewal.
+func (m *tokenManager) Token() (*oauth2.Token, error) {
+	return m.tokenContext(m.ctx)
+}
+
+// tokenContext is like Token, but the token is renewed with ctx (e.g. the
+// context of the API request needing it)
+func (m *tokenManager) tokenContext(ctx context.Context) (*oauth2.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token.Valid() {
+		return m.token, nil
+	}
+
+	m.waitRefresh()
+	if m.token.Valid() {
+		return m.token, nil
+	}
+
+	if err := m.renew(m.withHTTPClient(ctx)); err != nil {
+		return nil, err
+	}
+
+	return m.token, nil
+}
+
+// withHTTPClient returns ctx with the HTTP client of the token requests
+func (m *tokenManager) withHTTPClient(ctx context.Context) context.Context {
+	if ctx == m.ctx {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, m.ctx.Value(oauth2.HTTPClient))
+}
+
+// Reauthenticate implements duokey.Authenticator. The renewal is made while
+// holding the lock, so that the requests rejected together wait for it and
+// then skip their own.
+func (m *tokenManager) Reauthenticate(ctx context.Context, sentAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.waitRefresh()
+	if m.obtained.After(sentAt) {
+		return nil
+	}
+
+	m.logger.Info("access token rejected by the server, renewing it")
+
+	return m.renew(m.withHTTPClient(ctx))
+}
+
+// waitRefresh waits for the background refresh in progress, if any, so that
+// a refresh token is never spent twice. The caller must hold the lock, which
+// is released while waiting.
+func (m *tokenManager) waitRefresh() {
+	for m.refreshing != nil {
+		refreshing := m.refreshing
+		m.mu.Unlock()
+		<-refreshing
+		m.mu.Lock()
+	}
+}
+
+// renew replaces the token. The caller must hold the lock and have waited for
+// the background refresh (see waitRefresh).
+func (m *tokenManager) renew(ctx context.Context) error {
+	token, grantType, err := m.fetch(ctx, m.token)
+	if err != nil {
+		return err
+	}
+
+	m.token = token
+	m.obtained = time.Now()
+	m.store(token)
+	m.notify(grantType, token)
+
+	// Reschedule the background refresh from the new expiry
+	select {
+	case m.renewed <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// fetch obtains a new token: with the refresh token of current if any, by
+// running the grant again otherwise (or if the refresh fails). The granted
+// scopes are checked on every renewal. The acquisition is traced as a child
+// of the span of ctx.
+func (m *tokenManager) fetch(ctx context.Context, current *oauth2.Token) (token *oauth2.Token, grantType string, err error) {
+	if m.metrics != nil {
+		start := time.Now()
+		defer func() {
+			m.metrics.ObserveToken(duokey.TokenObservation{
+				TenantID:  m.creds.TenantID,
+				GrantType: grantType,
+				ErrorKind: errorKind(err),
+				Duration:  time.Since(start),
+			})
+		}()
+	}
+	if m.tracer != nil {
+		var span duokey.Span
+		ctx, span = m.tracer.Start(ctx, duokey.SpanAcquireToken)
+		defer func() {
+			span.SetAttribute(duokey.AttributeGrantType, grantType)
+			span.End(err)
+		}()
+	}
+
+	if current != nil && current.RefreshToken != "" {
+		token, err := m.refreshToken(ctx, current.RefreshToken)
+		if err == nil {
+			if err := checkScope(token, m.creds); err != nil {
+				return nil, "refresh_token", err
+			}
+			return token, "refresh_token", nil
+		}
+		m.logger.Warn("could not refresh the token, running the grant again", "grant_type", m.grantType, "error", err)
+	}
+
+	token, err = m.grant(ctx)
+	if err != nil {
+		return nil, m.grantType, err
+	}
+
+	if err := checkToken(token); err != nil {
+		return nil, m.grantType, err
+	}
+
+	if err := checkScope(token, m.creds); err != nil {
+		return nil, m.grantType, err
+	}
+
+	return token, m.grantType, nil
+}
+
+// refreshToken obtains a new token with the refresh_token grant
+func (m *tokenManager) refreshToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	config, err := m.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := &oauth2.Token{RefreshToken: refreshToken}
+	token, err := config.TokenSource(ctx, expired).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, checkToken(token)
+}
+
+// load returns the cached token if it is still valid. Otherwise, it returns
+// the cached token as expired if it holds a refresh token.
+func (m *tokenManager) load() (token, expired *oauth2.Token) {
+	if m.cache == nil {
+		return nil, nil
+	}
+
+	token, err := m.cache.Load(m.cacheKey)
+	if err != nil {
+		m.logger.Warn("could not read the token cache", "error", err)
+		return nil, nil
+	}
+
+	if token == nil {
+		return nil, nil
+	}
+	if checkToken(token) != nil {
+		if token.RefreshToken != "" {
+			return nil, token
+		}
+		return nil, nil
+	}
+
+	return token, nil
+}
+
+// store saves a new token in the cache
+func (m *tokenManager) store(token *oauth2.Token) {
+	if m.cache == nil {
+		return
+	}
+
+	if err := m.cache.Store(m.cacheKey, token); err != nil {
+		m.logger.Warn("could not write the token cache", "error", err)
+	}
+}
+
+// run refreshes the token in the background until close is called
+func (m *tokenManager) run() {
+	defer close(m.done)
+
+	retry := minRefreshRetry
+	var delay time.Duration // Backoff after a failure, 0 to schedule from the expiry
+
+	for {
+		m.mu.Lock()
+		current := m.token
+		m.mu.Unlock()
+
+		// Tokens without expiry are only refreshed once a renewal sets one
+		var timer <-chan time.Time
+		switch {
+		case delay > 0:
+			timer = m.after(delay)
+		case !current.Expiry.IsZero():
+			timer = m.after(m.nextRefresh(current.Expiry))
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-m.renewed:
+			retry, delay = minRefreshRetry, 0
+			continue
+		case <-timer:
+		}
+
+		// A request may have renewed the token meanwhile: the refresh is then
+		// rescheduled. The renewals by the requests hold the lock and wait for
+		// refreshing, so the fetches are serialized and current is still the
+		// token when the fetch returns.
+		m.mu.Lock()
+		if m.token != current {
+			select {
+			case <-m.renewed:
+			default:
+			}
+			m.mu.Unlock()
+			retry, delay = minRefreshRetry, 0
+			continue
+		}
+		refreshing := make(chan struct{})
+		m.refreshing = refreshing
+		m.mu.Unlock()
+
+		// Fetch without holding the lock: requests keep using the current token meanwhile
+		token, grantType, err := m.fetch(m.ctx, current)
+
+		m.mu.Lock()
+		if err == nil {
+			m.token = token
+			m.obtained = time.Now()
+		}
+		m.refreshing = nil
+		close(refreshing)
+		m.mu.Unlock()
+
+		if err != nil {
+			m.logger.Error("could not refresh the token", "error", err)
+			if m.refresh.OnTokenError != nil {
+				m.refresh.OnTokenError(err)
+			}
+
+			delay = retry
+			if retry *= 2; retry > maxRefreshRetry {
+				retry = maxRefreshRetry
+			}
+			continue
+		}
+
+		m.store(token)
+		m.notify(grantType, token)
+
+		retry = minRefreshRetry
+		delay = 0
+	}
+}
+
+// nextRefresh returns the delay until the next refresh: Before plus a random
+// jitter ahead of expiry, but not before half of the remaining lifetime
+func (m *tokenManager) nextRefresh(expiry time.Time) time.Duration {
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		return minRefreshRetry
+	}
+
+	lead := m.refresh.Before + time.Duration(rand.Int63n(int64(m.refresh.Jitter)))
+	if lead > remaining/2 {
+		lead = remaining / 2
+	}
+
+	return remaining - lead
+}
+
+func (m *tokenManager) notify(grantType string, token *oauth2.Token) {
+	if m.refresh.OnTokenRefresh != nil {
+		m.refresh.OnTokenRefresh(duokey.TokenEvent{Grant: grantType, Expiry: token.Expiry})
+	}
+}
+
+// close stops the background refresh
+func (m *tokenManager) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+// checkToken validates a token returned by the issuer
+func checkToken(token *oauth2.Token) error {
+	if !token.Valid() {
+		return fmt.Errorf("failed to check the token")
+	}
+
+	if token.TokenType != "Bearer" {
+		return fmt.Errorf("bad token: expected 'Bearer', got '%s'", token.TokenType)
+	}
+
+	return nil
+}
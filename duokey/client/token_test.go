@@ -0,0 +1,364 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeGrant returns a new Bearer token valid for an hour on each call, or the
+// scripted errors first
+type fakeGrant struct {
+	mu     sync.Mutex
+	calls  int
+	errors []error
+}
+
+func (g *fakeGrant) grant(context.Context) (*oauth2.Token, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.calls++
+	if len(g.errors) > 0 {
+		err := g.errors[0]
+		g.errors = g.errors[1:]
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: "token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func (g *fakeGrant) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls
+}
+
+// manualTimer replaces time.After: the test decides when the timers fire
+type manualTimer struct {
+	delays chan time.Duration
+	fire   chan time.Time
+}
+
+func newManualTimer() *manualTimer {
+	return &manualTimer{delays: make(chan time.Duration, 10), fire: make(chan time.Time)}
+}
+
+func (m *manualTimer) after(d time.Duration) <-chan time.Time {
+	m.delays <- d
+	return m.fire
+}
+
+func staticConfig(config *oauth2.Config) configFunc {
+	return func(context.Context) (*oauth2.Config, error) { return config, nil }
+}
+
+func TestNextRefresh(t *testing.T) {
+
+	m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", nil,
+		duokey.TokenRefreshConfig{Before: time.Minute, Jitter: time.Second}, duokey.NewSilentLogger())
+
+	testCases := []struct {
+		name     string
+		lifetime time.Duration
+		min, max time.Duration
+	}{
+		{name: "Long-lived token", lifetime: time.Hour, min: 58*time.Minute + 58*time.Second, max: 59 * time.Minute},
+		{name: "Short-lived token", lifetime: time.Minute, min: 29 * time.Second, max: 30 * time.Second},
+		{name: "Expired token", lifetime: -time.Minute, min: minRefreshRetry, max: minRefreshRetry},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delay := m.nextRefresh(time.Now().Add(tc.lifetime))
+			assert.GreaterOrEqual(t, int64(delay), int64(tc.min))
+			assert.LessOrEqual(t, int64(delay), int64(tc.max))
+		})
+	}
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+
+	grant := &fakeGrant{}
+	timer := newManualTimer()
+	events := make(chan duokey.TokenEvent, 10)
+	errs := make(chan error, 10)
+
+	m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", grant.grant, duokey.TokenRefreshConfig{
+		OnTokenRefresh: func(e duokey.TokenEvent) { events <- e },
+		OnTokenError:   func(err error) { errs <- err },
+	}, duokey.NewSilentLogger())
+	m.after = timer.after
+
+	require.NoError(t, m.init())
+	defer m.close()
+	assert.Greater(t, int64(<-timer.delays), int64(58*time.Minute))
+
+	// Without refresh token, the grant runs again
+	timer.fire <- time.Now()
+	event := <-events
+	assert.Equal(t, "password", event.Grant)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), event.Expiry, time.Minute)
+	assert.Equal(t, 2, grant.count())
+	<-timer.delays
+
+	// A failure is reported and retried with a backoff
+	grant.mu.Lock()
+	grant.errors = []error{errors.New("issuer down"), errors.New("issuer down")}
+	grant.mu.Unlock()
+
+	timer.fire <- time.Now()
+	assert.EqualError(t, <-errs, "issuer down")
+	assert.Equal(t, minRefreshRetry, <-timer.delays)
+
+	timer.fire <- time.Now()
+	<-errs
+	assert.Equal(t, 2*minRefreshRetry, <-timer.delays)
+
+	timer.fire <- time.Now()
+	assert.Equal(t, "password", (<-events).Grant)
+
+	// The token of a request is the refreshed one
+	token, err := m.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.Equal(t, 5, grant.count())
+}
+
+func TestBackgroundRefreshSerialized(t *testing.T) {
+
+	grant := &fakeGrant{}
+	timer := newManualTimer()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", func(ctx context.Context) (*oauth2.Token, error) {
+		if grant.count() > 0 {
+			started <- struct{}{}
+			<-release
+		}
+		return grant.grant(ctx)
+	}, duokey.TokenRefreshConfig{}, duokey.NewSilentLogger())
+	m.after = timer.after
+
+	require.NoError(t, m.init())
+	defer m.close()
+	<-timer.delays
+
+	// A request rejected during the background refresh waits for it and
+	// then uses the new token instead of fetching another one
+	sentAt := time.Now()
+	timer.fire <- time.Now()
+	<-started
+
+	reauthenticated := make(chan error)
+	go func() { reauthenticated <- m.Reauthenticate(context.Background(), sentAt) }()
+
+	select {
+	case <-reauthenticated:
+		t.Fatal("the renewal should wait for the background refresh")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-reauthenticated)
+	assert.Equal(t, 2, grant.count())
+}
+
+// memoryCache is a duokey.TokenCache holding a single token
+type memoryCache struct {
+	token *oauth2.Token
+}
+
+func (c *memoryCache) Load(duokey.TokenCacheKey) (*oauth2.Token, error) {
+	return c.token, nil
+}
+
+func (c *memoryCache) Store(_ duokey.TokenCacheKey, token *oauth2.Token) error {
+	c.token = token
+	return nil
+}
+
+func TestCachedRefreshToken(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"refreshed","token_type":"Bearer","expires_in":3600,"refresh_token":"refresh"}`))
+	}))
+	defer server.Close()
+
+	grant := &fakeGrant{}
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}
+	m := newTokenManager(context.Background(), staticConfig(config), "password", grant.grant, duokey.TokenRefreshConfig{Disabled: true}, duokey.NewSilentLogger())
+
+	// The refresh token of an expired cached token spares the grant
+	cache := &memoryCache{token: &oauth2.Token{AccessToken: "expired", TokenType: "Bearer", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Minute)}}
+	m.cache = cache
+
+	require.NoError(t, m.init())
+	defer m.close()
+
+	token, err := m.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "refreshed", token.AccessToken)
+	assert.Equal(t, "refreshed", cache.token.AccessToken, "the new token is cached")
+	assert.Zero(t, grant.count())
+}
+
+func TestBackgroundRefreshRescheduled(t *testing.T) {
+
+	t.Run("Renewed by a request", func(t *testing.T) {
+		grant := &fakeGrant{}
+		timer := newManualTimer()
+
+		m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", grant.grant, duokey.TokenRefreshConfig{}, duokey.NewSilentLogger())
+		m.after = timer.after
+
+		require.NoError(t, m.init())
+		defer m.close()
+		<-timer.delays
+
+		// The refresh is scheduled again from the expiry of the renewed token,
+		// instead of fetching a redundant one at the old deadline
+		require.NoError(t, m.Reauthenticate(context.Background(), time.Now()))
+		select {
+		case delay := <-timer.delays:
+			assert.Greater(t, int64(delay), int64(58*time.Minute))
+		case <-time.After(time.Second):
+			t.Fatal("the refresh should be rescheduled")
+		}
+		assert.Equal(t, 2, grant.count())
+	})
+
+	t.Run("Token without expiry", func(t *testing.T) {
+		grant := &fakeGrant{}
+		timer := newManualTimer()
+
+		m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", func(ctx context.Context) (*oauth2.Token, error) {
+			if grant.count() == 0 {
+				grant.grant(ctx)
+				return &oauth2.Token{AccessToken: "token", TokenType: "Bearer"}, nil
+			}
+			return grant.grant(ctx)
+		}, duokey.TokenRefreshConfig{}, duokey.NewSilentLogger())
+		m.after = timer.after
+
+		require.NoError(t, m.init())
+		defer m.close()
+
+		select {
+		case <-timer.delays:
+			t.Fatal("a token without expiry should not be refreshed")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// A renewal setting an expiry starts the refresh
+		require.NoError(t, m.Reauthenticate(context.Background(), time.Now()))
+		select {
+		case delay := <-timer.delays:
+			assert.Greater(t, int64(delay), int64(58*time.Minute))
+		case <-time.After(time.Second):
+			t.Fatal("the refresh should be scheduled")
+		}
+	})
+}
+
+func TestScopeCheckedOnRenewal(t *testing.T) {
+
+	var calls int
+	m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", func(context.Context) (*oauth2.Token, error) {
+		calls++
+		scope := "duokey api"
+		if calls > 1 {
+			scope = "duokey"
+		}
+		token := &oauth2.Token{AccessToken: "token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+		return token.WithExtra(map[string]interface{}{"scope": scope}), nil
+	}, duokey.TokenRefreshConfig{Disabled: true}, duokey.NewSilentLogger())
+	m.creds.Scope = "duokey api"
+
+	require.NoError(t, m.init())
+	defer m.close()
+
+	// A renewed token with narrower scopes is rejected
+	err := m.Reauthenticate(context.Background(), time.Now())
+	assert.ErrorIs(t, err, ErrScopeNotGranted)
+}
+
+func TestTokenInfoContext(t *testing.T) {
+
+	grant := &fakeGrant{}
+	m := newTokenManager(context.Background(), staticConfig(&oauth2.Config{}), "password", func(ctx context.Context) (*oauth2.Token, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return grant.grant(ctx)
+	}, duokey.TokenRefreshConfig{Disabled: true}, duokey.NewSilentLogger())
+
+	require.NoError(t, m.init())
+	defer m.close()
+	m.token.Expiry = time.Now().Add(-time.Minute)
+
+	// The renewal of an expired token is made with the context of the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := (&Client{tokens: m}).TokenInfo(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, grant.count())
+}
+
+func TestRefreshToken(t *testing.T) {
+
+	var refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"refreshed","token_type":"Bearer","expires_in":3600,"refresh_token":"refresh"}`))
+	}))
+	defer server.Close()
+
+	grant := &fakeGrant{}
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}
+	m := newTokenManager(context.Background(), staticConfig(config), "password", grant.grant, duokey.TokenRefreshConfig{Disabled: true}, duokey.NewSilentLogger())
+	require.NoError(t, m.init())
+	defer m.close()
+
+	testCases := []struct {
+		name         string
+		refreshToken string
+		wantToken    string
+		wantGrant    string
+	}{
+		{name: "Valid refresh token", refreshToken: "refresh", wantToken: "refreshed", wantGrant: "refresh_token"},
+		{name: "Rejected refresh token", refreshToken: "revoked", wantToken: "token", wantGrant: "password"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, grantType, err := m.fetch(context.Background(), &oauth2.Token{RefreshToken: tc.refreshToken})
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantToken, token.AccessToken)
+			assert.Equal(t, tc.wantGrant, grantType)
+		})
+	}
+
+	assert.Equal(t, 1, refreshes)
+}
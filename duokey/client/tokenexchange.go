@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// exchangeToken runs the token-exchange grant (RFC 8693): the subject token of
+// creds, read again at each call, is exchanged for an access token. The client
+// authenticates as for the password grant.
+func exchangeToken(ctx context.Context, conf *oauth2.Config, creds credentials.Config) (*oauth2.Token, error) {
+	subjectToken, subjectTokenType, err := credentials.GetSubjectToken(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client credentials flow only differs by its grant type, which can be overridden
+	exchange := &clientcredentials.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		TokenURL:     conf.Endpoint.TokenURL,
+		Scopes:       conf.Scopes,
+		AuthStyle:    conf.Endpoint.AuthStyle,
+		EndpointParams: url.Values{
+			"grant_type":           {credentials.TokenExchangeGrantType},
+			"subject_token":        {subjectToken},
+			"subject_token_type":   {subjectTokenType},
+			"requested_token_type": {credentials.AccessTokenType},
+		},
+	}
+
+	return exchange.Token(ctx)
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"golang.org/x/oauth2"
+)
+
+// ErrScopeNotGranted is returned by New, and by the requests renewing the
+// token, when the issuer did not grant the scope of the credentials.
+var ErrScopeNotGranted = errors.New("scope not granted")
+
+// TokenInfo describes the identity and the permissions carried by the access
+// token of a client. The claims are read from a token whose signature was
+// checked against the JWKS of the issuer.
+type TokenInfo struct {
+	Issuer   string
+	Subject  string
+	ClientID string
+	TenantID string
+	Scopes   []string
+	Roles    []string
+	Expiry   time.Time
+}
+
+// HasScope reports whether scope was granted.
+func (i *TokenInfo) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenClaims are the claims read from the tokens. IdentityServer and ABP
+// serialize single values as strings and several values as arrays.
+type tokenClaims struct {
+	ClientID    string     `json:"client_id"`
+	Scope       stringList `json:"scope"`
+	Role        stringList `json:"role"`
+	Roles       stringList `json:"roles"`
+	TenantID    string     `json:"tenantid"`
+	ABPTenantID string     `json:"http://www.aspnetboilerplate.com/identity/claims/tenantId"`
+}
+
+// stringList decodes a space-separated string or an array of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = strings.Fields(s)
+		return nil
+	}
+
+	var a []string
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	*l = a
+	return nil
+}
+
+// TokenInfo verifies the current access token and returns its claims. If the
+// access token is not a JWT, the ID token returned with it is used instead.
+// It fails for clients not created by New or NewWithConfig.
+func (c *Client) TokenInfo(ctx context.Context) (*TokenInfo, error) {
+	if c.tokens == nil {
+		return nil, fmt.Errorf("no token manager: the client was not created by New")
+	}
+
+	token, err := c.tokens.tokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := c.tokens.verifier()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := token.AccessToken
+	if strings.Count(raw, ".") != 2 {
+		raw, _ = token.Extra("id_token").(string)
+		if raw == "" {
+			return nil, fmt.Errorf("the access token is not a JWT and no ID token was issued")
+		}
+	}
+
+	verified, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify the token: %w", err)
+	}
+
+	var claims tokenClaims
+	if err := verified.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to read the token claims: %w", err)
+	}
+
+	info := &TokenInfo{
+		Issuer:   verified.Issuer,
+		Subject:  verified.Subject,
+		ClientID: claims.ClientID,
+		TenantID: claims.TenantID,
+		Scopes:   claims.Scope,
+		Roles:    append(claims.Role, claims.Roles...),
+		Expiry:   verified.Expiry,
+	}
+	if info.TenantID == "" {
+		info.TenantID = claims.ABPTenantID
+	}
+
+	return info, nil
+}
+
+// verifier returns the verifier of the tokens, created on first use. The
+// audience of access tokens is the API rather than the client, so it is not
+// checked.
+func (m *tokenManager) verifier() (*oidc.IDTokenVerifier, error) {
+	m.verifierMutex.Lock()
+	defer m.verifierMutex.Unlock()
+
+	if m.tokenVerifier == nil {
+		// The keys are fetched with m.ctx, which lives as long as the client
+		verifier, err := credentials.GetVerifierWithContext(m.ctx, m.creds, &oidc.Config{SkipClientIDCheck: true})
+		if err != nil {
+			return nil, err
+		}
+		m.tokenVerifier = verifier
+	}
+
+	return m.tokenVerifier, nil
+}
+
+// checkScope verifies that the scopes requested in creds were granted, when
+// the token response lists the granted scopes
+func checkScope(token *oauth2.Token, creds credentials.Config) error {
+	granted, ok := token.Extra("scope").(string)
+	if !ok || granted == "" {
+		return nil
+	}
+
+	info := TokenInfo{Scopes: strings.Fields(granted)}
+	for _, scope := range strings.Fields(creds.Scope) {
+		if !info.HasScope(scope) {
+			return fmt.Errorf("%w: '%s' (granted: '%s')", ErrScopeNotGranted, scope, granted)
+		}
+	}
+
+	return nil
+}
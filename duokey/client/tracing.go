@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+)
+
+// spanKey is the context key of the span of a request
+type spanKey struct{}
+
+// Names of the tracing handlers
+const (
+	startSpanHandlerName   = "duokey.StartSpan"
+	injectTraceHandlerName = "duokey.InjectTraceContext"
+	endSpanHandlerName     = "duokey.EndSpan"
+)
+
+// addTracing adds the handlers tracing the requests with tracer: a span named
+// after the operation covers all the attempts of a request. The trace context
+// is sent to the server.
+func addTracing(h *request.Handlers, tracer duokey.Tracer) {
+	startSpan := func(r *request.Request) duokey.Span {
+		ctx, span := tracer.Start(r.HTTPRequest.Context(), r.Operation.Name)
+		r.HTTPRequest = r.HTTPRequest.WithContext(context.WithValue(ctx, spanKey{}, span))
+
+		if describer, ok := r.Parameters.(request.KeyDescriber); ok {
+			key := describer.DescribeKey()
+			setNonEmpty(span, duokey.AttributeKeyID, key.KeyID)
+			setNonEmpty(span, duokey.AttributeVaultID, key.VaultID)
+			setNonEmpty(span, duokey.AttributeAlgorithm, key.Algorithm)
+		}
+		return span
+	}
+
+	h.Build.PushFrontNamed(request.NamedHandler{Name: startSpanHandlerName, Fn: func(r *request.Request) {
+		startSpan(r)
+	}})
+
+	h.Sign.PushBackNamed(request.NamedHandler{Name: injectTraceHandlerName, Fn: func(r *request.Request) {
+		tracer.Inject(r.HTTPRequest.Context(), r.HTTPRequest.Header)
+	}})
+
+	h.Complete.PushBackNamed(request.NamedHandler{Name: endSpanHandlerName, Fn: func(r *request.Request) {
+		// A request rejected before the Build phase gets a span too
+		span, ok := r.HTTPRequest.Context().Value(spanKey{}).(duokey.Span)
+		if !ok {
+			span = startSpan(r)
+		}
+
+		// The size of the payload is recorded, never its content
+		span.SetAttribute(duokey.AttributePayloadSize, len(r.Body))
+		span.SetAttribute(duokey.AttributeRetryCount, r.RetryCount)
+		if r.HTTPResponse != nil {
+			span.SetAttribute(duokey.AttributeStatusCode, r.HTTPResponse.StatusCode)
+		}
+		span.End(r.Error)
+	}})
+}
+
+func setNonEmpty(span duokey.Span, key, value string) {
+	if value != "" {
+		span.SetAttribute(key, value)
+	}
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+)
+
+// newBaseTransport returns the transport of the token and API requests,
+// configured by options. It presents the client certificate of creds, if any
+// (mutual TLS).
+func newBaseTransport(creds credentials.Config, options duokey.TransportConfig) (http.RoundTripper, error) {
+	cert, err := credentials.GetClientCertificate(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Base != nil {
+		settings := options
+		settings.Base = nil
+		settings.Timeout = 0
+		if cert != nil || !reflect.ValueOf(settings).IsZero() {
+			return nil, fmt.Errorf("the transport settings and the client certificate cannot be combined with a base transport")
+		}
+		return options.Base, nil
+	}
+
+	if cert == nil && reflect.ValueOf(options).IsZero() {
+		return http.DefaultTransport, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	if options.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: options.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if options.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+	if options.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	}
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+
+	if options.Proxy != "" {
+		if transport.Proxy, err = proxyFunc(options.Proxy, options.NoProxy); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.RootCAs != nil || options.RootCAFile != "" {
+		if transport.TLSClientConfig.RootCAs, err = rootCAs(options); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.MinTLSVersion != 0 {
+		transport.TLSClientConfig.MinVersion = options.MinTLSVersion
+	}
+
+	if len(options.PinnedKeys) > 0 {
+		if transport.TLSClientConfig.VerifyConnection, err = verifyPins(options.PinnedKeys); err != nil {
+			return nil, err
+		}
+	}
+
+	// A non-nil empty TLSNextProto disables HTTP/2
+	if options.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
+
+// rootCAs returns the certificate pool verifying the server certificates
+func rootCAs(options duokey.TransportConfig) (*x509.CertPool, error) {
+	pool := options.RootCAs
+	if pool == nil {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+	} else {
+		// Do not modify the pool of the caller
+		pool = pool.Clone()
+	}
+
+	if options.RootCAFile != "" {
+		data, err := ioutil.ReadFile(options.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the root CAs: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to read the root CAs: no certificate found in %s", options.RootCAFile)
+		}
+	}
+
+	return pool, nil
+}
+
+// proxyFunc returns a function sending the requests through proxyURL, except
+// those to the hosts matching noProxy
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if proxy.Scheme == "" || proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: %s", proxyURL)
+	}
+
+	patterns := strings.Split(noProxy, ",")
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), patterns) {
+			return nil, nil
+		}
+		return proxy, nil
+	}, nil
+}
+
+// bypassProxy reports whether host matches one of the NO_PROXY patterns
+func bypassProxy(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if h, _, err := net.SplitHostPort(pattern); err == nil {
+			pattern = h
+		}
+
+		if pattern == "" {
+			continue
+		}
+		if pattern == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if patternIP := net.ParseIP(pattern); patternIP != nil {
+			if ip != nil && patternIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"crypto/tls"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBaseTransport(t *testing.T) {
+
+	// The default transport is shared when there is nothing to configure
+	transport, err := newBaseTransport(credentials.Config{}, duokey.TransportConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, http.DefaultTransport, transport)
+
+	transport, err = newBaseTransport(credentials.Config{}, duokey.TransportConfig{
+		TLSHandshakeTimeout:   time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		MaxIdleConnsPerHost:   42,
+		MinTLSVersion:         tls.VersionTLS13,
+		DisableHTTP2:          true,
+	})
+	require.NoError(t, err)
+
+	httpTransport, ok := transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, time.Second, httpTransport.TLSHandshakeTimeout)
+	assert.Equal(t, 2*time.Second, httpTransport.ResponseHeaderTimeout)
+	assert.Equal(t, 42, httpTransport.MaxIdleConnsPerHost)
+	assert.Equal(t, uint16(tls.VersionTLS13), httpTransport.TLSClientConfig.MinVersion)
+	assert.False(t, httpTransport.ForceAttemptHTTP2)
+	assert.NotNil(t, httpTransport.TLSNextProto)
+
+	// http.DefaultTransport is not modified
+	assert.NotEqual(t, 42, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost)
+
+	// A base transport is used as is
+	base := &http.Transport{}
+	transport, err = newBaseTransport(credentials.Config{}, duokey.TransportConfig{Base: base, Timeout: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, base, transport)
+
+	testCases := []struct {
+		name    string
+		options duokey.TransportConfig
+	}{
+		{name: "Proxy without scheme", options: duokey.TransportConfig{Proxy: "proxy:3128"}},
+		{name: "Missing CA file", options: duokey.TransportConfig{RootCAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "Base with settings", options: duokey.TransportConfig{Base: &http.Transport{}, DisableHTTP2: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newBaseTransport(credentials.Config{}, tc.options)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+
+	testCases := []struct {
+		host    string
+		noProxy string
+		want    bool
+	}{
+		{host: "kms.duokey.com", noProxy: "", want: false},
+		{host: "kms.duokey.com", noProxy: "*", want: true},
+		{host: "kms.duokey.com", noProxy: "duokey.com", want: true},
+		{host: "kms.duokey.com", noProxy: ".duokey.com", want: true},
+		{host: "kms.duokey.com", noProxy: "*.duokey.com", want: true},
+		{host: "duokey.com", noProxy: ".duokey.com", want: true},
+		{host: "notduokey.com", noProxy: "duokey.com", want: false},
+		{host: "KMS.DuoKey.com", noProxy: "example.com, duokey.com:443", want: true},
+		{host: "10.1.2.3", noProxy: "10.0.0.0/8", want: true},
+		{host: "192.168.1.1", noProxy: "10.0.0.0/8", want: false},
+		{host: "::1", noProxy: "::1", want: true},
+		{host: "127.0.0.1", noProxy: "localhost", want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host+" "+tc.noProxy, func(t *testing.T) {
+			assert.Equal(t, tc.want, bypassProxy(tc.host, strings.Split(tc.noProxy, ",")))
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+)
+
+// wireLogTransport dumps the requests and the responses at debug level (see
+// duokey.WireLogConfig). The logger masks the secrets and the payloads.
+type wireLogTransport struct {
+	Transport http.RoundTripper
+	Logger    duokey.LeveledLogger
+}
+
+var _ http.RoundTripper = (*wireLogTransport)(nil)
+
+func (t *wireLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		req.Body.Close()
+
+		// The request is cloned not to alter the one of the caller
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	t.Logger.Debug("HTTP request",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"header", req.Header,
+		"body", dumpBody(req.Header, body))
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		t.Logger.Debug("HTTP response", "url", req.URL.String(), "error", err)
+		return nil, err
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	t.Logger.Debug("HTTP response",
+		"url", req.URL.String(),
+		"status", resp.StatusCode,
+		"header", resp.Header,
+		"body", dumpBody(resp.Header, body))
+
+	return resp, nil
+}
+
+// dumpBody returns the JSON and form bodies as text, and only the size and
+// the content type of the others
+func dumpBody(header http.Header, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	// The bodies are not truncated: the masking needs whole JSON strings
+	contentType := header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" || mediaType == "application/x-www-form-urlencoded" || strings.HasSuffix(mediaType, "+json") {
+		return string(body)
+	}
+	return fmt.Sprintf("[%d bytes of %s]", len(body), contentType)
+}
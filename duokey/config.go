@@ -1,16 +1,220 @@
 package duokey
 
 import (
+	"context"
+	"crypto/x509"
 	"net/http"
+	"time"
 
 	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"golang.org/x/oauth2"
 )
 
-// Config stores the configuration of a DuoKey client: credentials needed to 
+// Config stores the configuration of a DuoKey client: credentials needed to
 // get an access token and http client.
 type Config struct {
 	Credentials credentials.Config
 	HTTPClient  *http.Client
 
-	Logger Logger
+	// Logger receives the messages of the SDK at info level and above, as
+	// text. LeveledLogger, if set, takes precedence (see LoggerFor).
+	Logger        Logger
+	LeveledLogger LeveledLogger
+
+	// TokenRefresh configures the background refresh of the access token
+	TokenRefresh TokenRefreshConfig
+
+	// Authenticator renews the access token when the server rejects it. It
+	// is set by client.New; requests are not retried if it is nil.
+	Authenticator Authenticator
+
+	// TokenCache persists the access token across processes (optional, see
+	// package tokencache)
+	TokenCache TokenCache
+
+	// Transport configures the HTTP transport of the token and API requests
+	Transport TransportConfig
+
+	// Tracer traces the API requests and the token acquisitions (optional)
+	Tracer Tracer
+
+	// Metrics records the API requests and the token acquisitions (optional)
+	Metrics Metrics
+
+	// WireLog dumps the HTTP requests and responses (opt-in)
+	WireLog WireLogConfig
+
+	// RateLimit limits the rate and the concurrency of the API requests
+	// (optional)
+	RateLimit RateLimitConfig
+}
+
+// RateLimitConfig limits the API requests of a client, e.g. to keep a batch
+// job from getting the whole tenant throttled. A request waits for the global
+// limit and for the limit of its operation; it fails fast with
+// client.ErrRateLimited if its context expires before it could be sent.
+//
+// On a 429 response, the rates are halved and recover gradually, and the
+// requests wait for the delay given by the Retry-After header.
+type RateLimitConfig struct {
+	Global     Limit
+	Operations map[string]Limit // By operation name (Encrypt, Decrypt, ...)
+}
+
+// Limit is a token bucket and a maximum number of requests in flight. The
+// zero values disable them.
+type Limit struct {
+	Rate        float64 // Requests per second
+	Burst       int     // Size of the bucket (1 if zero)
+	MaxInFlight int
+}
+
+// IsZero reports whether no limit is set
+func (c RateLimitConfig) IsZero() bool {
+	if c.Global != (Limit{}) {
+		return false
+	}
+	for _, limit := range c.Operations {
+		if limit != (Limit{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// WireLogConfig configures the dump of the token and API requests and of their
+// responses: method, URL, status, headers and JSON or form bodies, logged at
+// debug level. The Authorization header, the passwords, client secrets,
+// tokens and payloads are masked unless ShowSecrets or ShowPayloads is set.
+// These options are meant for a local sandbox: never enable them in
+// production.
+type WireLogConfig struct {
+	Enabled      bool
+	ShowPayloads bool // Show the encrypted and decrypted payloads
+	ShowSecrets  bool // Show the credentials and the tokens
+}
+
+// DefaultTokenTimeout is the default timeout of the token requests
+const DefaultTokenTimeout = 10 * time.Second
+
+// TransportConfig configures the HTTP transport shared by the token requests
+// (discovery, JWKS, token endpoint) and the API requests. The zero value keeps
+// the settings of http.DefaultTransport.
+type TransportConfig struct {
+	// Timeout limits the duration of a whole request, reading of the
+	// response body included. It defaults to DefaultTokenTimeout for the
+	// token requests; the API requests have no timeout by default.
+	Timeout time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConnsPerHost   int
+
+	// Proxy is the URL of the HTTP proxy. NoProxy is a comma-separated list
+	// of hosts reached directly, as in the NO_PROXY environment variable:
+	// host names (matching their subdomains too), IP addresses, CIDR ranges
+	// or "*". Ports are ignored. If Proxy is empty, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy   string
+	NoProxy string
+
+	// RootCAs replaces the system roots to verify the server certificates.
+	// The PEM certificates of RootCAFile (e.g. the CA of an on-premises
+	// installation) are added to RootCAs, or to the system roots if RootCAs
+	// is nil.
+	RootCAs    *x509.CertPool
+	RootCAFile string
+
+	// MinTLSVersion is the minimum TLS version (e.g. tls.VersionTLS13)
+	MinTLSVersion uint16
+
+	// DisableHTTP2 restricts the connections to HTTP/1.1
+	DisableHTTP2 bool
+
+	// PinnedKeys are the base64-encoded SHA-256 hashes of the subject public
+	// key info of trusted certificates (see client.PublicKeyPin), with or
+	// without the "sha256/" prefix. If set, a TLS connection to the issuer or
+	// to the DuoKey API fails with a *client.PinMismatchError unless one of
+	// the certificates of the verified chain matches a pin. List the current
+	// and the next keys during a rotation.
+	PinnedKeys []string
+
+	// Base, if set, sends the requests instead of a transport built from the
+	// settings above, e.g. to record the exchanges (see package recorder). It
+	// cannot be combined with these settings or with a client certificate;
+	// Timeout still applies.
+	Base http.RoundTripper
+}
+
+// TokenCache stores access tokens. Load returns nil and no error if there is
+// no token for key.
+type TokenCache interface {
+	Load(key TokenCacheKey) (*oauth2.Token, error)
+	Store(key TokenCacheKey, token *oauth2.Token) error
+}
+
+// TokenCacheKey identifies the cached token of a client
+type TokenCacheKey struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	TenantID uint32 `json:"tenant_id"`
+	Scope    string `json:"scope"`
+	UserName string `json:"username"`
+}
+
+// NewTokenCacheKey returns the cache key of creds
+func NewTokenCacheKey(creds credentials.Config) TokenCacheKey {
+	return TokenCacheKey{
+		Issuer:   creds.Issuer,
+		ClientID: creds.ClientID,
+		TenantID: creds.TenantID,
+		Scope:    creds.Scope,
+		UserName: creds.UserName,
+	}
+}
+
+// Authenticator renews the access token of a client
+type Authenticator interface {
+	// Reauthenticate discards the access token and obtains a new one through
+	// the configured grant, unless a new token was already obtained after
+	// sentAt (the time the rejected request was sent). Concurrent calls
+	// share a single renewal.
+	Reauthenticate(ctx context.Context, sentAt time.Time) error
+}
+
+// Default values of TokenRefreshConfig
+const (
+	DefaultRefreshBefore = time.Minute
+	DefaultRefreshJitter = 30 * time.Second
+)
+
+// TokenRefreshConfig configures the refresh of the access token. Unless
+// Disabled is set, the token is refreshed in the background before it
+// expires: with the refresh token if the issuer returned one, otherwise by
+// running the grant again. The background refresh is only started by
+// client.NewWithConfig and runs until Client.Close is called.
+type TokenRefreshConfig struct {
+	// Disabled turns the background refresh off. The token is then only
+	// renewed when a request needs it.
+	Disabled bool
+	// Before is how long before expiry the token is refreshed (DefaultRefreshBefore if zero)
+	Before time.Duration
+	// Jitter is the upper bound of a random delay subtracted from the refresh
+	// time, so that instances started together do not all hit the issuer at
+	// the same time (DefaultRefreshJitter if zero)
+	Jitter time.Duration
+
+	// OnTokenRefresh is called after each successful refresh
+	OnTokenRefresh func(TokenEvent)
+	// OnTokenError is called when a refresh fails. The refresh is retried
+	// with a backoff while the current token is still valid.
+	OnTokenError func(error)
+}
+
+// TokenEvent describes a new access token. The token itself is not exposed.
+type TokenEvent struct {
+	// Grant is the grant used to obtain the token ("password", "refresh_token", ...)
+	Grant  string
+	Expiry time.Time
 }
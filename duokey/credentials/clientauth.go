@@ -0,0 +1,176 @@
+package credentials
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ClientAssertionType is the client_assertion_type of the private_key_jwt
+// client authentication (RFC 7523)
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime is the validity of a client assertion
+const clientAssertionLifetime = 5 * time.Minute
+
+// GetClientCertificate returns the TLS client certificate of config, or nil if
+// mutual TLS is not configured.
+func GetClientCertificate(config Config) (*tls.Certificate, error) {
+	if config.ClientCertificate != nil {
+		return config.ClientCertificate, nil
+	}
+
+	if config.ClientCertFile == "" && config.ClientKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+	}
+
+	return &cert, nil
+}
+
+// UsesClientAssertion reports whether the client authenticates with a signed
+// assertion (private_key_jwt) rather than with its secret.
+func UsesClientAssertion(config Config) bool {
+	return config.ClientAssertionSigner != nil || config.ClientAssertionKeyFile != ""
+}
+
+// GetClientAssertion returns a client assertion for the token endpoint
+// audience: a JWT signed with the key of config (RS256, ES256 or EdDSA,
+// depending on the key type).
+func GetClientAssertion(config Config, audience string) (string, error) {
+	signer := config.ClientAssertionSigner
+	if signer == nil {
+		var err error
+		if signer, err = loadSigner(config.ClientAssertionKeyFile); err != nil {
+			return "", err
+		}
+	}
+
+	alg, err := signingAlgorithm(signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if config.ClientAssertionKeyID != "" {
+		header["kid"] = config.ClientAssertionKeyID
+	}
+
+	claims := map[string]interface{}{
+		"iss": config.ClientID,
+		"sub": config.ClientID,
+		"aud": audience,
+		"jti": uuid.New().String(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	signature, err := sign(signer, alg, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the client assertion: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signingAlgorithm returns the JWS algorithm of a public key
+func signingAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported curve for the client assertion: %s", pub.Curve.Params().Name)
+		}
+		return "ES256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	}
+	return "", fmt.Errorf("unsupported key type for the client assertion: %T", pub)
+}
+
+// sign returns the JWS signature of input
+func sign(signer crypto.Signer, alg string, input []byte) ([]byte, error) {
+	if alg == "EdDSA" {
+		return signer.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(input)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil || alg != "ES256" {
+		return signature, err
+	}
+
+	// crypto.Signer returns an ASN.1 ECDSA signature, JWS expects r || s
+	var asn1Signature struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &asn1Signature); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 64)
+	asn1Signature.R.FillBytes(raw[:32])
+	asn1Signature.S.FillBytes(raw[32:])
+
+	return raw, nil
+}
+
+// loadSigner reads a PEM private key (PKCS #8, PKCS #1 or SEC 1)
+func loadSigner(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client assertion key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to read the client assertion key: no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported client assertion key: %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("failed to read the client assertion key: unsupported format")
+}
@@ -0,0 +1,101 @@
+package credentials_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetClientAssertion(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	p384, err := x509.MarshalECPrivateKey(p384Key)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		block   *pem.Block
+		wantAlg string
+		wantErr bool
+	}{
+		{name: "PKCS #8", block: &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, wantAlg: "ES256"},
+		{name: "PKCS #1", block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, wantAlg: "RS256"},
+		{name: "SEC 1", block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}, wantAlg: "ES256"},
+		{name: "Unsupported curve", block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: p384}, wantErr: true},
+		{name: "Not a key", block: &pem.Block{Type: "CERTIFICATE", Bytes: []byte("Lorem ipsum")}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.pem")
+			require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(tc.block), 0600))
+
+			config := credentials.Config{ClientID: "client", ClientAssertionKeyFile: path, ClientAssertionKeyID: "kid"}
+			assert.True(t, credentials.UsesClientAssertion(config))
+
+			assertion, err := credentials.GetClientAssertion(config, "https://issuer/token")
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			parts := strings.Split(assertion, ".")
+			require.Len(t, parts, 3)
+
+			var header map[string]string
+			decodeSegment(t, parts[0], &header)
+			assert.Equal(t, tc.wantAlg, header["alg"])
+			assert.Equal(t, "kid", header["kid"])
+
+			var claims map[string]interface{}
+			decodeSegment(t, parts[1], &claims)
+			assert.Equal(t, "client", claims["iss"])
+			assert.Equal(t, "client", claims["sub"])
+			assert.Equal(t, "https://issuer/token", claims["aud"])
+			assert.NotEmpty(t, claims["jti"])
+		})
+	}
+
+	_, err = credentials.GetClientAssertion(credentials.Config{ClientAssertionKeyFile: "missing.pem"}, "aud")
+	assert.Error(t, err)
+}
+
+func TestGetClientCertificate(t *testing.T) {
+
+	cert, err := credentials.GetClientCertificate(credentials.Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, cert)
+
+	_, err = credentials.GetClientCertificate(credentials.Config{ClientCertFile: "missing.pem", ClientKeyFile: "missing.key"})
+	assert.Error(t, err)
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v))
+}
@@ -2,6 +2,11 @@ package credentials
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -18,24 +23,191 @@ type Config struct {
 	Scope          string `mapstructure:"scope"`
 	HeaderTenantID string `mapstructure:"header-tenant-id"`
 	TenantID       uint32 `mapstructure:"tenant-id"`
+
+	// Endpoints of the issuer (optional). If TokenURL is set, the discovery
+	// document is not read to get a token. If JWKSURL is set, it is not read
+	// to verify the tokens either.
+	AuthURL  string `mapstructure:"auth-url"`
+	TokenURL string `mapstructure:"token-url"`
+	JWKSURL  string `mapstructure:"jwks-url"`
+
+	// Mutual TLS (optional): the client certificate is presented to the
+	// issuer and to the DuoKey API. ClientCertificate takes precedence over
+	// the files.
+	ClientCertFile    string           `mapstructure:"client-cert-file"`
+	ClientKeyFile     string           `mapstructure:"client-key-file"`
+	ClientCertificate *tls.Certificate `mapstructure:"-"`
+
+	// private_key_jwt client authentication (optional, RFC 7523): the client
+	// authenticates with an assertion signed with a local key (PEM file) or
+	// with a crypto.Signer (e.g. backed by an HSM) instead of ClientSecret.
+	ClientAssertionKeyFile string        `mapstructure:"client-assertion-key-file"`
+	ClientAssertionKeyID   string        `mapstructure:"client-assertion-key-id"`
+	ClientAssertionSigner  crypto.Signer `mapstructure:"-"`
+
+	// Token exchange (optional, RFC 8693): if SubjectTokenFile is set, the
+	// token it holds (e.g. a projected Kubernetes service account token) is
+	// exchanged for an access token instead of UserName and Password. The
+	// file is read again for each exchange. SubjectTokenType defaults to
+	// DefaultSubjectTokenType.
+	SubjectTokenFile string `mapstructure:"subject-token-file"`
+	SubjectTokenType string `mapstructure:"subject-token-type"`
+}
+
+// DefaultDiscoveryTTL is the default lifetime of the cached discovery documents
+const DefaultDiscoveryTTL = 15 * time.Minute
+
+// maxStaleDiscovery is the age beyond which a cached discovery document is
+// neither used when the issuer cannot be reached nor kept in the cache
+const maxStaleDiscovery = 24 * time.Hour
+
+// discoveryEntry is a cached discovery document
+type discoveryEntry struct {
+	endpoint oauth2.Endpoint
+	jwksURL  string
+	fetched  time.Time
+}
+
+// discoveryKey identifies a cached discovery document: the issuer and the HTTP
+// client which fetched it, so that a client with other pinning, root CAs or
+// proxy settings fetches its own document
+type discoveryKey struct {
+	issuer string
+	client *http.Client // nil for http.DefaultClient
+}
+
+// Process-wide cache of the discovery documents
+var discovery = struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[discoveryKey]discoveryEntry
+}{
+	ttl:     DefaultDiscoveryTTL,
+	entries: make(map[discoveryKey]discoveryEntry),
+}
+
+// SetDiscoveryTTL sets how long the discovery documents are cached. A zero or
+// negative ttl disables the cache.
+func SetDiscoveryTTL(ttl time.Duration) {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	discovery.ttl = ttl
+}
+
+// ClearDiscoveryCache removes all the cached discovery documents.
+func ClearDiscoveryCache() {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	discovery.entries = make(map[discoveryKey]discoveryEntry)
 }
 
 // GetOauth2Config reads the token and authorization URLs from a discovery document
 func GetOauth2Config(config Config) (*oauth2.Config, error) {
-	provider, err := oidc.NewProvider(context.Background(), config.Issuer)
-	if err != nil {
-		return nil, err
-	}
+	return GetOauth2ConfigWithContext(context.Background(), config)
+}
 
+// GetOauth2ConfigWithContext is like GetOauth2Config but the discovery request
+// can be cancelled with ctx. It uses the HTTP client of ctx, if any (see
+// oidc.ClientContext). The discovery document is skipped if config.TokenURL is
+// set, and cached process-wide for this HTTP client otherwise. If the issuer
+// cannot be reached, a cached document fetched less than a day ago is used.
+func GetOauth2ConfigWithContext(ctx context.Context, config Config) (*oauth2.Config, error) {
 	conf := &oauth2.Config{
 		ClientID:     config.ClientID,
 		ClientSecret: config.ClientSecret,
 		Scopes:       []string{config.Scope},
-		Endpoint: oauth2.Endpoint{
+	}
+
+	if config.TokenURL != "" {
+		conf.Endpoint = oauth2.Endpoint{AuthURL: config.AuthURL, TokenURL: config.TokenURL}
+	} else {
+		entry, err := discover(ctx, config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		conf.Endpoint = entry.endpoint
+	}
+
+	// The client assertion is added to the form parameters (see GetClientAssertion)
+	if UsesClientAssertion(config) {
+		conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+
+	return conf, nil
+}
+
+// GetVerifierWithContext returns a verifier checking the signature of the
+// tokens issued by config.Issuer against the issuer's JWKS. The keys are
+// fetched with ctx, which must outlive the verifier. The JWKS URL is read from
+// the discovery document unless config.JWKSURL is set.
+func GetVerifierWithContext(ctx context.Context, config Config, oidcConfig *oidc.Config) (*oidc.IDTokenVerifier, error) {
+	jwksURL := config.JWKSURL
+
+	if jwksURL == "" {
+		entry, err := discover(ctx, config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		jwksURL = entry.jwksURL
+	}
+
+	keySet := oidc.NewRemoteKeySet(ctx, jwksURL)
+
+	return oidc.NewVerifier(config.Issuer, keySet, oidcConfig), nil
+}
+
+// discover returns the discovery document of issuer, from the cache if possible
+func discover(ctx context.Context, issuer string) (discoveryEntry, error) {
+	key := discoveryKey{issuer: issuer}
+	key.client, _ = ctx.Value(oauth2.HTTPClient).(*http.Client)
+
+	discovery.Lock()
+	entry, cached := discovery.entries[key]
+	ttl := discovery.ttl
+	discovery.Unlock()
+
+	if cached && time.Since(entry.fetched) < ttl {
+		return entry, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		// The endpoints rarely change: a stale document is better than no token
+		if cached && ttl > 0 && ctx.Err() == nil && time.Since(entry.fetched) < maxStaleDiscovery {
+			return entry, nil
+		}
+		return discoveryEntry{}, err
+	}
+
+	var claims struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return discoveryEntry{}, err
+	}
+
+	entry = discoveryEntry{
+		endpoint: oauth2.Endpoint{
 			AuthURL:  provider.Endpoint().AuthURL,
 			TokenURL: provider.Endpoint().TokenURL,
 		},
+		jwksURL: claims.JWKSURL,
+		fetched: time.Now(),
 	}
 
-	return conf, nil
+	if ttl > 0 {
+		discovery.Lock()
+		discovery.entries[key] = entry
+		// The documents of the clients no longer used are dropped eventually
+		for k, e := range discovery.entries {
+			if time.Since(e.fetched) >= maxStaleDiscovery {
+				delete(discovery.entries, k)
+			}
+		}
+		discovery.Unlock()
+	}
+
+	return entry, nil
 }
@@ -0,0 +1,117 @@
+package credentials_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOauth2ConfigWithContext(t *testing.T) {
+
+	defer credentials.SetDiscoveryTTL(credentials.DefaultDiscoveryTTL)
+
+	testCases := []struct {
+		name          string
+		ttl           time.Duration
+		setup         func(*duokeytest.Server, *credentials.Config)
+		wantDiscovery int // Number of discovery requests for two calls
+		wantErr       bool
+	}{
+		{name: "Cached document", ttl: time.Minute, wantDiscovery: 1},
+		{name: "Cache disabled", ttl: 0, wantDiscovery: 2},
+		{name: "Token URL given",
+			ttl: time.Minute,
+			setup: func(s *duokeytest.Server, c *credentials.Config) {
+				c.TokenURL = s.URL + duokeytest.TokenPath
+			},
+			wantDiscovery: 0,
+		},
+		{name: "Issuer unreachable",
+			ttl: time.Minute,
+			setup: func(s *duokeytest.Server, _ *credentials.Config) {
+				s.InjectFault(duokeytest.DiscoveryPath, duokeytest.Fault{StatusCode: http.StatusServiceUnavailable})
+			},
+			wantDiscovery: 2,
+			wantErr:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := duokeytest.NewServer(nil)
+			defer server.Close()
+
+			credentials.SetDiscoveryTTL(tc.ttl)
+			creds := server.Credentials()
+			if tc.setup != nil {
+				tc.setup(server, &creds)
+			}
+
+			for i := 0; i < 2; i++ {
+				config, err := credentials.GetOauth2ConfigWithContext(context.Background(), creds)
+				if tc.wantErr {
+					assert.Error(t, err)
+					continue
+				}
+				require.NoError(t, err)
+				assert.Equal(t, server.URL+duokeytest.TokenPath, config.Endpoint.TokenURL)
+				assert.Equal(t, creds.ClientID, config.ClientID)
+			}
+
+			assert.Equal(t, tc.wantDiscovery, server.Calls(duokeytest.DiscoveryPath))
+		})
+	}
+}
+
+func TestDiscoveryPerHTTPClient(t *testing.T) {
+
+	credentials.ClearDiscoveryCache()
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	// A client with other transport settings does not reuse the document
+	// fetched by another one
+	for _, client := range []*http.Client{{}, {}} {
+		ctx := oidc.ClientContext(context.Background(), client)
+		for i := 0; i < 2; i++ {
+			_, err := credentials.GetOauth2ConfigWithContext(ctx, server.Credentials())
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, 2, server.Calls(duokeytest.DiscoveryPath))
+}
+
+func TestStaleDiscoveryDocument(t *testing.T) {
+
+	defer credentials.SetDiscoveryTTL(credentials.DefaultDiscoveryTTL)
+	credentials.SetDiscoveryTTL(time.Millisecond)
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	_, err := credentials.GetOauth2ConfigWithContext(context.Background(), server.Credentials())
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+
+	// The expired document is used when the issuer cannot be reached...
+	server.InjectFault(duokeytest.DiscoveryPath, duokeytest.Fault{StatusCode: http.StatusServiceUnavailable})
+	config, err := credentials.GetOauth2ConfigWithContext(context.Background(), server.Credentials())
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+duokeytest.TokenPath, config.Endpoint.TokenURL)
+	assert.Equal(t, 2, server.Calls(duokeytest.DiscoveryPath))
+
+	// ...but not when the caller gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	credentials.ClearDiscoveryCache()
+	_, err = credentials.GetOauth2ConfigWithContext(ctx, server.Credentials())
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package credentials
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Token exchange (RFC 8693) identifiers
+const (
+	TokenExchangeGrantType  = "urn:ietf:params:oauth:grant-type:token-exchange"
+	AccessTokenType         = "urn:ietf:params:oauth:token-type:access_token"
+	DefaultSubjectTokenType = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// UsesTokenExchange reports whether the client exchanges a subject token (e.g.
+// a Kubernetes service account token) for its access tokens rather than
+// running the password grant.
+func UsesTokenExchange(config Config) bool {
+	return config.SubjectTokenFile != ""
+}
+
+// GetSubjectToken reads the subject token of config. The file is read on each
+// call, so that a rotated token is picked up.
+func GetSubjectToken(config Config) (token string, tokenType string, err error) {
+	data, err := ioutil.ReadFile(config.SubjectTokenFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the subject token: %w", err)
+	}
+
+	token = strings.TrimSpace(string(data))
+	if token == "" {
+		return "", "", fmt.Errorf("failed to read the subject token: %s is empty", config.SubjectTokenFile)
+	}
+
+	tokenType = config.SubjectTokenType
+	if tokenType == "" {
+		tokenType = DefaultSubjectTokenType
+	}
+
+	return token, tokenType, nil
+}
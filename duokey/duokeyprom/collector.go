@@ -0,0 +1,177 @@
+// Package duokeyprom exports the metrics of DuoKey clients to Prometheus.
+//
+//	collector := duokeyprom.NewCollector(duokeyprom.Options{})
+//	prometheus.MustRegister(collector)
+//	config.Metrics = collector
+//
+// The metrics are labelled by tenant, so that one collector can be shared by
+// the clients of several tenants.
+package duokeyprom
+
+import (
+	"strconv"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace prefixes the names of the metrics
+const DefaultNamespace = "duokey"
+
+// Default buckets of the histograms
+var (
+	DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	DefaultSizeBuckets     = prometheus.ExponentialBuckets(64, 4, 8) // 64 B to 1 MiB
+)
+
+// Labels of the metrics
+const (
+	LabelOperation   = "operation"
+	LabelTenant      = "tenant"
+	LabelStatusClass = "status_class" // 2xx, 4xx, 5xx or none
+	LabelErrorKind   = "error_kind"   // See the duokey.ErrorKind constants
+	LabelGrantType   = "grant_type"
+	LabelDirection   = "direction" // request or response
+)
+
+// Options configures a Collector. The zero value uses the defaults.
+type Options struct {
+	Namespace       string
+	ConstLabels     prometheus.Labels
+	DurationBuckets []float64 // In seconds
+	SizeBuckets     []float64 // In bytes
+}
+
+// Collector records the activity of DuoKey clients. It implements both
+// duokey.Metrics and prometheus.Collector.
+type Collector struct {
+	requests      *prometheus.CounterVec
+	requestErrors *prometheus.CounterVec
+	retries       *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	payloadSize   *prometheus.HistogramVec
+
+	tokens        *prometheus.CounterVec
+	tokenErrors   *prometheus.CounterVec
+	tokenDuration *prometheus.HistogramVec
+}
+
+// Ensure that Collector implements the duokey.Metrics and
+// prometheus.Collector interfaces
+var _ duokey.Metrics = (*Collector)(nil)
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a collector to register with a prometheus.Registerer
+func NewCollector(options Options) *Collector {
+	if options.Namespace == "" {
+		options.Namespace = DefaultNamespace
+	}
+	if options.DurationBuckets == nil {
+		options.DurationBuckets = DefaultDurationBuckets
+	}
+	if options.SizeBuckets == nil {
+		options.SizeBuckets = DefaultSizeBuckets
+	}
+
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   options.Namespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: options.ConstLabels,
+		}, labels)
+	}
+	histogram := func(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   options.Namespace,
+			Name:        name,
+			Help:        help,
+			ConstLabels: options.ConstLabels,
+			Buckets:     buckets,
+		}, labels)
+	}
+
+	return &Collector{
+		requests: counter("requests_total", "Number of API requests.",
+			LabelOperation, LabelTenant, LabelStatusClass),
+		requestErrors: counter("request_errors_total", "Number of failed API requests.",
+			LabelOperation, LabelTenant, LabelStatusClass, LabelErrorKind),
+		retries: counter("request_retries_total", "Number of API request attempts after the first one.",
+			LabelOperation, LabelTenant),
+		duration: histogram("request_duration_seconds", "Duration of the API requests, all attempts included.",
+			options.DurationBuckets, LabelOperation, LabelTenant),
+		payloadSize: histogram("request_payload_bytes", "Size of the request and response bodies of the API requests.",
+			options.SizeBuckets, LabelOperation, LabelTenant, LabelDirection),
+		tokens: counter("token_acquisitions_total", "Number of access token acquisitions.",
+			LabelTenant, LabelGrantType),
+		tokenErrors: counter("token_errors_total", "Number of failed access token acquisitions.",
+			LabelTenant, LabelGrantType, LabelErrorKind),
+		tokenDuration: histogram("token_duration_seconds", "Duration of the access token acquisitions.",
+			options.DurationBuckets, LabelTenant, LabelGrantType),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.requests, c.requestErrors, c.retries, c.duration, c.payloadSize,
+		c.tokens, c.tokenErrors, c.tokenDuration,
+	}
+}
+
+// ObserveRequest implements duokey.Metrics
+func (c *Collector) ObserveRequest(o duokey.RequestObservation) {
+	tenant := formatTenant(o.TenantID)
+	class := statusClass(o.StatusCode)
+
+	c.requests.WithLabelValues(o.Operation, tenant, class).Inc()
+	if o.ErrorKind != "" {
+		c.requestErrors.WithLabelValues(o.Operation, tenant, class, o.ErrorKind).Inc()
+	}
+	if o.Retries > 0 {
+		c.retries.WithLabelValues(o.Operation, tenant).Add(float64(o.Retries))
+	}
+	c.duration.WithLabelValues(o.Operation, tenant).Observe(o.Duration.Seconds())
+
+	c.payloadSize.WithLabelValues(o.Operation, tenant, "request").Observe(float64(o.RequestSize))
+	if o.ResponseSize >= 0 {
+		c.payloadSize.WithLabelValues(o.Operation, tenant, "response").Observe(float64(o.ResponseSize))
+	}
+}
+
+// ObserveToken implements duokey.Metrics
+func (c *Collector) ObserveToken(o duokey.TokenObservation) {
+	tenant := formatTenant(o.TenantID)
+
+	c.tokens.WithLabelValues(tenant, o.GrantType).Inc()
+	if o.ErrorKind != "" {
+		c.tokenErrors.WithLabelValues(tenant, o.GrantType, o.ErrorKind).Inc()
+	}
+	c.tokenDuration.WithLabelValues(tenant, o.GrantType).Observe(o.Duration.Seconds())
+}
+
+func formatTenant(tenantID uint32) string {
+	return strconv.FormatUint(uint64(tenantID), 10)
+}
+
+// statusClass returns the class of an HTTP status ("2xx", "4xx", ...), "none"
+// if the server did not reply
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,147 @@
+package duokeyprom_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/client"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeyprom"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeytest"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type silentLogger struct{}
+
+func (silentLogger) Info(...interface{})          {}
+func (silentLogger) Infof(string, ...interface{}) {}
+
+func TestCollector(t *testing.T) {
+
+	collector := duokeyprom.NewCollector(duokeyprom.Options{})
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	creds := server.Credentials()
+	c, err := client.NewWithConfig(duokey.Config{
+		Credentials:  creds,
+		Logger:       silentLogger{},
+		TokenRefresh: duokey.TokenRefreshConfig{Disabled: true},
+		Metrics:      collector,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+	input := &kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	// A success, a renewal of the rejected token and a server error
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	server.RevokeTokens()
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	server.InjectFault(duokeytest.EncryptRoute, duokeytest.Fault{StatusCode: http.StatusInternalServerError, Count: 1})
+	_, err = kmsClient.Encrypt(input)
+	require.Error(t, err)
+
+	// An invalid input, rejected before it is sent
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	require.Error(t, err)
+
+	tenant := strconv.FormatUint(uint64(creds.TenantID), 10)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"duokey_requests_total", map[string]string{"operation": "Encrypt", "tenant": tenant, "status_class": "2xx"}, 2},
+		{"duokey_requests_total", map[string]string{"operation": "Encrypt", "tenant": tenant, "status_class": "5xx"}, 1},
+		{"duokey_request_errors_total", map[string]string{"operation": "Encrypt", "tenant": tenant, "status_class": "5xx", "error_kind": duokey.ErrorKindServer}, 1},
+		{"duokey_requests_total", map[string]string{"operation": "Encrypt", "tenant": tenant, "status_class": "none"}, 1},
+		{"duokey_request_errors_total", map[string]string{"operation": "Encrypt", "tenant": tenant, "status_class": "none", "error_kind": duokey.ErrorKindInvalidRequest}, 1},
+		{"duokey_request_retries_total", map[string]string{"operation": "Encrypt", "tenant": tenant}, 1},
+		{"duokey_request_duration_seconds", map[string]string{"operation": "Encrypt", "tenant": tenant}, 4},
+		{"duokey_request_payload_bytes", map[string]string{"operation": "Encrypt", "tenant": tenant, "direction": "request"}, 4},
+		{"duokey_token_acquisitions_total", map[string]string{"tenant": tenant, "grant_type": "password"}, 2},
+		{"duokey_token_duration_seconds", map[string]string{"tenant": tenant, "grant_type": "password"}, 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, value(t, families, tc.name, tc.labels))
+		})
+	}
+
+	count, err := testutil.GatherAndCount(registry, "duokey_token_errors_total")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestCollectorTokenErrors(t *testing.T) {
+
+	collector := duokeyprom.NewCollector(duokeyprom.Options{Namespace: "app"})
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+	server.InjectFault(duokeytest.TokenPath, duokeytest.Fault{StatusCode: http.StatusUnauthorized, Body: `{"error":"invalid_client"}`})
+
+	_, err := client.NewWithConfig(duokey.Config{Credentials: server.Credentials(), Logger: silentLogger{}, Metrics: collector})
+	require.Error(t, err)
+
+	count, err := testutil.GatherAndCount(wrap(collector), "app_token_errors_total")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func wrap(c prometheus.Collector) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	return registry
+}
+
+// value returns the value of a counter, or the sample count of a histogram
+func value(t *testing.T, families []*dto.MetricFamily, name string, labels map[string]string) float64 {
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			if metric.GetHistogram() != nil {
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("no metric %s %v", name, labels)
+	return 0
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	if len(metric.GetLabel()) != len(labels) {
+		return false
+	}
+	for _, pair := range metric.GetLabel() {
+		if labels[pair.GetName()] != pair.GetValue() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package duokeytest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+)
+
+// authenticateClient checks the client authentication of a token request:
+// private_key_jwt if a client assertion is given, the TLS client certificate
+// if Config.ClientCAs is set, the client secret otherwise
+func (s *Server) authenticateClient(r *http.Request) bool {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	if clientID != s.config.ClientID {
+		return false
+	}
+
+	if r.PostForm.Get("client_assertion_type") == credentials.ClientAssertionType {
+		return s.config.ClientPublicKey != nil && s.verifyAssertion(r.PostForm.Get("client_assertion")) == nil
+	}
+
+	if s.config.ClientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	return clientSecret == s.config.ClientSecret
+}
+
+// verifyAssertion verifies a private_key_jwt client assertion (RFC 7523)
+func (s *Server) verifyAssertion(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed assertion")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	if err := verifySignature(s.config.ClientPublicKey, header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return err
+	}
+
+	var claims struct {
+		Issuer   string `json:"iss"`
+		Subject  string `json:"sub"`
+		Audience string `json:"aud"`
+		Expiry   int64  `json:"exp"`
+		ID       string `json:"jti"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+
+	switch {
+	case claims.Issuer != s.config.ClientID || claims.Subject != s.config.ClientID:
+		return errors.New("bad issuer or subject")
+	case claims.Audience != s.URL+TokenPath:
+		return fmt.Errorf("bad audience: %s", claims.Audience)
+	case time.Now().After(time.Unix(claims.Expiry, 0)):
+		return errors.New("expired assertion")
+	case claims.ID == "":
+		return errors.New("missing jti")
+	}
+
+	// An assertion cannot be replayed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.assertions[claims.ID] {
+		return errors.New("assertion replayed")
+	}
+	s.assertions[claims.ID] = true
+
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature verifies a JWS signature (RS256, ES256 or EdDSA)
+func verifySignature(pub crypto.PublicKey, alg string, input, signature []byte) error {
+	digest := sha256.Sum256(input)
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		sig := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(pub, input, signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %s not supported for a key of type %T", alg, pub)
+}
@@ -0,0 +1,282 @@
+package duokeytest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/google/uuid"
+)
+
+// KeyType is the type of a software key
+type KeyType string
+
+const (
+	KeyAES KeyType = kms.KeyTypeAES // AES-256
+	KeyRSA KeyType = kms.KeyTypeRSA // RSA 2048 bits
+)
+
+const rsaKeySize = 2048
+
+// errAuthentication is the message of the .NET AuthenticationTagMismatchException,
+// reported verbatim by the DuoKey server when a GCM tag does not match
+var errAuthentication = errors.New("The computed authentication tag did not match the input authentication tag.")
+
+// softwareKey is a key held in memory by the fake server
+type softwareKey struct {
+	data    kms.KeyData
+	aesKey  []byte
+	rsaKey  *rsa.PrivateKey
+	keyType KeyType
+}
+
+// CreateKey generates a software key in a vault and returns its ID. The key
+// is enabled and can be used for encryption and decryption.
+func (s *Server) CreateKey(vaultID string, keyType KeyType) string {
+	key := &softwareKey{keyType: keyType}
+
+	switch keyType {
+	case KeyAES:
+		key.aesKey = make([]byte, 32)
+		if _, err := rand.Read(key.aesKey); err != nil {
+			panic(fmt.Sprintf("duokeytest: failed to generate an AES key: %v", err))
+		}
+	case KeyRSA:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+		if err != nil {
+			panic(fmt.Sprintf("duokeytest: failed to generate an RSA key: %v", err))
+		}
+		key.rsaKey = rsaKey
+	default:
+		panic(fmt.Sprintf("duokeytest: unknown key type %s", keyType))
+	}
+
+	return s.addKey(vaultID, key)
+}
+
+// addKey stores a key in a vault and fills in its metadata
+func (s *Server) addKey(vaultID string, key *softwareKey) string {
+	keyID := uuid.New().String()
+
+	key.data = kms.KeyData{
+		Name:       keyID,
+		IsEnabled:  true,
+		IsEncrypt:  true,
+		IsDecrypt:  true,
+		ExternalId: keyID,
+		Type:       string(key.keyType),
+		VaultId:    vaultID,
+		Id:         keyID,
+	}
+
+	switch key.keyType {
+	case KeyAES:
+		key.data.Size = 8 * len(key.aesKey)
+	case KeyRSA:
+		key.data.Size = key.rsaKey.N.BitLen()
+		if der, err := x509.MarshalPKIXPublicKey(&key.rsaKey.PublicKey); err == nil {
+			key.data.PublicKey = base64.StdEncoding.EncodeToString(der)
+			key.data.PublishPublicKey = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.vaults[vaultID] == nil {
+		s.vaults[vaultID] = make(map[string]*softwareKey)
+	}
+	s.vaults[vaultID][keyID] = key
+
+	return keyID
+}
+
+// SetKeyUsage changes the usage flags of a key. It returns false if the key
+// does not exist.
+func (s *Server) SetKeyUsage(vaultID, keyID string, enabled, encrypt, decrypt bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.vaults[vaultID][keyID]
+	if !ok {
+		return false
+	}
+
+	key.data.IsEnabled = enabled
+	key.data.IsEncrypt = encrypt
+	key.data.IsDecrypt = decrypt
+
+	return true
+}
+
+// key returns a snapshot of a key of a vault. The snapshot is taken under
+// s.mu since SetKeyUsage may change the usage flags concurrently.
+func (s *Server) key(vaultID, keyID string) (*softwareKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.vaults[vaultID][keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in vault %s", keyID, vaultID)
+	}
+	snapshot := *key
+	return &snapshot, nil
+}
+
+// findKey looks a key up in all the vaults and returns a snapshot of it
+func (s *Server) findKey(keyID string) (*softwareKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, keys := range s.vaults {
+		if key, ok := keys[keyID]; ok {
+			snapshot := *key
+			return &snapshot, nil
+		}
+	}
+	return nil, fmt.Errorf("key %s not found", keyID)
+}
+
+// ciphertext is the result of an encryption. Iv and tag are empty for RSA.
+type ciphertext struct {
+	algorithm kms.Algorithm
+	payload   []byte
+	iv        []byte
+	tag       []byte
+}
+
+// encrypt encrypts plaintext. The GCM tag is returned separately.
+func (k *softwareKey) encrypt(algorithm kms.Algorithm, plaintext, aad []byte) (*ciphertext, error) {
+	if !k.data.IsEnabled || !k.data.IsEncrypt {
+		return nil, fmt.Errorf("key %s cannot be used for encryption", k.data.Id)
+	}
+
+	algorithm, err := k.algorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aad) > 0 && !algorithm.SupportsAAD() {
+		return nil, fmt.Errorf("algorithm %s does not support additional authenticated data", algorithm)
+	}
+
+	switch algorithm {
+	case kms.AlgorithmAESGCM:
+		gcm, err := k.gcm()
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		sealed := gcm.Seal(nil, iv, plaintext, aad)
+		n := len(sealed) - gcm.Overhead()
+		return &ciphertext{algorithm: algorithm, payload: sealed[:n], iv: iv, tag: sealed[n:]}, nil
+	case kms.AlgorithmRSAOAEP256:
+		payload, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &k.rsaKey.PublicKey, plaintext, nil)
+		return &ciphertext{algorithm: algorithm, payload: payload}, err
+	case kms.AlgorithmRSAOAEP:
+		payload, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &k.rsaKey.PublicKey, plaintext, nil)
+		return &ciphertext{algorithm: algorithm, payload: payload}, err
+	case kms.AlgorithmRSAPKCS1:
+		payload, err := rsa.EncryptPKCS1v15(rand.Reader, &k.rsaKey.PublicKey, plaintext)
+		return &ciphertext{algorithm: algorithm, payload: payload}, err
+	}
+
+	return nil, fmt.Errorf("algorithm %s not supported by the fake server", algorithm)
+}
+
+// decrypt decrypts c. For AES-GCM, the tag is either in c.tag or appended to
+// c.payload.
+func (k *softwareKey) decrypt(c *ciphertext, aad []byte) ([]byte, error) {
+	if !k.data.IsEnabled || !k.data.IsDecrypt {
+		return nil, fmt.Errorf("key %s cannot be used for decryption", k.data.Id)
+	}
+
+	algorithm, err := k.algorithm(c.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	switch algorithm {
+	case kms.AlgorithmAESGCM:
+		gcm, err := k.gcm()
+		if err != nil {
+			return nil, err
+		}
+		if len(c.iv) != gcm.NonceSize() {
+			return nil, fmt.Errorf("bad initialization vector")
+		}
+		sealed := append(append([]byte{}, c.payload...), c.tag...)
+		plaintext, err := gcm.Open(nil, c.iv, sealed, aad)
+		if err != nil {
+			return nil, errAuthentication
+		}
+		return plaintext, nil
+	case kms.AlgorithmRSAOAEP256:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, k.rsaKey, c.payload, nil)
+	case kms.AlgorithmRSAOAEP:
+		return rsa.DecryptOAEP(sha1.New(), rand.Reader, k.rsaKey, c.payload, nil)
+	case kms.AlgorithmRSAPKCS1:
+		return rsa.DecryptPKCS1v15(rand.Reader, k.rsaKey, c.payload)
+	}
+
+	return nil, fmt.Errorf("algorithm %s not supported by the fake server", algorithm)
+}
+
+// algorithm returns the algorithm to use with the key: the default algorithm
+// of the key type if none is requested.
+func (k *softwareKey) algorithm(algorithm kms.Algorithm) (kms.Algorithm, error) {
+	algorithm = algorithm.Normalize()
+
+	if algorithm == "" {
+		switch k.keyType {
+		case KeyAES:
+			return kms.AlgorithmAESGCM, nil
+		case KeyRSA:
+			return kms.AlgorithmRSAOAEP256, nil
+		}
+	}
+
+	if !algorithm.IsValid() {
+		return "", fmt.Errorf("unknown algorithm: %s", algorithm)
+	}
+
+	isAES := strings.HasPrefix(string(algorithm), "AES")
+	if isAES != (k.keyType == KeyAES) {
+		return "", fmt.Errorf("algorithm %s cannot be used with a key of type '%s'", algorithm, k.keyType)
+	}
+
+	return algorithm, nil
+}
+
+func (k *softwareKey) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kcv returns the key check value of an AES key: the first three bytes of the
+// encryption of a zero block
+func kcv(key []byte) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ""
+	}
+	out := make([]byte, aes.BlockSize)
+	block.Encrypt(out, make([]byte, aes.BlockSize))
+	return strings.ToUpper(hex.EncodeToString(out[:3]))
+}
@@ -0,0 +1,281 @@
+package duokeytest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+)
+
+// handleEncrypt serves EncryptRoute. The GCM tag is appended to the
+// encrypted payload, as done by the DuoKey server.
+func (s *Server) handleEncrypt(w http.ResponseWriter, r *http.Request) {
+	var input kms.EncryptInput
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	output, status, err := s.encrypt(&input)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, output)
+}
+
+func (s *Server) encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, int, error) {
+	if err := s.checkContext(input.Context); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	key, err := s.key(input.VaultID, input.KeyID)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	c, err := key.encrypt(input.Algorithm, input.Payload, input.AAD)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	output := &kms.EncryptOutput{Success: true, ABP: true}
+	output.Result.ID = input.ID
+	output.Result.KeyID = input.KeyID
+	output.Result.Algorithm = c.algorithm
+	output.Result.EncryptedPayload = base64.StdEncoding.EncodeToString(append(c.payload, c.tag...))
+	output.Result.AAD = input.AAD
+	if len(c.iv) > 0 {
+		output.Result.Iv = base64.StdEncoding.EncodeToString(c.iv)
+	}
+
+	return output, http.StatusOK, nil
+}
+
+// handleDecrypt serves DecryptRoute. The GCM tag is read from the tag field
+// or from the end of the payload.
+func (s *Server) handleDecrypt(w http.ResponseWriter, r *http.Request) {
+	var input kms.DecryptInput
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	output, status, err := s.decrypt(&input)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, output)
+}
+
+func (s *Server) decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, int, error) {
+	if err := s.checkContext(input.Context); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	key, err := s.key(input.VaultID, input.KeyID)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	c := &ciphertext{algorithm: input.Algorithm}
+	for _, field := range []struct {
+		name  string
+		value string
+		out   *[]byte
+	}{
+		{"payload", input.Payload, &c.payload},
+		{"iv", input.Iv, &c.iv},
+		{"tag", input.Tag, &c.tag},
+	} {
+		if *field.out, err = base64.StdEncoding.DecodeString(field.value); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("%s: %v", field.name, err)
+		}
+	}
+
+	plaintext, err := key.decrypt(c, input.AAD)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	output := &kms.DecryptOutput{Success: true, ABP: true}
+	output.Result.ID = input.ID
+	output.Result.KeyID = input.KeyID
+	output.Result.Algorithm = input.Algorithm
+	output.Result.Payload = plaintext
+	output.Result.AAD = input.AAD
+
+	return output, http.StatusOK, nil
+}
+
+// handleImport serves ImportRoute. The payload is imported as an AES key.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	var input kms.ImportInput
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	if err := s.checkContext(input.Context); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	switch len(input.Payload) {
+	case 16, 24, 32:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad AES key length: %d", len(input.Payload)))
+		return
+	}
+
+	key := &softwareKey{keyType: KeyAES, aesKey: append([]byte{}, input.Payload...)}
+	keyID := s.addKey(input.VaultID, key)
+
+	output := &kms.ImportOutput{Success: true, ABP: true}
+	output.Result.ID = input.ID
+	output.Result.KeyID = keyID
+	output.Result.KCV = kcv(key.aesKey)
+
+	writeJSON(w, http.StatusOK, output)
+}
+
+// handleGetKeyId serves GetKeyIdRoute
+func (s *Server) handleGetKeyId(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	key, err := s.findKey(r.URL.Query().Get("externalId"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	output := &kms.GetKeyIdOutput{Success: true, ABP: true}
+	output.Result.Key = key.data
+	output.Result.VaultName = key.data.VaultId
+
+	writeJSON(w, http.StatusOK, output)
+}
+
+// handleReEncrypt serves ReEncryptRoute
+func (s *Server) handleReEncrypt(w http.ResponseWriter, r *http.Request) {
+	var input kms.ReEncryptInput
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	dOutput, status, err := s.decrypt(&kms.DecryptInput{
+		ID:        input.ID,
+		KeyID:     input.SourceKeyID,
+		VaultID:   input.SourceVaultID,
+		Algorithm: input.SourceAlgorithm,
+		Context:   input.Context,
+		Payload:   input.Payload,
+		Iv:        input.SourceIv,
+		Tag:       input.SourceTag,
+		AAD:       input.SourceAAD,
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	eOutput, status, err := s.encrypt(&kms.EncryptInput{
+		ID:        input.ID,
+		KeyID:     input.DestinationKeyID,
+		VaultID:   input.DestinationVaultID,
+		Algorithm: input.DestinationAlgorithm,
+		Context:   input.Context,
+		Payload:   dOutput.Result.Payload,
+		AAD:       input.DestinationAAD,
+	})
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	output := &kms.ReEncryptOutput{Success: true, ABP: true}
+	output.Result.ID = input.ID
+	output.Result.KeyID = input.DestinationKeyID
+	output.Result.SourceKeyID = input.SourceKeyID
+	output.Result.Algorithm = eOutput.Result.Algorithm
+	output.Result.EncryptedPayload = eOutput.Result.EncryptedPayload
+	output.Result.Iv = eOutput.Result.Iv
+
+	writeJSON(w, http.StatusOK, output)
+}
+
+// batchResponse is the body returned by the batch routes
+type batchResponse struct {
+	Success bool `json:"success"`
+	Result  struct {
+		Items []interface{} `json:"items"`
+	} `json:"result"`
+	ABP bool `json:"__abp"`
+}
+
+// handleEncryptBatch serves EncryptBatchRoute. Failed items are reported
+// individually.
+func (s *Server) handleEncryptBatch(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Items []*kms.EncryptInput `json:"items"`
+	}
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	response := &batchResponse{Success: true, ABP: true}
+	for _, item := range input.Items {
+		output, _, err := s.encrypt(item)
+		if err != nil {
+			response.Result.Items = append(response.Result.Items, envelope{Error: err.Error()})
+			continue
+		}
+		response.Result.Items = append(response.Result.Items, output)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleDecryptBatch serves DecryptBatchRoute. Failed items are reported
+// individually.
+func (s *Server) handleDecryptBatch(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Items []*kms.DecryptInput `json:"items"`
+	}
+	if !decodeInput(w, r, &input) {
+		return
+	}
+
+	response := &batchResponse{Success: true, ABP: true}
+	for _, item := range input.Items {
+		output, _, err := s.decrypt(item)
+		if err != nil {
+			response.Result.Items = append(response.Result.Items, envelope{Error: err.Error()})
+			continue
+		}
+		response.Result.Items = append(response.Result.Items, output)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// decodeInput deserializes the body of a POST request. It writes an error
+// response and returns false on failure.
+func decodeInput(w http.ResponseWriter, r *http.Request, input interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad request body: %v", err))
+		return false
+	}
+
+	return true
+}
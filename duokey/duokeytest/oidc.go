@@ -0,0 +1,296 @@
+package duokeytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/google/uuid"
+)
+
+// TokenOptions alters the behaviour of the identity provider, to simulate
+// misconfigured or misbehaving issuers.
+type TokenOptions struct {
+	// TokenType is the token_type returned by the token endpoint ("Bearer" if empty)
+	TokenType string
+	// Lifetime overrides Config.TokenLifetime if not zero. A negative value
+	// issues tokens that are already expired.
+	Lifetime time.Duration
+	// Issuer is announced in the discovery document and set in the tokens
+	// (the server URL if empty)
+	Issuer string
+	// RefreshTokens makes the token endpoint return refresh tokens and accept
+	// the refresh_token grant. Refresh tokens are single use.
+	RefreshTokens bool
+}
+
+// SetTokenOptions changes the tokens issued from now on.
+func (s *Server) SetTokenOptions(options TokenOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.options = options
+}
+
+// Claims are set in the access and ID tokens issued by the server. The access
+// tokens are JWTs signed with RS256; the public key is published in the JWKS.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	Expiry    int64    `json:"exp"`
+	ID        string   `json:"jti,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	TenantID  string   `json:"tenantid,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Roles     []string `json:"role,omitempty"`
+	TokenType string   `json:"typ,omitempty"`
+}
+
+// issuerURL returns the issuer announced by the server
+func (s *Server) issuerURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.options.Issuer != "" {
+		return s.options.Issuer
+	}
+	return s.URL
+}
+
+// handleDiscovery serves the OIDC discovery document
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.issuerURL(),
+		"authorization_endpoint":                s.URL + AuthPath,
+		"token_endpoint":                        s.URL + TokenPath,
+		"jwks_uri":                              s.URL + JWKSPath,
+		"grant_types_supported":                 []string{"password", "refresh_token", credentials.TokenExchangeGrantType},
+		"response_types_supported":              []string{"token", "id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", s.config.Scope},
+	})
+}
+
+// handleJWKS serves the public key used to sign the tokens
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := s.signingKey.PublicKey
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": s.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// handleToken implements the resource owner password credentials, refresh
+// token and token exchange grants. The tenant header added by the SDK is
+// mandatory.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeTokenError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+
+	if err := s.checkTenant(r); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.authenticateClient(r) {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "password":
+		if r.PostForm.Get("username") != s.config.UserName || r.PostForm.Get("password") != s.config.Password {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		s.writeToken(w, s.config.UserName, "")
+	case "refresh_token":
+		subject, ok := s.useRefreshToken(r.PostForm.Get("refresh_token"))
+		if !ok {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		s.writeToken(w, subject, "")
+	case credentials.TokenExchangeGrantType:
+		if !s.acceptSubjectToken(r.PostForm.Get("subject_token"), r.PostForm.Get("subject_token_type")) {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		// The workload is identified by the client
+		s.writeToken(w, s.config.ClientID, credentials.AccessTokenType)
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+// useRefreshToken consumes a refresh token and returns its subject
+func (s *Server) useRefreshToken(refreshToken string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subject, ok := s.refreshTokens[refreshToken]
+	if !s.options.RefreshTokens || !ok {
+		return "", false
+	}
+	delete(s.refreshTokens, refreshToken)
+
+	return subject, true
+}
+
+// acceptSubjectToken reports whether a subject token can be exchanged
+func (s *Server) acceptSubjectToken(token, tokenType string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tokenType == "" {
+		return false
+	}
+	for _, t := range s.subjectTokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// writeToken issues an access token and an ID token for subject. The issued
+// token type is only returned by the token exchange grant.
+func (s *Server) writeToken(w http.ResponseWriter, subject, issuedTokenType string) {
+	s.mu.Lock()
+	options := s.options
+	s.mu.Unlock()
+
+	lifetime := s.config.TokenLifetime
+	if options.Lifetime != 0 {
+		lifetime = options.Lifetime
+	}
+
+	tokenType := options.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+
+	accessToken := s.IssueToken(subject, lifetime)
+
+	claims := s.claims(subject, lifetime)
+	idToken := s.sign(claims)
+
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"id_token":     idToken,
+		"token_type":   tokenType,
+		"expires_in":   int(lifetime.Seconds()),
+		"scope":        s.config.Scope,
+	}
+
+	if issuedTokenType != "" {
+		response["issued_token_type"] = issuedTokenType
+	}
+
+	if options.RefreshTokens {
+		refreshToken := uuid.New().String()
+		s.mu.Lock()
+		s.refreshTokens[refreshToken] = subject
+		s.mu.Unlock()
+		response["refresh_token"] = refreshToken
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// IssueToken returns an access token for subject accepted by the KMS routes,
+// as if it had been obtained from the token endpoint.
+func (s *Server) IssueToken(subject string, lifetime time.Duration) string {
+	claims := s.claims(subject, lifetime)
+	claims.TokenType = "at+jwt"
+	token := s.sign(claims)
+
+	s.mu.Lock()
+	s.tokens[token] = time.Unix(claims.Expiry, 0)
+	s.mu.Unlock()
+
+	return token
+}
+
+// claims returns the claims of a token issued now
+func (s *Server) claims(subject string, lifetime time.Duration) Claims {
+	now := time.Now()
+
+	return Claims{
+		Issuer:   s.issuerURL(),
+		Subject:  subject,
+		Audience: s.config.ClientID,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(lifetime).Unix(),
+		ID:       uuid.New().String(),
+		Scope:    s.config.Scope,
+		TenantID: s.tenantID(),
+		ClientID: s.config.ClientID,
+		Roles:    s.config.Roles,
+	}
+}
+
+// sign returns a JWT signed with RS256
+func (s *Server) sign(claims Claims) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.signingKey, crypto.SHA256, digest[:])
+	if err != nil {
+		panic("duokeytest: failed to sign a token: " + err.Error())
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authenticated checks the access token and the tenant header before calling next
+func (s *Server) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+
+		s.mu.Lock()
+		expiry, ok := s.tokens[token]
+		s.mu.Unlock()
+
+		if auth == token || !ok || time.Now().After(expiry) {
+			writeJSON(w, http.StatusUnauthorized, envelope{Error: "invalid or expired access token", UnauthorizedRequest: true})
+			return
+		}
+
+		if err := s.checkTenant(r); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,376 @@
+// Package duokeytest provides an in-process fake DuoKey server for tests. The
+// server exposes an OIDC discovery document, a token endpoint (password
+// grant) and the KMS routes. Keys are software keys held per vault; the
+// cryptographic operations (AES-GCM, RSA-OAEP, RSA PKCS #1 v1.5) are real.
+//
+//	server := duokeytest.NewServer(nil)
+//	defer server.Close()
+//
+//	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+//	client, err := kms.NewClient(server.Credentials(), server.Endpoints())
+package duokeytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/google/uuid"
+)
+
+// Routes served by the fake server
+const (
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	JWKSPath          = "/.well-known/openid-configuration/jwks"
+	AuthPath          = "/connect/authorize"
+	TokenPath         = "/connect/token"
+	EncryptRoute      = "/api/services/app/Keys/CreateEncryptRequest"
+	DecryptRoute      = "/api/services/app/Keys/CreateDecryptRequest"
+	ImportRoute       = "/api/services/app/Keys/CreateImportRequest"
+	GetKeyIdRoute     = "/api/services/app/Keys/GetKeyByExternalId"
+	ReEncryptRoute    = "/api/services/app/Keys/CreateReEncryptRequest"
+	EncryptBatchRoute = "/api/services/app/Keys/CreateEncryptBatchRequest"
+	DecryptBatchRoute = "/api/services/app/Keys/CreateDecryptBatchRequest"
+)
+
+// Default credentials accepted by the fake server
+const (
+	DefaultClientID       = "duokeytest"
+	DefaultClientSecret   = "duokeytest-secret"
+	DefaultUserName       = "jane.doe"
+	DefaultPassword       = "tooManyS3cr3ts!"
+	DefaultScope          = "duokey"
+	DefaultHeaderTenantID = "Abp.TenantId"
+	DefaultTenantID       = 1
+)
+
+// DefaultTokenLifetime is the lifetime of the access tokens when
+// Config.TokenLifetime is not set
+const DefaultTokenLifetime = time.Hour
+
+// Config stores the credentials accepted by the fake server. Empty fields are
+// set to their default value.
+type Config struct {
+	AppID          string
+	ClientID       string
+	ClientSecret   string
+	UserName       string
+	Password       string
+	Scope          string
+	HeaderTenantID string
+	TenantID       uint32
+	TokenLifetime  time.Duration
+	Roles          []string // Set in the role claim of the tokens
+
+	// ClientCAs enables mutual TLS on a server started with NewTLSServer:
+	// the clients must present a certificate signed by one of these CAs,
+	// which also authenticates them at the token endpoint (no secret needed).
+	ClientCAs *x509.CertPool
+	// ClientPublicKey enables the private_key_jwt client authentication:
+	// the token endpoint accepts client assertions signed with the matching
+	// private key (RSA, ECDSA P-256 or Ed25519).
+	ClientPublicKey crypto.PublicKey
+	// SubjectTokens are the subject tokens accepted by the token exchange
+	// grant (RFC 8693). The exchanged tokens are issued for ClientID.
+	SubjectTokens []string
+}
+
+// Fault alters the response of the server for a given path. If StatusCode is
+// set, the request is not processed and the server replies with StatusCode
+// and Body. Latency is added before the request is handled. Count is the
+// number of requests affected (0 means all of them).
+type Fault struct {
+	StatusCode int
+	Body       string
+	Latency    time.Duration
+	Count      int
+}
+
+// Server is a fake DuoKey server. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	config Config
+
+	signingKey *rsa.PrivateKey // Signs the access and ID tokens
+	keyID      string
+
+	mu            sync.Mutex
+	vaults        map[string]map[string]*softwareKey // Vault ID -> key ID -> key
+	tokens        map[string]time.Time               // Access token -> expiry
+	refreshTokens map[string]string                  // Refresh token -> subject
+	faults        map[string]*Fault
+	latency       time.Duration
+	calls         map[string]int
+	options       TokenOptions
+	assertions    map[string]bool // IDs of the client assertions already used
+	subjectTokens []string
+}
+
+// NewServer starts and returns a fake DuoKey server. The caller should call
+// Close when finished, to shut it down.
+func NewServer(config *Config) *Server {
+	s := newServer(config)
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// NewTLSServer starts and returns a fake DuoKey server using TLS. Use
+// Server.Client to get an HTTP client trusting the server certificate.
+func NewTLSServer(config *Config) *Server {
+	s := newServer(config)
+	s.Server = httptest.NewUnstartedServer(s.handler())
+	if s.config.ClientCAs != nil {
+		s.Server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: s.config.ClientCAs}
+	}
+	s.StartTLS()
+	return s
+}
+
+func newServer(config *Config) *Server {
+	var c Config
+	if config != nil {
+		c = *config
+	}
+
+	if c.AppID == "" {
+		c.AppID = uuid.New().String()
+	}
+	if c.ClientID == "" {
+		c.ClientID = DefaultClientID
+	}
+	if c.ClientSecret == "" {
+		c.ClientSecret = DefaultClientSecret
+	}
+	if c.UserName == "" {
+		c.UserName = DefaultUserName
+	}
+	if c.Password == "" {
+		c.Password = DefaultPassword
+	}
+	if c.Scope == "" {
+		c.Scope = DefaultScope
+	}
+	if c.HeaderTenantID == "" {
+		c.HeaderTenantID = DefaultHeaderTenantID
+	}
+	if c.TenantID == 0 {
+		c.TenantID = DefaultTenantID
+	}
+	if c.TokenLifetime == 0 {
+		c.TokenLifetime = DefaultTokenLifetime
+	}
+
+	signingKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	if err != nil {
+		panic(fmt.Sprintf("duokeytest: failed to generate the signing key: %v", err))
+	}
+
+	return &Server{
+		config:        c,
+		signingKey:    signingKey,
+		keyID:         uuid.New().String(),
+		vaults:        make(map[string]map[string]*softwareKey),
+		tokens:        make(map[string]time.Time),
+		refreshTokens: make(map[string]string),
+		faults:        make(map[string]*Fault),
+		calls:         make(map[string]int),
+		assertions:    make(map[string]bool),
+		subjectTokens: c.SubjectTokens,
+	}
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(DiscoveryPath, s.handleDiscovery)
+	mux.HandleFunc(JWKSPath, s.handleJWKS)
+	mux.HandleFunc(TokenPath, s.handleToken)
+
+	mux.HandleFunc(EncryptRoute, s.authenticated(s.handleEncrypt))
+	mux.HandleFunc(DecryptRoute, s.authenticated(s.handleDecrypt))
+	mux.HandleFunc(ImportRoute, s.authenticated(s.handleImport))
+	mux.HandleFunc(GetKeyIdRoute, s.authenticated(s.handleGetKeyId))
+	mux.HandleFunc(ReEncryptRoute, s.authenticated(s.handleReEncrypt))
+	mux.HandleFunc(EncryptBatchRoute, s.authenticated(s.handleEncryptBatch))
+	mux.HandleFunc(DecryptBatchRoute, s.authenticated(s.handleDecryptBatch))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[r.URL.Path]++
+		latency := s.latency
+		var fault Fault
+		if f, ok := s.faults[r.URL.Path]; ok {
+			fault = *f
+			if f.Count > 0 {
+				f.Count--
+				if f.Count == 0 {
+					delete(s.faults, r.URL.Path)
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if d := latency + fault.Latency; d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fault.StatusCode != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(fault.StatusCode)
+			w.Write([]byte(fault.Body))
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Config returns the configuration of the server, default values included.
+func (s *Server) Config() Config {
+	return s.config
+}
+
+// Credentials returns credentials accepted by the server.
+func (s *Server) Credentials() credentials.Config {
+	return credentials.Config{
+		Issuer:         s.URL,
+		AppID:          s.config.AppID,
+		ClientID:       s.config.ClientID,
+		ClientSecret:   s.config.ClientSecret,
+		UserName:       s.config.UserName,
+		Password:       s.config.Password,
+		Scope:          s.config.Scope,
+		HeaderTenantID: s.config.HeaderTenantID,
+		TenantID:       s.config.TenantID,
+	}
+}
+
+// Endpoints returns the KMS endpoints of the server. The optional routes
+// (re-encryption and batches) are included.
+func (s *Server) Endpoints() kms.Endpoints {
+	return kms.Endpoints{
+		BaseURL:           s.URL,
+		EncryptRoute:      EncryptRoute,
+		DecryptRoute:      DecryptRoute,
+		ImportRoute:       ImportRoute,
+		GetKeyIdRoute:     GetKeyIdRoute,
+		ReEncryptRoute:    ReEncryptRoute,
+		EncryptBatchRoute: EncryptBatchRoute,
+		DecryptBatchRoute: DecryptBatchRoute,
+	}
+}
+
+// InjectFault alters the responses of the server for path (e.g. EncryptRoute
+// or TokenPath). It replaces any fault previously injected for path.
+func (s *Server) InjectFault(path string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := fault
+	s.faults[path] = &f
+}
+
+// ClearFaults removes all the injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = make(map[string]*Fault)
+}
+
+// SetLatency adds a delay before every request is handled.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = latency
+}
+
+// Calls returns the number of requests received for path.
+func (s *Server) Calls(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[path]
+}
+
+// SetSubjectTokens replaces the subject tokens accepted by the token exchange
+// grant, e.g. to simulate their rotation.
+func (s *Server) SetSubjectTokens(tokens ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subjectTokens = tokens
+}
+
+// RevokeTokens invalidates all the access tokens issued so far.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = make(map[string]time.Time)
+}
+
+func (s *Server) tenantID() string {
+	return strconv.FormatUint(uint64(s.config.TenantID), 10)
+}
+
+func (s *Server) checkTenant(r *http.Request) error {
+	tenantID := r.Header.Get(s.config.HeaderTenantID)
+	if tenantID == "" {
+		return fmt.Errorf("header %s not found", s.config.HeaderTenantID)
+	}
+	if tenantID != s.tenantID() {
+		return fmt.Errorf("unknown tenant: %s", tenantID)
+	}
+	return nil
+}
+
+// checkContext verifies the mandatory context added by the SDK
+func (s *Server) checkContext(context map[string]string) error {
+	if context["appid"] != s.config.AppID {
+		return fmt.Errorf("context: bad appid '%s'", context["appid"])
+	}
+	if context["tenantid"] != s.tenantID() {
+		return fmt.Errorf("context: bad tenantid '%s'", context["tenantid"])
+	}
+	return nil
+}
+
+// envelope is the generic error response of the DuoKey API
+type envelope struct {
+	Success             bool   `json:"success"`
+	Error               string `json:"error,omitempty"`
+	UnauthorizedRequest bool   `json:"unAuthorizedRequest"`
+	ABP                 bool   `json:"__abp"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, envelope{Error: err.Error(), ABP: true})
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
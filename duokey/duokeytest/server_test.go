@@ -0,0 +1,344 @@
+package duokeytest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type silentLogger struct{}
+
+func (silentLogger) Info(...interface{})          {}
+func (silentLogger) Infof(string, ...interface{}) {}
+
+var _ duokey.Logger = silentLogger{}
+
+func newTestClient(t *testing.T, server *Server) *kms.KMS {
+	client, err := kms.NewClientWithLogger(server.Credentials(), server.Endpoints(), silentLogger{})
+	require.NoError(t, err)
+	return client
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+
+	testCases := []struct {
+		name      string
+		keyType   KeyType
+		algorithm kms.Algorithm
+		aad       []byte
+	}{
+		{name: "AES-GCM", keyType: KeyAES, algorithm: kms.AlgorithmAESGCM},
+		{name: "AES-GCM with AAD", keyType: KeyAES, algorithm: kms.AlgorithmAESGCM, aad: []byte("record-42")},
+		{name: "RSA-OAEP-256", keyType: KeyRSA, algorithm: kms.AlgorithmRSAOAEP256},
+		{name: "Legacy identifier", keyType: KeyRSA, algorithm: "3"},
+		{name: "RSA1_5", keyType: KeyRSA, algorithm: kms.AlgorithmRSAPKCS1},
+	}
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+			keyID := server.CreateKey("vault", testCase.keyType)
+
+			eOutput, err := client.Encrypt(&kms.EncryptInput{
+				KeyID:     keyID,
+				VaultID:   "vault",
+				Algorithm: testCase.algorithm,
+				Payload:   []byte("Lorem ipsum"),
+				AAD:       testCase.aad,
+			})
+			require.NoError(t, err)
+			assert.NotEqual(t, "Lorem ipsum", eOutput.Result.EncryptedPayload)
+
+			dOutput, err := client.Decrypt(&kms.DecryptInput{
+				KeyID:     keyID,
+				VaultID:   "vault",
+				Algorithm: testCase.algorithm,
+				Payload:   eOutput.Result.EncryptedPayload,
+				Iv:        eOutput.Result.Iv,
+				AAD:       testCase.aad,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []byte("Lorem ipsum"), dOutput.Result.Payload)
+		})
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+	keyID := server.CreateKey("vault", KeyAES)
+
+	eOutput, err := client.Encrypt(&kms.EncryptInput{
+		KeyID:     keyID,
+		VaultID:   "vault",
+		Algorithm: kms.AlgorithmAESGCM,
+		Payload:   []byte("Lorem ipsum"),
+		AAD:       []byte("tenant A"),
+	})
+	require.NoError(t, err)
+
+	_, err = client.Decrypt(&kms.DecryptInput{
+		KeyID:     keyID,
+		VaultID:   "vault",
+		Algorithm: kms.AlgorithmAESGCM,
+		Payload:   eOutput.Result.EncryptedPayload,
+		Iv:        eOutput.Result.Iv,
+		AAD:       []byte("tenant B"),
+	})
+	assert.ErrorIs(t, err, kms.ErrAuthenticationFailed)
+}
+
+func TestSetKeyUsage(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+	keyID := server.CreateKey("vault", KeyAES)
+
+	encrypt := func() error {
+		_, err := client.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+		return err
+	}
+
+	require.True(t, server.SetKeyUsage("vault", keyID, true, false, true))
+	assert.Error(t, encrypt(), "the key should not be usable for encryption")
+
+	require.True(t, server.SetKeyUsage("vault", keyID, true, true, true))
+	assert.NoError(t, encrypt())
+
+	assert.False(t, server.SetKeyUsage("vault", "unknown", true, true, true))
+
+	// The flags may change while requests are served (run with -race)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				server.SetKeyUsage("vault", keyID, true, i%2 == 0, true)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		encrypt()
+	}
+	close(stop)
+	<-done
+}
+
+func TestImportAndGetKeyId(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+
+	iOutput, err := client.Import(&kms.ImportInput{VaultID: "vault", Payload: make([]byte, 32)})
+	require.NoError(t, err)
+	assert.Equal(t, "DC95C0", iOutput.Result.KCV)
+
+	kOutput, err := client.GetKeyId(&kms.GetKeyIdInput{ExternalID: iOutput.Result.KeyID})
+	require.NoError(t, err)
+	assert.Equal(t, kms.KeyTypeAES, kOutput.Result.Key.Type)
+	assert.Equal(t, 256, kOutput.Result.Key.Size)
+	assert.Equal(t, "vault", kOutput.Result.Key.VaultId)
+}
+
+func TestReEncryptAndBatch(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+	oldKey := server.CreateKey("vault", KeyRSA)
+	newKey := server.CreateKey("vault", KeyAES)
+
+	inputs := []*kms.EncryptInput{
+		{KeyID: oldKey, VaultID: "vault", Payload: []byte("first")},
+		{KeyID: oldKey, VaultID: "other vault", Payload: []byte("second")},
+		{KeyID: oldKey, VaultID: "vault", Payload: []byte("third")},
+	}
+
+	eOutput, err := client.EncryptBatch(context.Background(), &kms.EncryptBatchInput{Inputs: inputs})
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.Calls(EncryptBatchRoute))
+	assert.Error(t, eOutput.Results[1].Err, "the key is not in the vault")
+
+	rOutput, err := client.ReEncrypt(&kms.ReEncryptInput{
+		SourceKeyID:        oldKey,
+		SourceVaultID:      "vault",
+		DestinationKeyID:   newKey,
+		DestinationVaultID: "vault",
+		Payload:            eOutput.Results[2].Output.Result.EncryptedPayload,
+	})
+	require.NoError(t, err)
+
+	dOutput, err := client.Decrypt(&kms.DecryptInput{
+		KeyID:   newKey,
+		VaultID: "vault",
+		Payload: rOutput.Result.EncryptedPayload,
+		Iv:      rOutput.Result.Iv,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("third"), dOutput.Result.Payload)
+}
+
+func TestTenantAndContext(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+	keyID := server.CreateKey("vault", KeyAES)
+
+	// Wrong application ID in the mandatory context
+	client.Config.Credentials.AppID = "someone else"
+	_, err := client.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.Error(t, err)
+
+	// Wrong tenant
+	client = newTestClient(t, server)
+	client.Config.Credentials.TenantID = 2
+	_, err = client.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.Error(t, err)
+
+	// Missing token
+	client = newTestClient(t, server)
+	client.Config.HTTPClient = http.DefaultClient
+	_, err = client.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")})
+	assert.Contains(t, err.Error(), "status 401")
+}
+
+func TestFaultsAndLatency(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	client := newTestClient(t, server)
+	keyID := server.CreateKey("vault", KeyAES)
+	input := func() *kms.EncryptInput {
+		return &kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte("Lorem ipsum")}
+	}
+
+	server.InjectFault(EncryptRoute, Fault{StatusCode: http.StatusServiceUnavailable, Body: `{"success":false}`, Count: 1})
+
+	_, err := client.Encrypt(input())
+	assert.Contains(t, err.Error(), "status 503")
+
+	_, err = client.Encrypt(input())
+	assert.NoError(t, err, "the fault should affect one request only")
+
+	server.SetLatency(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = client.EncryptWithContext(ctx, input())
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+}
+
+func TestTokenFault(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+
+	server.InjectFault(TokenPath, Fault{StatusCode: http.StatusBadRequest, Body: `{"error":"invalid_grant"}`})
+
+	_, err := kms.NewClientWithLogger(server.Credentials(), server.Endpoints(), silentLogger{})
+	assert.Error(t, err)
+
+	creds := server.Credentials()
+	creds.Password = "wrong"
+	server.ClearFaults()
+	_, err = kms.NewClientWithLogger(creds, server.Endpoints(), silentLogger{})
+	assert.Error(t, err)
+}
+
+func TestIssuedTokensVerify(t *testing.T) {
+
+	server := NewServer(&Config{TokenLifetime: time.Minute})
+	defer server.Close()
+
+	ctx := context.Background()
+
+	provider, err := oidc.NewProvider(ctx, server.URL)
+	require.NoError(t, err)
+
+	config := &oauth2.Config{
+		ClientID:     server.Config().ClientID,
+		ClientSecret: server.Config().ClientSecret,
+		Endpoint:     provider.Endpoint(),
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: tenantTransport{server}})
+	token, err := config.PasswordCredentialsToken(ctx, server.Config().UserName, server.Config().Password)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), token.Expiry, 5*time.Second)
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.ClientID}).Verify(ctx, rawIDToken)
+	require.NoError(t, err)
+	assert.Equal(t, server.Config().UserName, idToken.Subject)
+
+	_, err = provider.Verifier(&oidc.Config{ClientID: config.ClientID}).Verify(ctx, token.AccessToken)
+	assert.NoError(t, err, "the access token is a JWT signed by the issuer")
+}
+
+func TestRefreshTokens(t *testing.T) {
+
+	server := NewServer(nil)
+	defer server.Close()
+	server.SetTokenOptions(TokenOptions{RefreshTokens: true})
+
+	config := &oauth2.Config{
+		ClientID:     server.Config().ClientID,
+		ClientSecret: server.Config().ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: server.URL + TokenPath},
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: tenantTransport{server}})
+	token, err := config.PasswordCredentialsToken(ctx, server.Config().UserName, server.Config().Password)
+	require.NoError(t, err)
+	require.NotEmpty(t, token.RefreshToken)
+
+	refresh := func(refreshToken string) (*oauth2.Token, error) {
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	}
+
+	refreshed, err := refresh(token.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, token.AccessToken, refreshed.AccessToken)
+	assert.NotEqual(t, token.RefreshToken, refreshed.RefreshToken)
+
+	_, err = refresh(token.RefreshToken)
+	assert.Error(t, err, "refresh tokens are single use")
+}
+
+// tenantTransport adds the tenant header, as done by the SDK
+type tenantTransport struct {
+	server *Server
+}
+
+func (t tenantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set(t.server.Config().HeaderTenantID, t.server.tenantID())
+	return http.DefaultTransport.RoundTrip(req)
+}
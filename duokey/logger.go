@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,41 @@ type Logger interface {
 	Infof(string, ...interface{})
 }
 
+// LeveledLogger is a structured logging interface: keysAndValues alternate
+// keys (strings) and values, as in slog and Zap (Infow, ...). *slog.Logger
+// implements this interface (see also NewSlogLogger).
+type LeveledLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Level is the severity of a log message
+type Level int
+
+// Levels of the log messages
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
 func LogExecutionTime(logger Logger, msg string, start time.Time) {
 	logger.Infof("%s: %s", msg, time.Since(start))
 }
@@ -37,3 +73,94 @@ func NewDefaultLogger() Logger {
 		logger: log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile),
 	}
 }
+
+// leveledLogger writes the messages of level or above to a Logger
+type leveledLogger struct {
+	logger Logger
+	level  Level
+}
+
+// NewLeveledLogger returns a LeveledLogger writing the messages of level or
+// above to logger, as text lines: "WARN message key=value ...". The level is
+// omitted for the info messages.
+func NewLeveledLogger(logger Logger, level Level) LeveledLogger {
+	return &leveledLogger{logger: logger, level: level}
+}
+
+func (l *leveledLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *leveledLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *leveledLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *leveledLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *leveledLogger) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	if level != LevelInfo {
+		b.WriteString(level.String())
+		b.WriteByte(' ')
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], formatValue(keysAndValues[i+1]))
+	}
+
+	l.logger.Info(b.String())
+}
+
+// formatValue quotes the values containing spaces
+func formatValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// silentLogger discards the messages
+type silentLogger struct{}
+
+func (silentLogger) Debug(string, ...interface{}) {}
+func (silentLogger) Info(string, ...interface{})  {}
+func (silentLogger) Warn(string, ...interface{})  {}
+func (silentLogger) Error(string, ...interface{}) {}
+
+// NewSilentLogger returns a LeveledLogger discarding all the messages
+func NewSilentLogger() LeveledLogger {
+	return silentLogger{}
+}
+
+// LoggerFor returns the logger of the SDK for config: LeveledLogger if set,
+// Logger otherwise (at LevelInfo, or LevelDebug if the wire log is enabled),
+// or the default logger. Secrets are redacted from the messages (see Redact).
+func LoggerFor(config Config) LeveledLogger {
+	level := LevelInfo
+	if config.WireLog.Enabled {
+		level = LevelDebug
+	}
+
+	switch {
+	case config.LeveledLogger != nil:
+		return Redact(config.LeveledLogger)
+	case config.Logger != nil:
+		return Redact(NewLeveledLogger(config.Logger, level))
+	}
+	return Redact(NewLeveledLogger(NewDefaultLogger(), level))
+}
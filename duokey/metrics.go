@@ -0,0 +1,56 @@
+package duokey
+
+import "time"
+
+// Metrics records the activity of a client (see package duokey/duokeyprom for
+// Prometheus). The methods are called concurrently and must not block.
+type Metrics interface {
+	// ObserveRequest is called when an API request completes, once for all
+	// its attempts
+	ObserveRequest(RequestObservation)
+	// ObserveToken is called for each access token acquisition (initial
+	// grant, refresh or renewal)
+	ObserveToken(TokenObservation)
+}
+
+// RequestObservation describes a completed API request. The payloads are
+// never recorded, only their sizes.
+type RequestObservation struct {
+	Operation string
+	TenantID  uint32
+
+	// StatusCode is the HTTP status of the last attempt, 0 if the server
+	// did not reply
+	StatusCode int
+	// ErrorKind classifies the error of the request, empty on success
+	ErrorKind string
+
+	// Duration covers all the attempts, token acquisition included
+	Duration time.Duration
+	Retries  int
+
+	RequestSize  int   // Size of the serialized request body
+	ResponseSize int64 // Size of the response body, -1 if unknown
+}
+
+// TokenObservation describes an access token acquisition
+type TokenObservation struct {
+	TenantID  uint32
+	GrantType string
+	ErrorKind string // Empty on success
+	Duration  time.Duration
+}
+
+// Kinds of errors reported to Metrics
+const (
+	ErrorKindCanceled        = "canceled"         // The context was canceled
+	ErrorKindTimeout         = "timeout"          // A deadline or a timeout expired
+	ErrorKindNetwork         = "network"          // The server could not be reached
+	ErrorKindUnauthorized    = "unauthorized"     // The credentials or the token were rejected
+	ErrorKindRateLimited     = "rate_limited"     // Throttled by the server (429) or by the client
+	ErrorKindClient          = "client_error"     // The server replied with another 4xx status
+	ErrorKindServer          = "server_error"     // The server replied with a 5xx status
+	ErrorKindInvalidResponse = "invalid_response" // The response could not be read or validated
+	ErrorKindInvalidRequest  = "invalid_request"  // The request could not be built
+	ErrorKindOther           = "other"
+)
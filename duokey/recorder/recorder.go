@@ -0,0 +1,379 @@
+// Package recorder provides an http.RoundTripper that records the exchanges
+// with a DuoKey server in a cassette file and replays them later, e.g. in a
+// CI environment without network access.
+//
+// Bearer tokens, passwords, client secrets and payloads are redacted before
+// the cassette is written. The redacted values of the JSON bodies remain well
+// formed, so that the replayed responses can be decoded by the SDK: a payload
+// becomes the base64 encoding of Redacted and a JWT becomes an unsigned JWT
+// that only keeps the issuer, the audience and the validity period. Replayed
+// requests are matched on the HTTP method, the route (path and query) and the
+// redacted, normalized body.
+//
+// The recorder is plugged into a client with duokey.TransportConfig.Base:
+//
+//	rec, err := recorder.New("testdata/encrypt.json", recorder.ModeReplay, nil)
+//	config := duokey.Config{Credentials: creds, Transport: duokey.TransportConfig{Base: rec}}
+//	kmsClient, err := kms.NewClientWithConfig(config, endpoints)
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Mode selects between recording and replaying
+type Mode int
+
+const (
+	// ModeRecord forwards the requests to the server and records the exchanges
+	ModeRecord Mode = iota
+	// ModeReplay answers the requests from the cassette without network access
+	ModeReplay
+)
+
+// Redacted replaces the sensitive values in a cassette
+const Redacted = "REDACTED"
+
+// redactedPayload replaces the payloads, which are base64-encoded
+var redactedPayload = base64.StdEncoding.EncodeToString([]byte(Redacted))
+
+// Claims of a JWT kept in a cassette
+var publicClaims = []string{"iss", "aud", "exp", "iat", "nbf"}
+
+// Headers whose values are redacted (canonical form)
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Fields redacted in JSON and form bodies (lower case). The payload fields
+// hold the plaintext of the encrypt requests and decrypt responses.
+var sensitiveFields = map[string]bool{
+	"payload":          true,
+	"password":         true,
+	"client_secret":    true,
+	"clientsecret":     true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"id_token":         true,
+	"client_assertion": true,
+	"subject_token":    true,
+	"actor_token":      true,
+	"assertion":        true,
+}
+
+// Interaction is a recorded request/response pair
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is the redacted form of an HTTP request
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	Route  string      `json:"route"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// RecordedResponse is the redacted form of an HTTP response
+type RecordedResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// Cassette is the content of a cassette file
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Recorder records or replays HTTP exchanges. It is safe for concurrent use.
+type Recorder struct {
+	path      string
+	mode      Mode
+	transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// Ensure that Recorder implements the http.RoundTripper interface
+var _ http.RoundTripper = (*Recorder)(nil)
+
+// New returns a recorder bound to the cassette file path. In replay mode, the
+// cassette is loaded immediately. In record mode, the requests are forwarded
+// to transport (http.DefaultTransport if nil) and the cassette is written by
+// Save.
+func New(path string, mode Mode, transport http.RoundTripper) (*Recorder, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	r := &Recorder{path: path, mode: mode, transport: transport}
+
+	if mode == ModeReplay {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the cassette: %w", err)
+		}
+		if err := json.Unmarshal(data, &r.cassette); err != nil {
+			return nil, fmt.Errorf("failed to decode the cassette: %w", err)
+		}
+		r.used = make([]bool, len(r.cassette.Interactions))
+	}
+
+	return r, nil
+}
+
+// RoundTrip records or replays a request.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := RecordedRequest{
+		Method: req.Method,
+		Route:  route(req.URL),
+		Header: redactHeader(req.Header),
+		Body:   redactBody(req.Header.Get("Content-Type"), body),
+	}
+
+	if r.mode == ModeReplay {
+		return r.replay(req, recorded)
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: recorded,
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     redactHeader(resp.Header),
+			Body:       redactBody(resp.Header.Get("Content-Type"), respBody),
+		},
+	})
+	r.mu.Unlock()
+
+	return resp, nil
+}
+
+// replay returns the first unused interaction matching the request
+func (r *Recorder) replay(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, interaction := range r.cassette.Interactions {
+		if r.used[i] || !matches(interaction.Request, recorded) {
+			continue
+		}
+		r.used[i] = true
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Header.Clone(),
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("recorder: no recorded interaction for %s %s", recorded.Method, recorded.Route)
+}
+
+// Save writes the recorded interactions to the cassette file. It does nothing
+// in replay mode.
+func (r *Recorder) Save() error {
+	if r.mode == ModeReplay {
+		return nil
+	}
+
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a failure does not corrupt an existing cassette
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.path)
+}
+
+// Cassette returns a copy of the recorded (or loaded) interactions.
+func (r *Recorder) Cassette() Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+}
+
+func matches(recorded, req RecordedRequest) bool {
+	return recorded.Method == req.Method && recorded.Route == req.Route && recorded.Body == req.Body
+}
+
+// route returns the path and the sorted query of a URL, without the host so
+// that a cassette can be replayed against any base URL
+func route(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.Query().Encode()
+}
+
+// readBody reads a body and replaces it with an equivalent reader
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+
+	return data, nil
+}
+
+func redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for key, values := range header {
+		if sensitiveHeaders[http.CanonicalHeaderKey(key)] {
+			redacted[key] = []string{Redacted}
+			continue
+		}
+		redacted[key] = append([]string(nil), values...)
+	}
+	return redacted
+}
+
+// redactBody replaces the sensitive fields of a JSON or form body and
+// serializes it in a canonical form (sorted keys, no insignificant
+// whitespace), so that the bodies of equivalent requests are equal. Other
+// bodies are returned unchanged.
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		for key := range values {
+			if sensitiveFields[strings.ToLower(key)] {
+				values[key] = []string{Redacted}
+			}
+		}
+		return values.Encode()
+	}
+
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return string(body)
+	}
+
+	// encoding/json sorts the keys of the maps
+	data, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return string(body)
+	}
+	return string(data)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveFields[strings.ToLower(key)] && value != nil {
+				v[key] = redactedValue(key, value)
+				continue
+			}
+			v[key] = redactValue(value)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// redactedValue returns a well-formed substitute for a sensitive JSON value
+func redactedValue(key string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return Redacted
+	}
+
+	switch {
+	case strings.ToLower(key) == "payload":
+		return redactedPayload
+	case strings.Count(s, ".") == 2:
+		return redactedJWT(s)
+	}
+	return Redacted
+}
+
+// redactedJWT returns an unsigned JWT with the public claims of token
+func redactedJWT(token string) string {
+	claims := map[string]interface{}{"sub": Redacted}
+
+	var original map[string]interface{}
+	if data, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1]); err == nil && json.Unmarshal(data, &original) == nil {
+		for _, claim := range publicClaims {
+			if value, ok := original[claim]; ok {
+				claims[claim] = value
+			}
+		}
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
@@ -0,0 +1,214 @@
+package recorder_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/client"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeytest"
+	"github.com/duokey/duokey-sdk-go/duokey/recorder"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+const plaintext = "Dear Bob, the secret of the pyramids is ..."
+
+// tenantTransport adds the tenant header, as done by the SDK
+type tenantTransport struct {
+	header, value string
+	base          http.RoundTripper
+}
+
+func (t *tenantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set(t.header, t.value)
+	return t.base.RoundTrip(req)
+}
+
+// session obtains a token and encrypts and decrypts a payload through rec
+func session(t *testing.T, server *duokeytest.Server, rec *recorder.Recorder, keyID string) (*kms.EncryptOutput, *kms.DecryptOutput) {
+	creds := server.Credentials()
+	base := &tenantTransport{header: creds.HeaderTenantID, value: fmt.Sprint(creds.TenantID), base: rec}
+
+	oauth2Config := oauth2.Config{
+		ClientID:     creds.ClientID,
+		ClientSecret: creds.ClientSecret,
+		Scopes:       []string{creds.Scope},
+		Endpoint:     oauth2.Endpoint{TokenURL: creds.Issuer + duokeytest.TokenPath, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base})
+	token, err := oauth2Config.PasswordCredentialsToken(ctx, creds.UserName, creds.Password)
+	require.NoError(t, err)
+
+	httpClient := &http.Client{Transport: &oauth2.Transport{Source: oauth2.StaticTokenSource(token), Base: base}}
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{
+		Endpoints: &endpoints,
+		Client:    &client.Client{Config: duokey.Config{Credentials: creds, HTTPClient: httpClient}},
+	}
+
+	eOutput, err := kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte(plaintext)})
+	require.NoError(t, err)
+
+	dOutput, err := kmsClient.Decrypt(&kms.DecryptInput{
+		KeyID:     keyID,
+		VaultID:   "vault",
+		Algorithm: eOutput.Result.Algorithm,
+		Payload:   eOutput.Result.EncryptedPayload,
+		Iv:        eOutput.Result.Iv,
+	})
+	require.NoError(t, err)
+
+	return eOutput, dOutput
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	server := duokeytest.NewServer(&duokeytest.Config{AppID: "recorder"})
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	// Record
+	rec, err := recorder.New(path, recorder.ModeRecord, nil)
+	require.NoError(t, err)
+
+	recordedEncrypt, recordedDecrypt := session(t, server, rec, keyID)
+	assert.Equal(t, plaintext, string(recordedDecrypt.Result.Payload))
+	require.NoError(t, rec.Save())
+	assert.Len(t, rec.Cassette().Interactions, 3)
+
+	// The secrets and the plaintext are not in the cassette
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	for _, secret := range []string{plaintext, base64.StdEncoding.EncodeToString([]byte(plaintext)), duokeytest.DefaultPassword, duokeytest.DefaultClientSecret, "Bearer ey"} {
+		assert.NotContains(t, string(data), secret)
+	}
+	assert.Contains(t, string(data), recorder.Redacted)
+
+	// Replay without server
+	server.Close()
+
+	rec, err = recorder.New(path, recorder.ModeReplay, nil)
+	require.NoError(t, err)
+
+	replayedEncrypt, replayedDecrypt := session(t, server, rec, keyID)
+	assert.Equal(t, recordedEncrypt.Result.EncryptedPayload, replayedEncrypt.Result.EncryptedPayload)
+	assert.Equal(t, recordedEncrypt.Result.Iv, replayedEncrypt.Result.Iv)
+	assert.True(t, replayedDecrypt.Success)
+	assert.Equal(t, recorder.Redacted, string(replayedDecrypt.Result.Payload), "the redacted payload should be well formed")
+
+	// Every interaction was consumed
+	_, err = rec.RoundTrip(mustRequest(t, http.MethodPost, server.URL+duokeytest.TokenPath))
+	assert.Error(t, err)
+}
+
+func TestRecordAndReplayWithClient(t *testing.T) {
+	server := duokeytest.NewServer(&duokeytest.Config{AppID: "recorder-client"})
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	encryptDecrypt := func(rec *recorder.Recorder) (*kms.EncryptOutput, *kms.DecryptOutput) {
+		config := duokey.Config{
+			Credentials:   server.Credentials(),
+			LeveledLogger: duokey.NewSilentLogger(),
+			Transport:     duokey.TransportConfig{Base: rec},
+		}
+		kmsClient, err := kms.NewClientWithConfig(config, server.Endpoints())
+		require.NoError(t, err)
+		defer kmsClient.Client.Close()
+
+		eOutput, err := kmsClient.Encrypt(&kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte(plaintext)})
+		require.NoError(t, err)
+
+		dOutput, err := kmsClient.Decrypt(&kms.DecryptInput{
+			KeyID:     keyID,
+			VaultID:   "vault",
+			Algorithm: eOutput.Result.Algorithm,
+			Payload:   eOutput.Result.EncryptedPayload,
+			Iv:        eOutput.Result.Iv,
+		})
+		require.NoError(t, err)
+
+		return eOutput, dOutput
+	}
+
+	rec, err := recorder.New(path, recorder.ModeRecord, nil)
+	require.NoError(t, err)
+
+	recordedEncrypt, recordedDecrypt := encryptDecrypt(rec)
+	assert.Equal(t, plaintext, string(recordedDecrypt.Result.Payload))
+	require.NoError(t, rec.Save())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	for _, secret := range []string{plaintext, base64.StdEncoding.EncodeToString([]byte(plaintext)), duokeytest.DefaultPassword} {
+		assert.NotContains(t, string(data), secret)
+	}
+
+	// Replay without server: the redacted token is accepted by the client
+	server.Close()
+
+	rec, err = recorder.New(path, recorder.ModeReplay, nil)
+	require.NoError(t, err)
+
+	replayedEncrypt, replayedDecrypt := encryptDecrypt(rec)
+	assert.Equal(t, recordedEncrypt.Result.EncryptedPayload, replayedEncrypt.Result.EncryptedPayload)
+	assert.Equal(t, recorder.Redacted, string(replayedDecrypt.Result.Payload))
+}
+
+func TestReplayMatching(t *testing.T) {
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	rec, err := recorder.New(path, recorder.ModeRecord, nil)
+	require.NoError(t, err)
+
+	resp, err := rec.RoundTrip(mustRequest(t, http.MethodGet, server.URL+duokeytest.DiscoveryPath+"?b=2&a=1"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, rec.Save())
+
+	rec, err = recorder.New(path, recorder.ModeReplay, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		method  string
+		url     string
+		wantErr bool
+	}{
+		{name: "Other method", method: http.MethodPost, url: "http://localhost" + duokeytest.DiscoveryPath + "?a=1&b=2", wantErr: true},
+		{name: "Other route", method: http.MethodGet, url: "http://localhost" + duokeytest.JWKSPath, wantErr: true},
+		{name: "Other host, reordered query", method: http.MethodGet, url: "http://localhost" + duokeytest.DiscoveryPath + "?a=1&b=2", wantErr: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := rec.RoundTrip(mustRequest(t, tc.method, tc.url))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	require.NoError(t, err)
+	return req
+}
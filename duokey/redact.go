@@ -0,0 +1,179 @@
+package duokey
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the secrets in the log messages
+const Redacted = "[REDACTED]"
+
+// secretKeys and payloadKeys are the (normalized) keys whose values are not
+// logged
+var (
+	secretKeys = map[string]bool{
+		"authorization":   true,
+		"password":        true,
+		"secret":          true,
+		"clientsecret":    true,
+		"token":           true,
+		"accesstoken":     true,
+		"refreshtoken":    true,
+		"idtoken":         true,
+		"subjecttoken":    true,
+		"clientassertion": true,
+	}
+	payloadKeys = map[string]bool{
+		"payload":          true,
+		"encryptedpayload": true,
+		"plaintext":        true,
+	}
+)
+
+// secretHeaders are the headers whose values are not logged
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Patterns of the secrets and payloads embedded in strings: bearer tokens,
+// JSON fields and form or query parameters
+var (
+	bearerPattern      = regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9\-._~+/]+=*`)
+	jsonSecretPattern  = regexp.MustCompile(`(?i)("(?:password|client_?secret|access_?token|refresh_?token|id_?token|subject_?token|client_?assertion)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	jsonPayloadPattern = regexp.MustCompile(`(?i)("(?:payload|encrypted_?payload|plaintext)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	formPattern        = regexp.MustCompile(`(?i)\b((?:password|client_secret|access_token|refresh_token|id_token|subject_token|client_assertion)=)[^&\s"]*`)
+)
+
+// RedactOptions relaxes the redaction, e.g. to debug in a local sandbox
+type RedactOptions struct {
+	ShowPayloads bool // Show the payloads (payload, encryptedPayload, ...)
+	ShowSecrets  bool // Show the passwords, client secrets, tokens and Authorization headers
+}
+
+// redactingLogger redacts the messages before passing them to logger
+type redactingLogger struct {
+	logger  LeveledLogger
+	options RedactOptions
+}
+
+// Redact returns a LeveledLogger removing the secrets from the messages
+// passed to logger: the values of the sensitive keys (authorization, password,
+// client_secret, tokens, payload, ...) and the bearer tokens, passwords, client
+// secrets and payloads found in the messages and in the string, error and
+// http.Header values. Byte slices are never logged.
+func Redact(logger LeveledLogger) LeveledLogger {
+	return RedactWith(logger, RedactOptions{})
+}
+
+// RedactWith is like Redact with options. If logger is already redacting, its
+// options are replaced.
+func RedactWith(logger LeveledLogger, options RedactOptions) LeveledLogger {
+	if r, ok := logger.(*redactingLogger); ok {
+		if r.options == options {
+			return r
+		}
+		logger = r.logger
+	}
+	return &redactingLogger{logger: logger, options: options}
+}
+
+func (r *redactingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	r.logger.Debug(r.redactString(msg), r.redactKeysAndValues(keysAndValues)...)
+}
+
+func (r *redactingLogger) Info(msg string, keysAndValues ...interface{}) {
+	r.logger.Info(r.redactString(msg), r.redactKeysAndValues(keysAndValues)...)
+}
+
+func (r *redactingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	r.logger.Warn(r.redactString(msg), r.redactKeysAndValues(keysAndValues)...)
+}
+
+func (r *redactingLogger) Error(msg string, keysAndValues ...interface{}) {
+	r.logger.Error(r.redactString(msg), r.redactKeysAndValues(keysAndValues)...)
+}
+
+// RedactString replaces the bearer tokens, passwords, client secrets and
+// payloads found in s
+func RedactString(s string) string {
+	return redactString(s, RedactOptions{})
+}
+
+func (r *redactingLogger) redactString(s string) string {
+	return redactString(s, r.options)
+}
+
+func redactString(s string, options RedactOptions) string {
+	if !options.ShowSecrets {
+		s = bearerPattern.ReplaceAllString(s, "${1}"+Redacted)
+		s = jsonSecretPattern.ReplaceAllString(s, `${1}"`+Redacted+`"`)
+		s = formPattern.ReplaceAllString(s, "${1}"+Redacted)
+	}
+	if !options.ShowPayloads {
+		s = jsonPayloadPattern.ReplaceAllString(s, `${1}"`+Redacted+`"`)
+	}
+	return s
+}
+
+// SensitiveKey reports whether the values of key must not be logged. The case,
+// dashes and underscores are ignored.
+func SensitiveKey(key string) bool {
+	key = normalizeKey(key)
+	return secretKeys[key] || payloadKeys[key]
+}
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+}
+
+func (r *redactingLogger) redactKeysAndValues(keysAndValues []interface{}) []interface{} {
+	redacted := make([]interface{}, len(keysAndValues))
+	for i := 0; i < len(keysAndValues); i += 2 {
+		redacted[i] = keysAndValues[i]
+		if i+1 == len(keysAndValues) {
+			break
+		}
+
+		if key, ok := keysAndValues[i].(string); ok {
+			key = normalizeKey(key)
+			if (secretKeys[key] && !r.options.ShowSecrets) || (payloadKeys[key] && !r.options.ShowPayloads) {
+				redacted[i+1] = Redacted
+				continue
+			}
+		}
+		redacted[i+1] = r.redactValue(keysAndValues[i+1])
+	}
+	return redacted
+}
+
+func (r *redactingLogger) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case error:
+		return r.redactString(v.Error())
+	case http.Header:
+		return r.redactHeader(v)
+	case []byte:
+		return Redacted
+	}
+	return value
+}
+
+// redactHeader returns a copy of header without the credentials
+func (r *redactingLogger) redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for key, values := range header {
+		for i := range values {
+			values[i] = r.redactString(values[i])
+		}
+		header[key] = values
+	}
+	if !r.options.ShowSecrets {
+		for _, key := range secretHeaders {
+			if header.Get(key) != "" {
+				header.Set(key, Redacted)
+			}
+		}
+	}
+	return header
+}
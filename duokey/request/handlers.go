@@ -0,0 +1,231 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
+	"github.com/pkg/errors"
+	"gopkg.in/validator.v2"
+)
+
+// Handlers are the phases of a request, run in this order by Send:
+//
+//   - Build serializes the parameters into Body
+//   - Sign authenticates the request (the access token itself is added by the
+//     HTTP client)
+//   - Send makes the HTTP request and sets HTTPResponse
+//   - Unmarshal reads HTTPResponse into Response
+//   - Validate checks Response
+//   - Retry runs if one of the previous phases failed, and sets Retryable to
+//     send the request again from the Sign phase
+//   - Complete runs last, whatever the outcome
+//
+// Build runs once; Sign to Retry run for each attempt.
+type Handlers struct {
+	Build     HandlerList
+	Sign      HandlerList
+	Send      HandlerList
+	Unmarshal HandlerList
+	Validate  HandlerList
+	Retry     HandlerList
+	Complete  HandlerList
+}
+
+// Default handlers of the phases
+var (
+	BuildJSONBodyHandler    = NamedHandler{Name: "duokey.BuildJSONBody", Fn: buildJSONBody}
+	SendHandler             = NamedHandler{Name: "duokey.Send", Fn: sendRequest}
+	UnmarshalJSONHandler    = NamedHandler{Name: "duokey.UnmarshalJSON", Fn: unmarshalJSON}
+	ValidateResponseHandler = NamedHandler{Name: "duokey.ValidateResponse", Fn: validateResponse}
+	ReauthenticateHandler   = NamedHandler{Name: "duokey.Reauthenticate", Fn: reauthenticate}
+	ZeroSensitiveHandler    = NamedHandler{Name: "duokey.ZeroSensitive", Fn: zeroSensitive}
+)
+
+// DefaultHandlers returns the handlers of the DuoKey API requests
+func DefaultHandlers() Handlers {
+	var h Handlers
+
+	h.Build.PushBackNamed(BuildJSONBodyHandler)
+	h.Send.PushBackNamed(SendHandler)
+	h.Unmarshal.PushBackNamed(UnmarshalJSONHandler)
+	h.Validate.PushBackNamed(ValidateResponseHandler)
+	h.Retry.PushBackNamed(ReauthenticateHandler)
+	h.Complete.PushBackNamed(ZeroSensitiveHandler)
+
+	return h
+}
+
+// Copy returns a copy of h: the lists of the copy can be modified without
+// changing h.
+func (h Handlers) Copy() Handlers {
+	return Handlers{
+		Build:     h.Build.copy(),
+		Sign:      h.Sign.copy(),
+		Send:      h.Send.copy(),
+		Unmarshal: h.Unmarshal.copy(),
+		Validate:  h.Validate.copy(),
+		Retry:     h.Retry.copy(),
+		Complete:  h.Complete.copy(),
+	}
+}
+
+// IsEmpty reports whether no handler is set
+func (h Handlers) IsEmpty() bool {
+	return h.Build.Len()+h.Sign.Len()+h.Send.Len()+h.Unmarshal.Len()+h.Validate.Len()+h.Retry.Len()+h.Complete.Len() == 0
+}
+
+// NamedHandler is a handler identified by its name, which allows to remove or
+// replace it
+type NamedHandler struct {
+	Name string
+	Fn   func(*Request)
+}
+
+// HandlerList is an ordered list of handlers
+type HandlerList struct {
+	list []NamedHandler
+}
+
+func (l HandlerList) copy() HandlerList {
+	return HandlerList{list: append([]NamedHandler(nil), l.list...)}
+}
+
+// Len returns the number of handlers in the list
+func (l *HandlerList) Len() int {
+	return len(l.list)
+}
+
+// Names returns the names of the handlers, in order
+func (l *HandlerList) Names() []string {
+	names := make([]string, len(l.list))
+	for i, h := range l.list {
+		names[i] = h.Name
+	}
+	return names
+}
+
+// PushBack adds an anonymous handler at the end of the list
+func (l *HandlerList) PushBack(fn func(*Request)) {
+	l.PushBackNamed(NamedHandler{Fn: fn})
+}
+
+// PushBackNamed adds h at the end of the list
+func (l *HandlerList) PushBackNamed(h NamedHandler) {
+	l.list = append(l.list, h)
+}
+
+// PushFront adds an anonymous handler at the beginning of the list
+func (l *HandlerList) PushFront(fn func(*Request)) {
+	l.PushFrontNamed(NamedHandler{Fn: fn})
+}
+
+// PushFrontNamed adds h at the beginning of the list
+func (l *HandlerList) PushFrontNamed(h NamedHandler) {
+	l.list = append([]NamedHandler{h}, l.list...)
+}
+
+// RemoveByName removes the handlers named name
+func (l *HandlerList) RemoveByName(name string) {
+	var list []NamedHandler
+	for _, h := range l.list {
+		if h.Name != name {
+			list = append(list, h)
+		}
+	}
+	l.list = list
+}
+
+// SwapNamed replaces the handlers named h.Name with h. It reports whether a
+// handler was replaced.
+func (l *HandlerList) SwapNamed(h NamedHandler) bool {
+	swapped := false
+	for i := range l.list {
+		if l.list[i].Name == h.Name {
+			l.list[i] = h
+			swapped = true
+		}
+	}
+	return swapped
+}
+
+// Clear removes all the handlers
+func (l *HandlerList) Clear() {
+	l.list = nil
+}
+
+// Run calls the handlers in order. If a handler sets r.Error while it was
+// nil, the next handlers are skipped.
+func (l *HandlerList) Run(r *Request) {
+	failed := r.Error != nil
+	for _, h := range l.list {
+		h.Fn(r)
+		if !failed && r.Error != nil {
+			return
+		}
+	}
+}
+
+// buildJSONBody serializes the parameters
+func buildJSONBody(r *Request) {
+	if r.Parameters == nil {
+		return
+	}
+
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(r.Parameters); err != nil {
+		r.Error = errors.Wrap(err, "failed to serialize request body")
+		return
+	}
+	r.Body = body.Bytes()
+}
+
+// sendRequest makes the HTTP request with the body
+func sendRequest(r *Request) {
+	r.HTTPRequest.Body = ioutil.NopCloser(bytes.NewReader(r.Body))
+	r.HTTPRequest.ContentLength = int64(len(r.Body))
+
+	var err error
+	if r.HTTPResponse, err = r.HTTPClient.Do(r.HTTPRequest); err != nil {
+		r.Error = errors.Wrap(err, "failed to make HTTP request")
+	}
+}
+
+// unmarshalJSON parses the response
+func unmarshalJSON(r *Request) {
+	if err := parseHTTPResponse(r.HTTPResponse, r.Response, r.Sensitive); err != nil {
+		r.Error = err
+	}
+}
+
+// validateResponse validates the payload returned by the server (useful to
+// detect problems on the server side)
+func validateResponse(r *Request) {
+	if err := validator.Validate(r.Response); err != nil {
+		r.Error = errors.Wrap(err, "server error")
+	}
+}
+
+// reauthenticate obtains a new access token and retries the request once if
+// the server rejected the token (status 401 or "unAuthorizedRequest": true)
+func reauthenticate(r *Request) {
+	var errResp *ErrorResponse
+	if r.Authenticator == nil || r.reauthenticated || !errors.As(r.Error, &errResp) || !errResp.Unauthorized() {
+		return
+	}
+
+	r.reauthenticated = true
+	if err := r.Authenticator.Reauthenticate(r.HTTPRequest.Context(), r.AttemptTime); err != nil {
+		r.Error = errors.Wrap(err, "failed to renew the access token")
+		return
+	}
+	r.Retryable = true
+}
+
+// zeroSensitive zeroes the serialized body of sensitive requests
+func zeroSensitive(r *Request) {
+	if r.Sensitive {
+		sensitive.Zero(r.Body)
+	}
+}
@@ -0,0 +1,129 @@
+package request_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerList(t *testing.T) {
+
+	var l request.HandlerList
+	noop := func(*request.Request) {}
+
+	l.PushBackNamed(request.NamedHandler{Name: "b", Fn: noop})
+	l.PushBackNamed(request.NamedHandler{Name: "c", Fn: noop})
+	l.PushFrontNamed(request.NamedHandler{Name: "a", Fn: noop})
+	assert.Equal(t, []string{"a", "b", "c"}, l.Names())
+
+	assert.True(t, l.SwapNamed(request.NamedHandler{Name: "b", Fn: noop}))
+	assert.False(t, l.SwapNamed(request.NamedHandler{Name: "d", Fn: noop}))
+
+	l.RemoveByName("b")
+	assert.Equal(t, []string{"a", "c"}, l.Names())
+
+	// The lists of a copy are independent
+	h := request.Handlers{Send: l}
+	c := h.Copy()
+	c.Send.Clear()
+	assert.Equal(t, 2, h.Send.Len())
+	assert.True(t, c.IsEmpty())
+	assert.False(t, request.DefaultHandlers().IsEmpty())
+}
+
+func TestSendPhases(t *testing.T) {
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name      string
+		setup     func(*request.Handlers)
+		wantPath  []string
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "Default handlers",
+			wantPath:  []string{"Sign", "Retry", "Complete"},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{name: "Retry on unavailability",
+			setup: func(h *request.Handlers) {
+				h.Retry.PushBack(func(r *request.Request) {
+					var errResp *request.ErrorResponse
+					if errors.As(r.Error, &errResp) && errResp.StatusCode == http.StatusServiceUnavailable && r.RetryCount < 1 {
+						r.Retryable = true
+					}
+				})
+			},
+			wantPath:  []string{"Sign", "Retry", "Sign", "Complete"},
+			wantCalls: 2,
+		},
+		{name: "Build failure",
+			setup: func(h *request.Handlers) {
+				h.Build.PushFront(func(r *request.Request) { r.Error = errors.New("custom serialization failed") })
+			},
+			wantPath: []string{"Complete"},
+			wantErr:  true,
+		},
+		{name: "Replaced send",
+			setup: func(h *request.Handlers) {
+				h.Send.SwapNamed(request.NamedHandler{Name: request.SendHandler.Name, Fn: func(r *request.Request) {
+					r.Error = errors.New("injected fault")
+				}})
+			},
+			wantPath: []string{"Sign", "Retry", "Complete"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+
+			config := duokey.Config{
+				Credentials: credentials.Config{HeaderTenantID: "Abp.TenantId", TenantID: 1},
+				HTTPClient:  server.Client(),
+			}
+			op := &request.Operation{Name: "Test", HTTPMethod: http.MethodPost, BaseURL: server.URL, Route: "/test"}
+			req := request.New(config, op, nil, &struct{ Success bool }{})
+
+			var path []string
+			record := func(phase string) func(*request.Request) {
+				return func(*request.Request) { path = append(path, phase) }
+			}
+			if tc.setup != nil {
+				tc.setup(&req.Handlers)
+			}
+			req.Handlers.Sign.PushBack(record("Sign"))
+			req.Handlers.Retry.PushFront(record("Retry"))
+			req.Handlers.Complete.PushBack(record("Complete"))
+
+			err := req.Send()
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantPath, path)
+			assert.Equal(t, tc.wantCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
 	"github.com/pkg/errors"
 	"gopkg.in/validator.v2"
 )
@@ -23,6 +25,26 @@ type Request struct {
 	Error        error
 	Parameters   interface{} // Parameters needed to build the request body
 	Response     interface{} // Stores the deserialized response
+
+	// Sensitive requests have their serialized request and response bodies
+	// zeroed once they have been processed (best effort: copies made by the
+	// HTTP stack are out of reach).
+	Sensitive bool
+
+	// Authenticator renews the access token when the server rejects it (see
+	// ReauthenticateHandler)
+	Authenticator duokey.Authenticator
+
+	Operation *Operation
+	Handlers  Handlers
+
+	Body        []byte    // Serialized parameters, set by the Build handlers
+	SendTime    time.Time // Time Send was called
+	AttemptTime time.Time // Time the current attempt started
+	RetryCount  int       // Number of attempts made before the current one
+	Retryable   bool      // Set by the Retry handlers to send the request again
+
+	reauthenticated bool
 }
 
 // Operation (GET, POST, etc.). The URL of the endpoint is given by baseURL + Route.
@@ -34,6 +56,20 @@ type Operation struct {
 	QueryParams string
 }
 
+// KeyDescriber is implemented by the parameters of the operations on a key.
+// The description is read by the instrumentation (traces, metrics) and must
+// not contain sensitive data.
+type KeyDescriber interface {
+	DescribeKey() KeyDescription
+}
+
+// KeyDescription identifies the key used by a request
+type KeyDescription struct {
+	KeyID     string
+	VaultID   string
+	Algorithm string
+}
+
 // New returns a pointer to a request.
 // params contains the input parameters needed to build the request body.
 // response is pointer value to an object which the request's response
@@ -47,6 +83,7 @@ func New(config duokey.Config, operation *Operation, params interface{}, respons
 
 	if operation == nil {
 		err = fmt.Errorf("operation not defined")
+		operation = &Operation{}
 		goto buildrequest
 	}
 
@@ -84,54 +121,96 @@ func New(config duokey.Config, operation *Operation, params interface{}, respons
 buildrequest:
 
 	return &Request{
-		HTTPClient:  config.HTTPClient,
-		HTTPRequest: httpReq,
-		Error:       err,
-		Parameters:  params,
-		Response:    response,
+		HTTPClient:    config.HTTPClient,
+		HTTPRequest:   httpReq,
+		Error:         err,
+		Parameters:    params,
+		Response:      response,
+		Authenticator: config.Authenticator,
+		Operation:     operation,
+		Handlers:      DefaultHandlers(),
 	}
 }
 
 // Send transmits the request to a DuoKey server and returns an error if an
 // unexpected issue is encountered. The deserialized response can be found in
-// r.Data.
+// r.Response. The phases of r.Handlers are run in order (see Handlers); with
+// the default handlers, if the server rejects the access token (status 401 or
+// "unAuthorizedRequest": true) and r.Authenticator is set, a new token is
+// obtained and the request is sent once more. A request rejected by New (e.g.
+// invalid parameters) only runs the Complete phase, so that it is traced and
+// counted.
 func (r *Request) Send() error {
 
+	r.SendTime = time.Now()
+
 	if r.Error != nil {
-		return errors.Wrap(r.Error, "bad request")
+		r.Error = errors.Wrap(r.Error, "bad request")
+		r.Handlers.Complete.Run(r)
+		return r.Error
 	}
 
-	body := &bytes.Buffer{}
-	if r.Parameters != nil {
-		if err := json.NewEncoder(body).Encode(r.Parameters); err != nil {
-			return errors.Wrap(err, "failed to serialize request body")
+	r.Handlers.Build.Run(r)
+
+	for r.Error == nil {
+		r.AttemptTime = time.Now()
+		r.Retryable = false
+
+		r.Handlers.Sign.Run(r)
+		if r.Error == nil {
+			r.Handlers.Send.Run(r)
+		}
+		if r.Error == nil {
+			r.Handlers.Unmarshal.Run(r)
+		}
+		if r.Error == nil {
+			r.Handlers.Validate.Run(r)
+		}
+		if r.Error == nil {
+			break
+		}
+
+		r.Handlers.Retry.Run(r)
+		if !r.Retryable {
+			break
 		}
+
+		r.RetryCount++
+		r.Error = nil
+		r.HTTPResponse = nil
 	}
 
-	r.HTTPRequest.Body = ioutil.NopCloser(body)
+	r.Handlers.Complete.Run(r)
 
-	var err error
+	return r.Error
+}
 
-	if r.HTTPResponse, err = r.HTTPClient.Do(r.HTTPRequest); err != nil {
-		r.Error = err
-		return errors.Wrap(err, "failed to make HTTP request")
-	}
+// ErrorResponse is returned by Send when the DuoKey server replies with an
+// error status. The body is kept to let services interpret the error.
+type ErrorResponse struct {
+	StatusCode int
+	Body       []byte
+}
 
-	if err = parseHTTPResponse(r.HTTPResponse, r.Response); err != nil {
-		r.Error = err
-		return err
-	}
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, string(e.Body))
+}
 
-	// Validate the payload returned by the server (usefule to detect problems on the server side)
-	if err := validator.Validate(r.Response); err != nil {
-		r.Error = err
-		return errors.Wrap(err, "server error")
-	}
+// Unauthorized reports whether the server rejected the access token
+func (e *ErrorResponse) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || unauthorizedEnvelope(e.Body)
+}
 
-	return nil
+// unauthorizedEnvelope reports whether payload is an ABP envelope with
+// "unAuthorizedRequest": true
+func unauthorizedEnvelope(payload []byte) bool {
+	var envelope struct {
+		UnauthorizedRequest bool `json:"unAuthorizedRequest"`
+	}
+	return json.Unmarshal(payload, &envelope) == nil && envelope.UnauthorizedRequest
 }
 
-func parseHTTPResponse(resp *http.Response, response interface{}) error {
+func parseHTTPResponse(resp *http.Response, response interface{}, zeroPayload bool) error {
 	defer resp.Body.Close()
 
 	var payload []byte
@@ -141,8 +220,17 @@ func parseHTTPResponse(resp *http.Response, response interface{}) error {
 		return errors.Wrap(err, "failed to read response body")
 	}
 
+	if zeroPayload && resp.StatusCode < http.StatusMultipleChoices {
+		defer sensitive.Zero(payload)
+	}
+
 	if resp.StatusCode >= http.StatusMultipleChoices {
-		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(payload))
+		return &ErrorResponse{StatusCode: resp.StatusCode, Body: payload}
+	}
+
+	// Some deployments reject the token with a success status
+	if unauthorizedEnvelope(payload) {
+		return &ErrorResponse{StatusCode: resp.StatusCode, Body: append([]byte{}, payload...)}
 	}
 
 	if response != nil {
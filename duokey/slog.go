@@ -0,0 +1,16 @@
+//go:build go1.21
+
+package duokey
+
+import "log/slog"
+
+// NewSlogLogger returns a LeveledLogger writing to logger (slog.Default() if
+// nil). Set it as Config.LeveledLogger:
+//
+//	config.LeveledLogger = duokey.NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+func NewSlogLogger(logger *slog.Logger) LeveledLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,31 @@
+//go:build go1.21
+
+package duokey_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+
+	logger := duokey.LoggerFor(duokey.Config{LeveledLogger: duokey.NewSlogLogger(slog.New(handler))})
+	logger.Debug("token request", "status", 200, "client_secret", "s3cr3t")
+
+	assert.Equal(t, "level=DEBUG msg=\"token request\" status=200 client_secret=[REDACTED]\n", buf.String())
+}
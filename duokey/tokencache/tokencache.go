@@ -0,0 +1,271 @@
+// Package tokencache stores access tokens in files so that short-lived
+// processes (e.g. CLI tools) reuse a valid token instead of running the OIDC
+// discovery and the password grant on every start.
+//
+//	cache, err := tokencache.New(tokencache.Options{Key: key})
+//	client, err := kms.NewClientWithConfig(duokey.Config{Credentials: creds, TokenCache: cache}, endpoints)
+//
+// Each token is stored in its own file, encrypted with AES-256-GCM. The key is
+// never stored by the cache: take it from an OS keyring or a secret manager,
+// so that reading the cache directory does not disclose the tokens. Writers
+// synchronize through lock files, so that several processes can share the
+// cache.
+package tokencache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
+	"golang.org/x/oauth2"
+)
+
+const (
+	keySize      = 32
+	entrySuffix  = ".token"
+	lockSuffix   = ".lock"
+	entryVersion = 1
+
+	// DefaultLockTimeout is the default time to wait for a lock
+	DefaultLockTimeout = 5 * time.Second
+	// Locks older than staleLock were left by a crashed process
+	staleLock = 30 * time.Second
+)
+
+// ErrLockTimeout is returned when a lock could not be acquired in time
+var ErrLockTimeout = errors.New("tokencache: timeout while waiting for the lock")
+
+// Options configures a Cache
+type Options struct {
+	// Dir is the directory of the cache (DefaultDir if empty)
+	Dir string
+	// Key encrypts the tokens (32 bytes, required). It must not be stored
+	// next to the cache, e.g. take it from an OS keyring or a secret manager.
+	Key []byte
+	// LockTimeout is the time to wait for a lock (DefaultLockTimeout if zero)
+	LockTimeout time.Duration
+}
+
+// Cache is a file-based token cache. It implements duokey.TokenCache and is
+// safe for concurrent use by several goroutines and processes.
+type Cache struct {
+	dir         string
+	aead        cipher.AEAD
+	lockTimeout time.Duration
+}
+
+// Ensure that Cache implements the duokey.TokenCache interface
+var _ duokey.TokenCache = (*Cache)(nil)
+
+// entry is the content of a cache entry. The extra fields of an oauth2.Token
+// are not serialized, so the ID token is kept explicitly (see
+// client.Client.TokenInfo).
+type entry struct {
+	oauth2.Token
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// DefaultDir returns the default cache directory: duokey/tokens under the
+// user's configuration directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "duokey", "tokens"), nil
+}
+
+// New creates the cache directory if needed and returns a cache.
+func New(options Options) (*Cache, error) {
+	c := &Cache{dir: options.Dir, lockTimeout: options.LockTimeout}
+
+	if c.dir == "" {
+		dir, err := DefaultDir()
+		if err != nil {
+			return nil, fmt.Errorf("tokencache: %w", err)
+		}
+		c.dir = dir
+	}
+
+	if c.lockTimeout <= 0 {
+		c.lockTimeout = DefaultLockTimeout
+	}
+
+	if len(options.Key) != keySize {
+		return nil, fmt.Errorf("tokencache: the key must be %d bytes long", keySize)
+	}
+
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("tokencache: %w", err)
+	}
+
+	block, err := aes.NewCipher(options.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Load returns the token stored for key, or nil if there is none. Expired
+// tokens are returned as well: the client renews them with their refresh
+// token, if any.
+func (c *Cache) Load(key duokey.TokenCacheKey) (*oauth2.Token, error) {
+	name := c.entryName(key)
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tokencache: %w", err)
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(data) < 1+nonceSize || data[0] != entryVersion {
+		return nil, fmt.Errorf("tokencache: bad entry %s", name)
+	}
+
+	plaintext, err := c.aead.Open(nil, data[1:1+nonceSize], data[1+nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("tokencache: cannot decrypt entry %s (wrong key?)", name)
+	}
+	defer sensitive.Zero(plaintext)
+
+	var e entry
+	if err := json.Unmarshal(plaintext, &e); err != nil {
+		return nil, fmt.Errorf("tokencache: bad entry %s: %w", name, err)
+	}
+
+	token := &e.Token
+	if e.IDToken != "" {
+		token = token.WithExtra(map[string]interface{}{"id_token": e.IDToken})
+	}
+
+	return token, nil
+}
+
+// Store saves token for key, replacing the previous one.
+func (c *Cache) Store(key duokey.TokenCacheKey, token *oauth2.Token) error {
+	name := c.entryName(key)
+
+	e := entry{Token: *token}
+	e.IDToken, _ = token.Extra("id_token").(string)
+
+	plaintext, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	defer sensitive.Zero(plaintext)
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := append([]byte{entryVersion}, nonce...)
+	data = c.aead.Seal(data, nonce, plaintext, []byte(name))
+
+	unlock, err := c.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeFile(filepath.Join(c.dir, name), data)
+}
+
+// Delete removes the token stored for key, if any.
+func (c *Cache) Delete(key duokey.TokenCacheKey) error {
+	name := c.entryName(key)
+
+	unlock, err := c.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// entryName returns the file name of the entry of key. The name does not
+// disclose the key fields.
+func (c *Cache) entryName(key duokey.TokenCacheKey) string {
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + entrySuffix
+}
+
+// lock acquires the lock of a file of the cache and returns the function
+// releasing it. A lock is a file created exclusively, which works on every
+// OS and file system supporting O_EXCL.
+func (c *Cache) lock(name string) (func(), error) {
+	path := filepath.Join(c.dir, name+lockSuffix)
+	deadline := time.Now().Add(c.lockTimeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("tokencache: %w", err)
+		}
+
+		// Break the locks left by crashed processes
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeFile replaces a file atomically: readers see the old or the new
+// content, never a partial one
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package tokencache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+var testKey = duokey.TokenCacheKey{Issuer: "https://issuer.example.com", ClientID: "client", TenantID: 1, Scope: "duokey", UserName: "jane.doe"}
+
+// encryptionKey encrypts the tokens of the tests
+var encryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testToken() *oauth2.Token {
+	token := &oauth2.Token{AccessToken: "secret-access-token", TokenType: "Bearer", RefreshToken: "secret-refresh-token", Expiry: time.Now().Add(time.Hour)}
+	return token.WithExtra(map[string]interface{}{"id_token": "secret-id-token", "scope": "api"})
+}
+
+func TestStoreLoad(t *testing.T) {
+
+	dir := t.TempDir()
+	cache, err := New(Options{Dir: dir, Key: encryptionKey})
+	require.NoError(t, err)
+
+	token, err := cache.Load(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, token, "empty cache")
+
+	require.NoError(t, cache.Store(testKey, testToken()))
+
+	// Another process with the same directory and key shares the tokens
+	other, err := New(Options{Dir: dir, Key: encryptionKey})
+	require.NoError(t, err)
+	token, err = other.Load(testKey)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	assert.Equal(t, "secret-access-token", token.AccessToken)
+	assert.Equal(t, "secret-refresh-token", token.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+	assert.Equal(t, "secret-id-token", token.Extra("id_token"), "the ID token should be kept")
+
+	// The tokens are encrypted
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entrySuffix))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+	assert.NotContains(t, filepath.Base(files[0]), "jane.doe")
+
+	// Other keys are distinct entries
+	otherKey := testKey
+	otherKey.Scope = "other"
+	token, err = cache.Load(otherKey)
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	require.NoError(t, cache.Delete(testKey))
+	token, err = cache.Load(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, token)
+}
+
+func TestOptions(t *testing.T) {
+
+	key := make([]byte, keySize)
+
+	testCases := []struct {
+		name    string
+		options func(dir string) Options
+		wantErr bool
+	}{
+		{name: "Given key", options: func(dir string) Options { return Options{Dir: dir, Key: key} }},
+		{name: "Short key", options: func(dir string) Options { return Options{Dir: dir, Key: key[:16]} }, wantErr: true},
+		{name: "Missing key", options: func(dir string) Options { return Options{Dir: dir} }, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := New(tc.options(dir))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, files, "the key is not stored")
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+
+	dir := t.TempDir()
+	cache, err := New(Options{Dir: dir, Key: encryptionKey})
+	require.NoError(t, err)
+	require.NoError(t, cache.Store(testKey, testToken()))
+
+	other, err := New(Options{Dir: dir, Key: make([]byte, keySize)})
+	require.NoError(t, err)
+	_, err = other.Load(testKey)
+	assert.Error(t, err)
+}
+
+func TestLocks(t *testing.T) {
+
+	dir := t.TempDir()
+	cache, err := New(Options{Dir: dir, Key: encryptionKey})
+	require.NoError(t, err)
+
+	// Concurrent writers
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cache.Store(testKey, testToken()))
+		}()
+	}
+	wg.Wait()
+
+	token, err := cache.Load(testKey)
+	require.NoError(t, err)
+	assert.NotNil(t, token)
+
+	// A held lock blocks the writers until the timeout
+	impatient, err := New(Options{Dir: dir, Key: encryptionKey, LockTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = cache.lock(cache.entryName(testKey))
+	require.NoError(t, err)
+	assert.ErrorIs(t, impatient.Store(testKey, testToken()), ErrLockTimeout)
+
+	// A stale lock is broken
+	lockPath := filepath.Join(dir, cache.entryName(testKey)+lockSuffix)
+	old := time.Now().Add(-2 * staleLock)
+	require.NoError(t, os.Chtimes(lockPath, old, old))
+	assert.NoError(t, cache.Store(testKey, testToken()))
+}
@@ -0,0 +1,41 @@
+package duokey
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer traces the operations of a client: a span is started for each API
+// request and for each token acquisition (see package duokey/tracing for
+// OpenTelemetry).
+type Tracer interface {
+	// Start starts a span named name, child of the span of ctx if any, and
+	// returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject adds the trace context of ctx to the header of an outgoing
+	// request.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is an operation traced by a Tracer
+type Span interface {
+	// SetAttribute records an attribute of the operation. The value is a
+	// string, an int or a bool.
+	SetAttribute(key string, value interface{})
+	// End ends the span. err is the outcome of the operation.
+	End(err error)
+}
+
+// Name of the token acquisition spans
+const SpanAcquireToken = "AcquireToken"
+
+// Attributes of the spans. The payloads are never recorded.
+const (
+	AttributeKeyID       = "duokey.key_id"
+	AttributeVaultID     = "duokey.vault_id"
+	AttributeAlgorithm   = "duokey.algorithm"
+	AttributeRetryCount  = "duokey.retry_count"
+	AttributePayloadSize = "duokey.payload_size"
+	AttributeGrantType   = "duokey.grant_type"
+	AttributeStatusCode  = "http.response.status_code"
+)
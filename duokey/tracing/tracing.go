@@ -0,0 +1,133 @@
+// Package tracing traces the DuoKey operations with OpenTelemetry. Set the
+// tracer returned by New in duokey.Config:
+//
+//	config.Tracer = tracing.New()
+//	c, err := client.NewWithConfig(config)
+//
+// Each API request gets a client span named after its operation (Encrypt,
+// Decrypt, Import, GetKeyId, ...), each token acquisition an AcquireToken
+// span, child of the request needing the token if any. The trace context is
+// propagated to the servers with the W3C Trace Context headers.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// InstrumentationName identifies the tracer of the SDK
+const InstrumentationName = "github.com/duokey/duokey-sdk-go"
+
+// Option configures the tracer returned by New
+type Option func(*tracer)
+
+// WithTracerProvider sets the tracer provider (otel.GetTracerProvider by
+// default)
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(t *tracer) {
+		t.provider = provider
+	}
+}
+
+// WithPropagator sets the propagator of the trace context (W3C Trace Context
+// by default)
+func WithPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(t *tracer) {
+		t.propagator = propagator
+	}
+}
+
+type tracer struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	tracer     trace.Tracer
+}
+
+var _ duokey.Tracer = (*tracer)(nil)
+
+// New returns a duokey.Tracer creating OpenTelemetry spans
+func New(options ...Option) duokey.Tracer {
+	t := &tracer{
+		provider:   otel.GetTracerProvider(),
+		propagator: propagation.TraceContext{},
+	}
+	for _, option := range options {
+		option(t)
+	}
+	t.tracer = t.provider.Tracer(InstrumentationName)
+
+	return t
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, duokey.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, span{s}
+}
+
+func (t *tracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// End records err as an exception event and as the status of the span. The
+// message is sanitized (see errorMessage) since traces are exported to third
+// parties.
+func (s span) End(err error) {
+	if err != nil {
+		message := errorMessage(err)
+		s.span.AddEvent("exception", trace.WithAttributes(
+			attribute.String("exception.type", fmt.Sprintf("%T", err)),
+			attribute.String("exception.message", message),
+		))
+		s.span.SetStatus(codes.Error, message)
+	}
+	s.span.End()
+}
+
+// errorMessage returns the message of err without the body of an error
+// response (API or token endpoint), which may quote the request, and with the
+// secrets redacted
+func errorMessage(err error) string {
+	message := err.Error()
+
+	var errResp *request.ErrorResponse
+	if errors.As(err, &errResp) && len(errResp.Body) > 0 {
+		message = strings.ReplaceAll(message, string(errResp.Body), duokey.Redacted)
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && len(retrieveErr.Body) > 0 {
+		message = strings.ReplaceAll(message, string(retrieveErr.Body), duokey.Redacted)
+	}
+
+	return duokey.RedactString(message)
+}
@@ -0,0 +1,113 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/duokey/client"
+	"github.com/duokey/duokey-sdk-go/duokey/duokeytest"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/duokey/duokey-sdk-go/duokey/tracing"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type silentLogger struct{}
+
+func (silentLogger) Info(...interface{})          {}
+func (silentLogger) Infof(string, ...interface{}) {}
+
+func TestTracing(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	server := duokeytest.NewServer(nil)
+	defer server.Close()
+
+	c, err := client.NewWithConfig(duokey.Config{
+		Credentials:  server.Credentials(),
+		Logger:       silentLogger{},
+		TokenRefresh: duokey.TokenRefreshConfig{Disabled: true},
+		Tracer:       tracing.New(tracing.WithTracerProvider(provider)),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The trace context is sent to the server
+	var traceparent string
+	c.Handlers.Complete.PushBack(func(r *request.Request) {
+		traceparent = r.HTTPRequest.Header.Get("traceparent")
+	})
+
+	endpoints := server.Endpoints()
+	kmsClient := &kms.KMS{Client: c, Endpoints: &endpoints}
+	keyID := server.CreateKey("vault", duokeytest.KeyAES)
+
+	// The rejected token is renewed within the Encrypt span
+	server.RevokeTokens()
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	payload := "Lorem ipsum dolor sit amet"
+	_, err = kmsClient.EncryptWithContext(ctx, &kms.EncryptInput{KeyID: keyID, VaultID: "vault", Payload: []byte(payload)})
+	require.NoError(t, err)
+	parent.End()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+
+	// The first token, then the renewal
+	require.Len(t, spans[duokey.SpanAcquireToken], 2)
+	require.Len(t, spans["Encrypt"], 1)
+	encrypt := spans["Encrypt"][0]
+	renewal := spans[duokey.SpanAcquireToken][1]
+
+	assert.Equal(t, parent.SpanContext().SpanID(), encrypt.Parent().SpanID())
+	assert.Equal(t, encrypt.SpanContext().SpanID(), renewal.Parent().SpanID())
+	assert.Contains(t, traceparent, encrypt.SpanContext().TraceID().String())
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range encrypt.Attributes() {
+		attributes[kv.Key] = kv.Value
+		assert.NotContains(t, kv.Value.Emit(), payload, "the payload is never recorded")
+	}
+	assert.Equal(t, keyID, attributes[duokey.AttributeKeyID].AsString())
+	assert.Equal(t, "vault", attributes[duokey.AttributeVaultID].AsString())
+	assert.Equal(t, int64(1), attributes[duokey.AttributeRetryCount].AsInt64())
+	assert.Equal(t, int64(200), attributes[duokey.AttributeStatusCode].AsInt64())
+	assert.Greater(t, attributes[duokey.AttributePayloadSize].AsInt64(), int64(len(payload)))
+	assert.Equal(t, codes.Unset, encrypt.Status().Code)
+
+	// Failed operations are marked as errors
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{KeyID: "unknown", VaultID: "vault", Payload: []byte(payload)})
+	require.Error(t, err)
+
+	ended := recorder.Ended()
+	failed := ended[len(ended)-1]
+	assert.Equal(t, "Encrypt", failed.Name())
+	assert.Equal(t, codes.Error, failed.Status().Code)
+
+	// The body of the error response is not exported
+	assert.Equal(t, "request failed with status 404: "+duokey.Redacted, failed.Status().Description)
+	require.Len(t, failed.Events(), 1)
+	for _, kv := range failed.Events()[0].Attributes {
+		assert.NotContains(t, kv.Value.Emit(), "not found in vault")
+	}
+
+	// So are the requests rejected before they are sent
+	_, err = kmsClient.Encrypt(&kms.EncryptInput{VaultID: "vault", Payload: []byte(payload)})
+	require.Error(t, err)
+
+	require.Len(t, recorder.Ended(), len(ended)+1)
+	ended = recorder.Ended()
+	rejected := ended[len(ended)-1]
+	assert.Equal(t, "Encrypt", rejected.Name())
+	assert.Equal(t, codes.Error, rejected.Status().Code)
+}
@@ -197,10 +197,10 @@ func getConfig() {
 * The key is set in the DUOKEY_KEY_ID variable
 *	This code was tested with an RSA or AES key
 * For RSA operations:
-*	Algorithm: "RSA-OAEP-256"
+*	Algorithm: kms.AlgorithmRSAOAEP256
 *		In former versions, was "3", used for Sepior
 * For AES-GCM operations:
-*	Algorithm: "AES-GCM",
+*	Algorithm: kms.AlgorithmAESGCM,
 *	And the Iv, received from the Encrypt operation, can be passed in the DecryptInput
  */
 func main() {
@@ -247,8 +247,8 @@ func main() {
 	}
 
 	// define the algorithm, according to the key
-	algorithm := "RSA-OAEP-256"
-	// algorithm := "AES-GCM"
+	algorithm := kms.AlgorithmRSAOAEP256
+	// algorithm := kms.AlgorithmAESGCM
 
 	// Encryption
 	eInput := &kms.EncryptInput{
@@ -0,0 +1,33 @@
+// Package sensitive contains the helpers shared by the packages that handle
+// keys, tokens and encryption contexts.
+package sensitive
+
+// Zero overwrites b with zeros. It is best effort: copies made elsewhere (by
+// the HTTP stack, the JSON decoder or the runtime) are out of reach.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Clone returns a copy of b that can be zeroed independently. A nil slice
+// gives an empty one.
+func Clone(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// CopyContext returns a copy of an encryption context, so that the mandatory
+// context can be merged into it without modifying the caller's map.
+func CopyContext(context map[string]string) map[string]string {
+	if context == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(context))
+	for key, value := range context {
+		c[key] = value
+	}
+	return c
+}
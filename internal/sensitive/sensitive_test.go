@@ -0,0 +1,27 @@
+package sensitive
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZero(t *testing.T) {
+	b := []byte("secret")
+	c := Clone(b)
+
+	Zero(b)
+
+	assert.Equal(t, make([]byte, 6), b)
+	assert.Equal(t, []byte("secret"), c, "the clone should not be zeroed")
+}
+
+func TestCopyContext(t *testing.T) {
+	assert.Nil(t, CopyContext(nil))
+
+	context := map[string]string{"purpose": "test"}
+	c := CopyContext(context)
+	c["tenant"] = "1"
+
+	assert.Equal(t, map[string]string{"purpose": "test"}, context)
+}
@@ -0,0 +1,126 @@
+package kms
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Algorithm identifies the encryption mode requested from DuoKey. An empty
+// Algorithm lets the server choose the mode from the key.
+type Algorithm string
+
+// Supported encryption modes
+const (
+	AlgorithmAESGCM     Algorithm = "AES-GCM"
+	AlgorithmAESCBC     Algorithm = "AES-CBC"
+	AlgorithmRSAOAEP    Algorithm = "RSA-OAEP"
+	AlgorithmRSAOAEP256 Algorithm = "RSA-OAEP-256"
+	AlgorithmRSAPKCS1   Algorithm = "RSA1_5"
+)
+
+// Key types reported in KeyData.Type
+const (
+	KeyTypeAES = "AES"
+	KeyTypeRSA = "RSA"
+)
+
+// algorithmSpec describes the constraints of an encryption mode
+type algorithmSpec struct {
+	keyType   string // Expected prefix of KeyData.Type
+	requireIv bool   // An Iv must be supplied on decryption
+	aead      bool   // Additional authenticated data and a tag are supported
+}
+
+var algorithms = map[Algorithm]algorithmSpec{
+	AlgorithmAESGCM:     {keyType: KeyTypeAES, requireIv: true, aead: true},
+	AlgorithmAESCBC:     {keyType: KeyTypeAES, requireIv: true},
+	AlgorithmRSAOAEP:    {keyType: KeyTypeRSA},
+	AlgorithmRSAOAEP256: {keyType: KeyTypeRSA},
+	AlgorithmRSAPKCS1:   {keyType: KeyTypeRSA},
+}
+
+// Numeric identifiers used by former versions of the DuoKey API
+var legacyAlgorithms = map[string]Algorithm{
+	"3": AlgorithmRSAOAEP256, // Sepior
+}
+
+// Normalize translates a legacy numeric identifier into the corresponding
+// Algorithm. Other values are returned unchanged.
+func (a Algorithm) Normalize() Algorithm {
+	if alg, ok := legacyAlgorithms[string(a)]; ok {
+		return alg
+	}
+	return a
+}
+
+// IsValid reports whether a (after normalization) is a supported algorithm.
+func (a Algorithm) IsValid() bool {
+	_, ok := algorithms[a.Normalize()]
+	return ok
+}
+
+// RequiresIv reports whether an initialization vector is needed to decrypt
+// a payload encrypted with a.
+func (a Algorithm) RequiresIv() bool {
+	return algorithms[a.Normalize()].requireIv
+}
+
+// SupportsAAD reports whether a authenticates additional data (AAD) and
+// produces a tag.
+func (a Algorithm) SupportsAAD() bool {
+	return algorithms[a.Normalize()].aead
+}
+
+// keyUsage is the operation for which a key is checked
+type keyUsage int
+
+const (
+	usageEncrypt keyUsage = iota
+	usageDecrypt
+)
+
+func (u keyUsage) String() string {
+	if u == usageDecrypt {
+		return "decryption"
+	}
+	return "encryption"
+}
+
+// checkAlgorithm verifies that the algorithm is supported and, if the key
+// metadata is known, that it matches the key type and usage flags.
+func checkAlgorithm(alg Algorithm, key *KeyData, usage keyUsage) error {
+	if alg == "" {
+		// The server determines the algorithm from the key
+		return nil
+	}
+
+	spec, ok := algorithms[alg.Normalize()]
+	if !ok {
+		return fmt.Errorf("unknown algorithm: %s", alg)
+	}
+
+	if key == nil {
+		return nil
+	}
+
+	if !key.IsEnabled {
+		return fmt.Errorf("key %s is disabled", key.Id)
+	}
+
+	if !strings.HasPrefix(strings.ToUpper(key.Type), spec.keyType) {
+		return fmt.Errorf("algorithm %s cannot be used with a key of type '%s'", alg, key.Type)
+	}
+
+	switch usage {
+	case usageEncrypt:
+		if !key.IsEncrypt {
+			return fmt.Errorf("key %s is not allowed for %s", key.Id, usage)
+		}
+	case usageDecrypt:
+		if !key.IsDecrypt {
+			return fmt.Errorf("key %s is not allowed for %s", key.Id, usage)
+		}
+	}
+
+	return nil
+}
@@ -2,10 +2,14 @@ package kms
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
 	"github.com/google/go-querystring/query"
+	"github.com/pkg/errors"
 )
 
 // Import
@@ -18,6 +22,11 @@ type ImportInput struct {
 	Payload []byte            `json:"payload"`
 }
 
+// DescribeKey implements request.KeyDescriber
+func (i *ImportInput) DescribeKey() request.KeyDescription {
+	return request.KeyDescription{VaultID: i.VaultID}
+}
+
 type ImportOutput struct {
 	Success bool `json:"success"`
 	Result  struct {
@@ -49,7 +58,7 @@ func (k *KMS) importRequest(input *ImportInput) (req *request.Request, output *I
 	op := &request.Operation{
 		Name:       opImport,
 		HTTPMethod: http.MethodPost,
-		BaseURL:    k.Endpoints.BaseURL,
+		BaseURL:    k.Endpoints.baseURL(),
 		Route:      k.Endpoints.ImportRoute,
 	}
 
@@ -68,7 +77,7 @@ func (k *KMS) importRequest(input *ImportInput) (req *request.Request, output *I
 	}
 
 	output = &ImportOutput{}
-	req = k.NewRequest(op, input, output)
+	req = k.newRequest(op, input, output)
 
 	return
 }
@@ -80,27 +89,42 @@ const opEncrypt = "Encrypt"
 // algorithm from the VaultID and KeyId. The optional field Algorithm allows you to specify a
 // chaining mode or a padding scheme. An initial vector or a tag can be supplied using the
 // Context field.
+// For AES-GCM, AAD (additional authenticated data) binds the ciphertext to e.g. a record ID or a
+// tenant: the same AAD must be supplied to decrypt the payload.
+// If Key is set (e.g. with the output of GetKeyId), the algorithm is checked against the key
+// type and usage flags before the request is sent.
 // Validation is done by calling request.New.
 type EncryptInput struct {
 	ID        uint32            `json:"id"`
 	KeyID     string            `json:"keyid" validate:"nonzero"`
 	VaultID   string            `json:"vaultid" validate:"nonzero"`
-	Algorithm string            `json:"algorithm,omitempty"`
+	Algorithm Algorithm         `json:"algorithm,omitempty"`
 	Context   map[string]string `json:"context,omitempty"`
 	Payload   []byte            `json:"payload"`
+	AAD       []byte            `json:"aad,omitempty"`
+	Key       *KeyData          `json:"-"`
+}
+
+// DescribeKey implements request.KeyDescriber
+func (i *EncryptInput) DescribeKey() request.KeyDescription {
+	return request.KeyDescription{KeyID: i.KeyID, VaultID: i.VaultID, Algorithm: string(i.Algorithm)}
 }
 
 // EncryptOutput contains the deserialized payload returned by the DuoKey server.
 // Validation is done by calling request.Send.
-// For AES-GCM operation, the Iv is also found in the payload and needed for the decrypt operation
+// For AES-GCM operation, the Iv is also found in the payload and needed for the decrypt operation.
+// The GCM tag is returned in Tag if the server sends it separately, otherwise it is appended to
+// EncryptedPayload.
 type EncryptOutput struct {
 	Success bool `json:"success"`
 	Result  struct {
-		KeyID            string `json:"keyid" validate:"nonzero"`
-		Algorithm        string `json:"algorithm"`
-		EncryptedPayload string `json:"encryptedPayload" validate:"nonzero"`
-		ID               uint32 `json:"id"`
-		Iv               string `json:"initializationVector"`
+		KeyID            string    `json:"keyid" validate:"nonzero"`
+		Algorithm        Algorithm `json:"algorithm"`
+		EncryptedPayload string    `json:"encryptedPayload" validate:"nonzero"`
+		ID               uint32    `json:"id"`
+		Iv               string    `json:"initializationVector"`
+		Tag              string    `json:"tag,omitempty"`
+		AAD              []byte    `json:"aad,omitempty"`
 	} `json:"result" validate:"nonzero"`
 	TargetURL           *string `json:"targetUrl"`
 	Error               *string `json:"error"`
@@ -131,7 +155,7 @@ func (k *KMS) encryptRequest(input *EncryptInput) (req *request.Request, output
 	op := &request.Operation{
 		Name:       opEncrypt,
 		HTTPMethod: http.MethodPost,
-		BaseURL:    k.Endpoints.BaseURL,
+		BaseURL:    k.Endpoints.baseURL(),
 		Route:      k.Endpoints.EncryptRoute,
 	}
 
@@ -149,8 +173,21 @@ func (k *KMS) encryptRequest(input *EncryptInput) (req *request.Request, output
 		input.Context[key] = value
 	}
 
+	// Translate legacy identifiers on a copy, so the caller's input is left as is, and
+	// reject invalid combinations before the network call
+	normalized := *input
+	normalized.Algorithm = input.Algorithm.Normalize()
+	input = &normalized
+
 	output = &EncryptOutput{}
-	req = k.NewRequest(op, input, output)
+	req = k.newRequest(op, input, output)
+
+	if req.Error == nil {
+		req.Error = checkAlgorithm(input.Algorithm, input.Key, usageEncrypt)
+	}
+	if req.Error == nil && len(input.AAD) > 0 && input.Algorithm != "" && !input.Algorithm.SupportsAAD() {
+		req.Error = fmt.Errorf("algorithm %s does not support additional authenticated data", input.Algorithm)
+	}
 
 	return
 }
@@ -159,16 +196,28 @@ func (k *KMS) encryptRequest(input *EncryptInput) (req *request.Request, output
 const opDecrypt = "Decrypt"
 
 // DecryptInput contains a payload to be decrypted by DuoKey.
-// An Iv can be passed if needed
+// An Iv must be passed for the AES modes (see Algorithm.RequiresIv).
+// For AES-GCM, AAD must match the data supplied at encryption. The tag can be passed in Tag or
+// appended to Payload (Tag is then left empty).
+// If Key is set, the algorithm is checked against the key type and usage flags before the
+// request is sent.
 // Validation is done by calling request.New.
 type DecryptInput struct {
 	ID        uint32            `json:"id"`
 	KeyID     string            `json:"keyid" validate:"nonzero"`
 	VaultID   string            `json:"vaultid" validate:"nonzero"`
-	Algorithm string            `json:"algorithm,omitempty"`
+	Algorithm Algorithm         `json:"algorithm,omitempty"`
 	Context   map[string]string `json:"context,omitempty"`
 	Payload   string            `json:"payload"`
 	Iv        string            `json:"iv"`
+	Tag       string            `json:"tag,omitempty"`
+	AAD       []byte            `json:"aad,omitempty"`
+	Key       *KeyData          `json:"-"`
+}
+
+// DescribeKey implements request.KeyDescriber
+func (i *DecryptInput) DescribeKey() request.KeyDescription {
+	return request.KeyDescription{KeyID: i.KeyID, VaultID: i.VaultID, Algorithm: string(i.Algorithm)}
 }
 
 // DecryptOutput contains the deserialized payload returned by the DuoKey server.
@@ -176,10 +225,11 @@ type DecryptInput struct {
 type DecryptOutput struct {
 	Success bool `json:"success"`
 	Result  struct {
-		KeyID     string `json:"keyid" validate:"nonzero"`
-		Algorithm string `json:"algorithm"`
-		Payload   []byte `json:"payload" validate:"nonzero"`
-		ID        uint32 `json:"id"`
+		KeyID     string    `json:"keyid" validate:"nonzero"`
+		Algorithm Algorithm `json:"algorithm"`
+		Payload   []byte    `json:"payload" validate:"nonzero"`
+		ID        uint32    `json:"id"`
+		AAD       []byte    `json:"aad,omitempty"`
 	} `json:"result" validate:"nonzero"`
 	TargetURL           *string `json:"targetUrl"`
 	Error               *string `json:"error"`
@@ -187,12 +237,28 @@ type DecryptOutput struct {
 	ABP                 bool    `json:"__abp"`
 }
 
+// ErrAuthenticationFailed is returned by Decrypt when the server could not authenticate
+// the payload, i.e. the AAD or the tag does not match. Use errors.Is to test for it.
+var ErrAuthenticationFailed = errors.New("message authentication failed")
+
+// Messages of the exceptions raised by the cryptographic libraries when a GCM tag does
+// not match, lowercased. The DuoKey server reports the failure with the message of the
+// exception and no dedicated error code or status, so the detection is best effort: it
+// recognizes .NET (AuthenticationTagMismatchException), Java (AEADBadTagException) and
+// Bouncy Castle (InvalidCipherTextException) messages.
+var authenticationFailureMarkers = []string{
+	"authentication tag did not match", // .NET
+	"tag mismatch",                     // Java (SunJCE)
+	"aeadbadtagexception",              // Java, when the exception name is reported
+	"mac check in gcm failed",          // Bouncy Castle
+}
+
 // Decrypt API operation for DuoKey
 func (k *KMS) Decrypt(input *DecryptInput) (*DecryptOutput, error) {
 
 	req, out := k.decryptRequest(input)
 
-	return out, req.Send()
+	return out, decryptError(req.Send(), out.Error)
 }
 
 // DecryptWithContext is the same operation as Decrypt. It is however possible
@@ -202,7 +268,7 @@ func (k *KMS) DecryptWithContext(ctx context.Context, input *DecryptInput) (*Dec
 	req, out := k.decryptRequest(input)
 	req.SetContext(ctx)
 
-	return out, req.Send()
+	return out, decryptError(req.Send(), out.Error)
 }
 
 func (k *KMS) decryptRequest(input *DecryptInput) (req *request.Request, output *DecryptOutput) {
@@ -210,7 +276,7 @@ func (k *KMS) decryptRequest(input *DecryptInput) (req *request.Request, output
 	op := &request.Operation{
 		Name:       opDecrypt,
 		HTTPMethod: http.MethodPost,
-		BaseURL:    k.Endpoints.BaseURL,
+		BaseURL:    k.Endpoints.baseURL(),
 		Route:      k.Endpoints.DecryptRoute,
 	}
 
@@ -228,12 +294,250 @@ func (k *KMS) decryptRequest(input *DecryptInput) (req *request.Request, output
 		input.Context[key] = value
 	}
 
+	// Translate legacy identifiers on a copy, so the caller's input is left as is, and
+	// reject invalid combinations before the network call
+	normalized := *input
+	normalized.Algorithm = input.Algorithm.Normalize()
+	input = &normalized
+
 	output = &DecryptOutput{}
-	req = k.NewRequest(op, input, output)
+	req = k.newRequest(op, input, output)
+
+	if req.Error == nil {
+		req.Error = checkAlgorithm(input.Algorithm, input.Key, usageDecrypt)
+	}
+	if req.Error == nil && input.Algorithm.RequiresIv() && input.Iv == "" {
+		req.Error = fmt.Errorf("algorithm %s requires an Iv", input.Algorithm)
+	}
+	if req.Error == nil && (len(input.AAD) > 0 || input.Tag != "") && input.Algorithm != "" && !input.Algorithm.SupportsAAD() {
+		req.Error = fmt.Errorf("algorithm %s does not support additional authenticated data", input.Algorithm)
+	}
 
 	return
 }
 
+// decryptError translates an authentication failure reported by the server
+// into ErrAuthenticationFailed. Other errors are returned unchanged.
+// The detection is best effort, see authenticationFailureMarkers.
+func decryptError(err error, serverError *string) error {
+	if err == nil {
+		return nil
+	}
+
+	var msg string
+	var errResp *request.ErrorResponse
+	if errors.As(err, &errResp) {
+		msg = string(errResp.Body)
+	}
+	if serverError != nil {
+		msg += *serverError
+	}
+
+	lower := strings.ToLower(msg)
+	for _, marker := range authenticationFailureMarkers {
+		if strings.Contains(lower, marker) {
+			return fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+		}
+	}
+
+	return err
+}
+
+// Re-encryption
+const opReEncrypt = "ReEncrypt"
+
+// ReEncryptInput contains a payload encrypted under a source key, to be encrypted under a
+// destination key. The Source fields are those of DecryptInput, the Destination fields those
+// of EncryptInput. The context is sent with both operations.
+// Validation is done by calling request.New.
+type ReEncryptInput struct {
+	ID                   uint32            `json:"id"`
+	SourceKeyID          string            `json:"sourceKeyid" validate:"nonzero"`
+	SourceVaultID        string            `json:"sourceVaultid" validate:"nonzero"`
+	SourceAlgorithm      Algorithm         `json:"sourceAlgorithm,omitempty"`
+	SourceIv             string            `json:"sourceIv,omitempty"`
+	SourceTag            string            `json:"sourceTag,omitempty"`
+	SourceAAD            []byte            `json:"sourceAad,omitempty"`
+	DestinationKeyID     string            `json:"destinationKeyid" validate:"nonzero"`
+	DestinationVaultID   string            `json:"destinationVaultid" validate:"nonzero"`
+	DestinationAlgorithm Algorithm         `json:"destinationAlgorithm,omitempty"`
+	DestinationAAD       []byte            `json:"destinationAad,omitempty"`
+	Context              map[string]string `json:"context,omitempty"`
+	Payload              string            `json:"payload"`
+}
+
+// DescribeKey implements request.KeyDescriber. The source key is described.
+func (i *ReEncryptInput) DescribeKey() request.KeyDescription {
+	return request.KeyDescription{KeyID: i.SourceKeyID, VaultID: i.SourceVaultID, Algorithm: string(i.SourceAlgorithm)}
+}
+
+// ReEncryptOutput contains the payload encrypted under the destination key.
+// Validation is done by calling request.Send.
+type ReEncryptOutput struct {
+	Success bool `json:"success"`
+	Result  struct {
+		KeyID            string    `json:"keyid" validate:"nonzero"`
+		SourceKeyID      string    `json:"sourceKeyid"`
+		Algorithm        Algorithm `json:"algorithm"`
+		EncryptedPayload string    `json:"encryptedPayload" validate:"nonzero"`
+		ID               uint32    `json:"id"`
+		Iv               string    `json:"initializationVector"`
+		Tag              string    `json:"tag,omitempty"`
+	} `json:"result" validate:"nonzero"`
+	TargetURL           *string `json:"targetUrl"`
+	Error               *string `json:"error"`
+	UnauthorizedRequest bool    `json:"unAuthorizedRequest"`
+	ABP                 bool    `json:"__abp"`
+}
+
+// ReEncrypt API operation for DuoKey. If Endpoints.ReEncryptRoute is set, the payload is
+// re-encrypted by the server and the plaintext never reaches the client. Otherwise, the
+// payload is decrypted and encrypted again by the client; the intermediate buffers are
+// zeroed once the operation is complete.
+func (k *KMS) ReEncrypt(input *ReEncryptInput) (*ReEncryptOutput, error) {
+
+	return k.ReEncryptWithContext(context.Background(), input)
+}
+
+// ReEncryptWithContext is the same operation as ReEncrypt. It is however possible
+// to pass a non-nil context.
+func (k *KMS) ReEncryptWithContext(ctx context.Context, input *ReEncryptInput) (*ReEncryptOutput, error) {
+
+	if k.Endpoints.ReEncryptRoute == "" {
+		return k.reEncryptClientSide(ctx, input)
+	}
+
+	req, out := k.reEncryptRequest(input)
+	req.SetContext(ctx)
+
+	return out, decryptError(req.Send(), out.Error)
+}
+
+func (k *KMS) reEncryptRequest(input *ReEncryptInput) (req *request.Request, output *ReEncryptOutput) {
+
+	op := &request.Operation{
+		Name:       opReEncrypt,
+		HTTPMethod: http.MethodPost,
+		BaseURL:    k.Endpoints.baseURL(),
+		Route:      k.Endpoints.ReEncryptRoute,
+	}
+
+	if input == nil {
+		input = &ReEncryptInput{}
+	}
+
+	// Create an empty context if needed
+	if input.Context == nil {
+		input.Context = make(map[string]string)
+	}
+
+	// Merge the input context and the mandatory context
+	for key, value := range k.Client.GetMandatoryContext() {
+		input.Context[key] = value
+	}
+
+	// Translate legacy identifiers on a copy, so the caller's input is left as is, and
+	// reject invalid combinations before the network call
+	normalized := *input
+	normalized.SourceAlgorithm = input.SourceAlgorithm.Normalize()
+	normalized.DestinationAlgorithm = input.DestinationAlgorithm.Normalize()
+	input = &normalized
+
+	output = &ReEncryptOutput{}
+	req = k.newRequest(op, input, output)
+
+	if req.Error == nil {
+		req.Error = checkReEncrypt(input)
+	}
+
+	return
+}
+
+// checkReEncrypt rejects the combinations that the client-side re-encryption would reject
+// when decrypting the payload or encrypting it again, whatever the route
+func checkReEncrypt(input *ReEncryptInput) error {
+	if err := checkAlgorithm(input.SourceAlgorithm, nil, usageDecrypt); err != nil {
+		return err
+	}
+	if input.SourceAlgorithm.RequiresIv() && input.SourceIv == "" {
+		return fmt.Errorf("algorithm %s requires an Iv", input.SourceAlgorithm)
+	}
+	if (len(input.SourceAAD) > 0 || input.SourceTag != "") && input.SourceAlgorithm != "" && !input.SourceAlgorithm.SupportsAAD() {
+		return fmt.Errorf("algorithm %s does not support additional authenticated data", input.SourceAlgorithm)
+	}
+	if err := checkAlgorithm(input.DestinationAlgorithm, nil, usageEncrypt); err != nil {
+		return err
+	}
+	if len(input.DestinationAAD) > 0 && input.DestinationAlgorithm != "" && !input.DestinationAlgorithm.SupportsAAD() {
+		return fmt.Errorf("algorithm %s does not support additional authenticated data", input.DestinationAlgorithm)
+	}
+	return nil
+}
+
+// reEncryptClientSide decrypts the payload with the source key and encrypts it with the
+// destination key. The plaintext is zeroed as soon as it is no longer needed.
+func (k *KMS) reEncryptClientSide(ctx context.Context, input *ReEncryptInput) (*ReEncryptOutput, error) {
+
+	output := &ReEncryptOutput{}
+
+	if input == nil {
+		input = &ReEncryptInput{}
+	}
+
+	// Reject the destination parameters before the payload is decrypted
+	if err := checkReEncrypt(input); err != nil {
+		return output, errors.Wrap(err, "bad request")
+	}
+
+	dReq, dOutput := k.decryptRequest(&DecryptInput{
+		ID:        input.ID,
+		KeyID:     input.SourceKeyID,
+		VaultID:   input.SourceVaultID,
+		Algorithm: input.SourceAlgorithm,
+		Context:   sensitive.CopyContext(input.Context),
+		Payload:   input.Payload,
+		Iv:        input.SourceIv,
+		Tag:       input.SourceTag,
+		AAD:       input.SourceAAD,
+	})
+	dReq.Sensitive = true
+	dReq.SetContext(ctx)
+
+	if err := decryptError(dReq.Send(), dOutput.Error); err != nil {
+		return output, err
+	}
+
+	plaintext := dOutput.Result.Payload
+	defer sensitive.Zero(plaintext)
+
+	eReq, eOutput := k.encryptRequest(&EncryptInput{
+		ID:        input.ID,
+		KeyID:     input.DestinationKeyID,
+		VaultID:   input.DestinationVaultID,
+		Algorithm: input.DestinationAlgorithm,
+		Context:   sensitive.CopyContext(input.Context),
+		Payload:   plaintext,
+		AAD:       input.DestinationAAD,
+	})
+	eReq.Sensitive = true
+	eReq.SetContext(ctx)
+
+	if err := eReq.Send(); err != nil {
+		return output, err
+	}
+
+	output.Success = eOutput.Success
+	output.Result.KeyID = eOutput.Result.KeyID
+	output.Result.SourceKeyID = input.SourceKeyID
+	output.Result.Algorithm = eOutput.Result.Algorithm
+	output.Result.EncryptedPayload = eOutput.Result.EncryptedPayload
+	output.Result.ID = eOutput.Result.ID
+	output.Result.Iv = eOutput.Result.Iv
+	output.Result.Tag = eOutput.Result.Tag
+
+	return output, nil
+}
+
 // GetKeyId
 const opGetKeyId = "GetKeyId"
 
@@ -315,7 +619,7 @@ func (k *KMS) getKeyIdRequest(input *GetKeyIdInput) (req *request.Request, outpu
 	op := &request.Operation{
 		Name:        opGetKeyId,
 		HTTPMethod:  http.MethodGet,
-		BaseURL:     k.Endpoints.BaseURL,
+		BaseURL:     k.Endpoints.baseURL(),
 		Route:       k.Endpoints.GetKeyIdRoute,
 		QueryParams: queryParams.Encode(),
 	}
@@ -325,7 +629,7 @@ func (k *KMS) getKeyIdRequest(input *GetKeyIdInput) (req *request.Request, outpu
 	}
 
 	output = &GetKeyIdOutput{}
-	req = k.NewRequest(op, input, output)
+	req = k.newRequest(op, input, output)
 
 	return
 }
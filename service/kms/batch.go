@@ -0,0 +1,456 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+	"gopkg.in/validator.v2"
+)
+
+const (
+	opEncryptBatch = "EncryptBatch"
+	opDecryptBatch = "DecryptBatch"
+)
+
+// DefaultBatchConcurrency is the maximum number of requests in flight when
+// BatchOptions.Concurrency is not set.
+const DefaultBatchConcurrency = 8
+
+// DefaultMaxBatchSize is the maximum number of items sent in one request to a
+// server-side batch route when BatchOptions.MaxBatchSize is not set.
+const DefaultMaxBatchSize = 100
+
+// BatchOptions controls the execution of a batch. If the batch route of the
+// operation is configured in Endpoints, the items are grouped and sent to the
+// server-side batch endpoint. Otherwise, each item is sent separately by a
+// bounded pool of workers.
+type BatchOptions struct {
+	Concurrency  int // Maximum number of requests in flight
+	MaxBatchSize int // Maximum number of items per request to a batch route
+}
+
+// EncryptBatchInput contains the payloads to be encrypted by EncryptBatch.
+type EncryptBatchInput struct {
+	Inputs  []*EncryptInput
+	Options BatchOptions
+}
+
+// EncryptBatchResult is the result of one item of a batch. Index is the
+// position of the item in the input slice or channel. An error affecting one
+// item does not abort the batch.
+type EncryptBatchResult struct {
+	Index  int
+	Output *EncryptOutput
+	Err    error
+}
+
+// EncryptBatchOutput contains one result per input, in the input order.
+type EncryptBatchOutput struct {
+	Results []EncryptBatchResult
+}
+
+// EncryptBatch encrypts a slice of payloads. If ctx is cancelled, the context
+// error is returned and the items that were not processed carry it.
+func (k *KMS) EncryptBatch(ctx context.Context, input *EncryptBatchInput) (*EncryptBatchOutput, error) {
+	if input == nil {
+		input = &EncryptBatchInput{}
+	}
+
+	results := make([]EncryptBatchResult, len(input.Inputs))
+	for i := range results {
+		results[i].Index = i
+	}
+
+	for r := range k.EncryptBatchChannel(ctx, sliceToChannel(input.Inputs), input.Options) {
+		results[r.Index] = r
+	}
+
+	return &EncryptBatchOutput{Results: results}, fillCancelled(ctx, results, func(r *EncryptBatchResult) bool {
+		return r.Output == nil && r.Err == nil
+	}, func(r *EncryptBatchResult, err error) { r.Err = err })
+}
+
+// EncryptBatchChannel encrypts the payloads read from inputs until the channel
+// is closed or ctx is cancelled. The results are sent in the input order; the
+// returned channel is closed once all the items read have been processed. The
+// caller must drain the returned channel.
+func (k *KMS) EncryptBatchChannel(ctx context.Context, inputs <-chan *EncryptInput, options BatchOptions) <-chan EncryptBatchResult {
+
+	process := func(ctx context.Context, items []*EncryptInput) ([]*EncryptOutput, []error) {
+		if k.Endpoints.EncryptBatchRoute == "" {
+			output, err := k.EncryptWithContext(ctx, items[0])
+			return []*EncryptOutput{output}, []error{err}
+		}
+		return k.encryptBatchRequest(ctx, items)
+	}
+
+	return toEncryptResults(runBatch(ctx, inputs, k.batchSize(k.Endpoints.EncryptBatchRoute, options), options.Concurrency, process))
+}
+
+// encryptBatchRequest sends a group of items to the server-side batch route.
+func (k *KMS) encryptBatchRequest(ctx context.Context, items []*EncryptInput) ([]*EncryptOutput, []error) {
+	outputs := make([]*EncryptOutput, len(items))
+	errs := make([]error, len(items))
+
+	var valid []*EncryptInput
+	var positions []int
+
+	// Each item is validated, normalized and completed with the mandatory context
+	for i, item := range items {
+		req, _ := k.encryptRequest(item)
+		if req.Error != nil {
+			errs[i] = errors.Wrap(req.Error, "bad request")
+			continue
+		}
+		valid = append(valid, req.Parameters.(*EncryptInput))
+		positions = append(positions, i)
+	}
+
+	if len(valid) == 0 {
+		return outputs, errs
+	}
+
+	raw, err := k.sendBatch(ctx, opEncryptBatch, k.Endpoints.EncryptBatchRoute, valid, len(valid))
+
+	for j, i := range positions {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		outputs[i] = &EncryptOutput{}
+		errs[i] = decodeBatchItem(raw[j], outputs[i], &outputs[i].Success, &outputs[i].Error)
+	}
+
+	return outputs, errs
+}
+
+// DecryptBatchInput contains the payloads to be decrypted by DecryptBatch.
+type DecryptBatchInput struct {
+	Inputs  []*DecryptInput
+	Options BatchOptions
+}
+
+// DecryptBatchResult is the result of one item of a batch. Index is the
+// position of the item in the input slice or channel. An error affecting one
+// item does not abort the batch.
+type DecryptBatchResult struct {
+	Index  int
+	Output *DecryptOutput
+	Err    error
+}
+
+// DecryptBatchOutput contains one result per input, in the input order.
+type DecryptBatchOutput struct {
+	Results []DecryptBatchResult
+}
+
+// DecryptBatch decrypts a slice of payloads. If ctx is cancelled, the context
+// error is returned and the items that were not processed carry it.
+func (k *KMS) DecryptBatch(ctx context.Context, input *DecryptBatchInput) (*DecryptBatchOutput, error) {
+	if input == nil {
+		input = &DecryptBatchInput{}
+	}
+
+	results := make([]DecryptBatchResult, len(input.Inputs))
+	for i := range results {
+		results[i].Index = i
+	}
+
+	for r := range k.DecryptBatchChannel(ctx, sliceToChannel(input.Inputs), input.Options) {
+		results[r.Index] = r
+	}
+
+	return &DecryptBatchOutput{Results: results}, fillCancelled(ctx, results, func(r *DecryptBatchResult) bool {
+		return r.Output == nil && r.Err == nil
+	}, func(r *DecryptBatchResult, err error) { r.Err = err })
+}
+
+// DecryptBatchChannel decrypts the payloads read from inputs until the channel
+// is closed or ctx is cancelled. The results are sent in the input order; the
+// returned channel is closed once all the items read have been processed. The
+// caller must drain the returned channel.
+func (k *KMS) DecryptBatchChannel(ctx context.Context, inputs <-chan *DecryptInput, options BatchOptions) <-chan DecryptBatchResult {
+
+	process := func(ctx context.Context, items []*DecryptInput) ([]*DecryptOutput, []error) {
+		if k.Endpoints.DecryptBatchRoute == "" {
+			output, err := k.DecryptWithContext(ctx, items[0])
+			return []*DecryptOutput{output}, []error{err}
+		}
+		return k.decryptBatchRequest(ctx, items)
+	}
+
+	return toDecryptResults(runBatch(ctx, inputs, k.batchSize(k.Endpoints.DecryptBatchRoute, options), options.Concurrency, process))
+}
+
+// decryptBatchRequest sends a group of items to the server-side batch route.
+func (k *KMS) decryptBatchRequest(ctx context.Context, items []*DecryptInput) ([]*DecryptOutput, []error) {
+	outputs := make([]*DecryptOutput, len(items))
+	errs := make([]error, len(items))
+
+	var valid []*DecryptInput
+	var positions []int
+
+	// Each item is validated, normalized and completed with the mandatory context
+	for i, item := range items {
+		req, _ := k.decryptRequest(item)
+		if req.Error != nil {
+			errs[i] = errors.Wrap(req.Error, "bad request")
+			continue
+		}
+		valid = append(valid, req.Parameters.(*DecryptInput))
+		positions = append(positions, i)
+	}
+
+	if len(valid) == 0 {
+		return outputs, errs
+	}
+
+	raw, err := k.sendBatch(ctx, opDecryptBatch, k.Endpoints.DecryptBatchRoute, valid, len(valid))
+
+	for j, i := range positions {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		outputs[i] = &DecryptOutput{}
+		errs[i] = decryptError(decodeBatchItem(raw[j], outputs[i], &outputs[i].Success, &outputs[i].Error), outputs[i].Error)
+	}
+
+	return outputs, errs
+}
+
+// batchRequest is the body sent to a server-side batch route
+type batchRequest struct {
+	Items interface{} `json:"items"`
+}
+
+// batchResponse is the body returned by a server-side batch route. The items
+// are decoded and validated one by one so that an error affecting one item
+// does not fail the whole batch.
+type batchResponse struct {
+	Success bool `json:"success"`
+	Result  struct {
+		Items []json.RawMessage `json:"items"`
+	} `json:"result"`
+	TargetURL           *string `json:"targetUrl"`
+	Error               *string `json:"error"`
+	UnauthorizedRequest bool    `json:"unAuthorizedRequest"`
+	ABP                 bool    `json:"__abp"`
+}
+
+// sendBatch posts the items to a batch route and returns one raw output per item.
+func (k *KMS) sendBatch(ctx context.Context, name, route string, items interface{}, count int) ([]json.RawMessage, error) {
+
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: http.MethodPost,
+		BaseURL:    k.Endpoints.baseURL(),
+		Route:      route,
+	}
+
+	output := &batchResponse{}
+	req := k.newRequest(op, &batchRequest{Items: items}, output)
+	req.SetContext(ctx)
+
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+
+	if len(output.Result.Items) != count {
+		return nil, fmt.Errorf("server error: expected %d items, got %d", count, len(output.Result.Items))
+	}
+
+	return output.Result.Items, nil
+}
+
+// decodeBatchItem deserializes and validates one item of a batch response.
+func decodeBatchItem(raw json.RawMessage, output interface{}, success *bool, serverError **string) error {
+	if err := json.Unmarshal(raw, output); err != nil {
+		return errors.Wrap(err, "failed to decode response body")
+	}
+
+	if !*success && *serverError != nil {
+		return fmt.Errorf("request failed: %s", **serverError)
+	}
+
+	if err := validator.Validate(output); err != nil {
+		return errors.Wrap(err, "server error")
+	}
+
+	return nil
+}
+
+// batchSize returns the number of items grouped in a request: 1 if the
+// server-side batch route is not configured.
+func (k *KMS) batchSize(route string, options BatchOptions) int {
+	if route == "" {
+		return 1
+	}
+	if options.MaxBatchSize <= 0 {
+		return DefaultMaxBatchSize
+	}
+	return options.MaxBatchSize
+}
+
+// batchResult is the result of one item processed by runBatch
+type batchResult[Out any] struct {
+	index  int
+	output Out
+	err    error
+}
+
+// batchGroup is a set of consecutive items sent in one request. The workers
+// write the results by index and close done.
+type batchGroup[In, Out any] struct {
+	start   int
+	items   []In
+	results []batchResult[Out]
+	done    chan struct{}
+}
+
+// runBatch reads the inputs, groups up to groupSize items that are already
+// available, and processes the groups with at most concurrency workers. The
+// results are emitted in the input order; at most concurrency groups are held
+// while waiting for an earlier one.
+func runBatch[In, Out any](ctx context.Context, inputs <-chan In, groupSize, concurrency int,
+	process func(context.Context, []In) ([]Out, []error)) <-chan batchResult[Out] {
+
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	groups := make(chan *batchGroup[In, Out])
+	pending := make(chan *batchGroup[In, Out], concurrency) // Groups in the input order
+	ordered := make(chan batchResult[Out])
+
+	// Group the inputs
+	go func() {
+		defer close(groups)
+		defer close(pending)
+
+		index := 0
+		for {
+			var group *batchGroup[In, Out]
+
+			select {
+			case <-ctx.Done():
+				return
+			case item, ok := <-inputs:
+				if !ok {
+					return
+				}
+				group = &batchGroup[In, Out]{start: index, items: []In{item}, done: make(chan struct{})}
+			}
+
+			// Add the items already available without waiting
+		fill:
+			for len(group.items) < groupSize {
+				select {
+				case item, ok := <-inputs:
+					if !ok {
+						break fill
+					}
+					group.items = append(group.items, item)
+				default:
+					break fill
+				}
+			}
+
+			index += len(group.items)
+			group.results = make([]batchResult[Out], len(group.items))
+			pending <- group
+			groups <- group
+		}
+	}()
+
+	// Process the groups
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for group := range groups {
+				var outputs []Out
+				var errs []error
+
+				if err := ctx.Err(); err != nil {
+					outputs = make([]Out, len(group.items))
+					errs = make([]error, len(group.items))
+					for i := range errs {
+						errs[i] = err
+					}
+				} else {
+					outputs, errs = process(ctx, group.items)
+				}
+
+				for i := range group.items {
+					group.results[i] = batchResult[Out]{index: group.start + i, output: outputs[i], err: errs[i]}
+				}
+				close(group.done)
+			}
+		}()
+	}
+
+	// Emit the results in the input order
+	go func() {
+		defer close(ordered)
+
+		for group := range pending {
+			<-group.done
+			for _, r := range group.results {
+				ordered <- r
+			}
+		}
+	}()
+
+	return ordered
+}
+
+func toEncryptResults(results <-chan batchResult[*EncryptOutput]) <-chan EncryptBatchResult {
+	out := make(chan EncryptBatchResult)
+	go func() {
+		defer close(out)
+		for r := range results {
+			out <- EncryptBatchResult{Index: r.index, Output: r.output, Err: r.err}
+		}
+	}()
+	return out
+}
+
+func toDecryptResults(results <-chan batchResult[*DecryptOutput]) <-chan DecryptBatchResult {
+	out := make(chan DecryptBatchResult)
+	go func() {
+		defer close(out)
+		for r := range results {
+			out <- DecryptBatchResult{Index: r.index, Output: r.output, Err: r.err}
+		}
+	}()
+	return out
+}
+
+func sliceToChannel[In any](inputs []In) <-chan In {
+	ch := make(chan In, len(inputs))
+	for _, input := range inputs {
+		ch <- input
+	}
+	close(ch)
+	return ch
+}
+
+// fillCancelled sets the context error on the results that were never
+// produced and returns the context error, if any.
+func fillCancelled[R any](ctx context.Context, results []R, missing func(*R) bool, setErr func(*R, error)) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+
+	for i := range results {
+		if missing(&results[i]) {
+			setErr(&results[i], err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,285 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	encryptBatchRoute = "/api/services/app/Keys/CreateEncryptBatchRequest"
+	decryptBatchRoute = "/api/services/app/Keys/CreateDecryptBatchRequest"
+)
+
+func newBatchInputs(n int) []*EncryptInput {
+	inputs := make([]*EncryptInput, n)
+	for i := range inputs {
+		inputs[i] = &EncryptInput{
+			KeyID:   "key",
+			VaultID: "vault",
+			Payload: []byte(fmt.Sprintf("payload %d", i)),
+		}
+	}
+	return inputs
+}
+
+func TestEncryptDecryptBatch(t *testing.T) {
+
+	var inFlight, maxInFlight int32
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		payload, _ := ioutil.ReadAll(r.Body)
+
+		var body []byte
+		var err error
+		switch r.RequestURI {
+		case encryptRoute:
+			body, err = mockEncrypt(payload)
+		case decryptRoute:
+			body, err = mockDecrypt(payload)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer mockServer.Close()
+
+	endpoints := Endpoints{
+		BaseURL:      mockServer.URL,
+		EncryptRoute: encryptRoute,
+		DecryptRoute: decryptRoute,
+	}
+
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+	inputs := newBatchInputs(20)
+	inputs[7].KeyID = "" // Invalid item
+
+	eOutput, err := kmsClient.EncryptBatch(context.Background(), &EncryptBatchInput{
+		Inputs:  inputs,
+		Options: BatchOptions{Concurrency: 3},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, eOutput.Results, len(inputs))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+
+	var dInputs []*DecryptInput
+	for i, r := range eOutput.Results {
+		assert.Equal(t, i, r.Index)
+		if i == 7 {
+			assert.Error(t, r.Err, "the invalid item should fail")
+			continue
+		}
+		assert.NoError(t, r.Err)
+		dInputs = append(dInputs, &DecryptInput{KeyID: "key", VaultID: "vault", Payload: r.Output.Result.EncryptedPayload})
+	}
+
+	dOutput, err := kmsClient.DecryptBatch(context.Background(), &DecryptBatchInput{Inputs: dInputs})
+	assert.NoError(t, err)
+
+	j := 0
+	for i := range inputs {
+		if i == 7 {
+			continue
+		}
+		assert.NoError(t, dOutput.Results[j].Err)
+		assert.Equal(t, inputs[i].Payload, dOutput.Results[j].Output.Result.Payload)
+		j++
+	}
+}
+
+func TestEncryptBatchRoute(t *testing.T) {
+
+	var requests int32
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if r.RequestURI != encryptBatchRoute {
+			t.Errorf("unexpected route: %s", r.RequestURI)
+		}
+
+		var body struct {
+			Items []EncryptInput `json:"items"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		var response batchResponse
+		response.Success = true
+		for _, item := range body.Items {
+			output := EncryptOutput{Success: true}
+			output.Result.KeyID = item.KeyID
+			output.Result.EncryptedPayload = string(item.Payload)
+			if string(item.Payload) == "payload 3" {
+				msg := "key disabled"
+				output = EncryptOutput{Success: false, Error: &msg}
+			}
+			raw, _ := json.Marshal(output)
+			response.Result.Items = append(response.Result.Items, raw)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	endpoints := Endpoints{
+		BaseURL:           mockServer.URL,
+		EncryptBatchRoute: encryptBatchRoute,
+	}
+
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+	inputs := newBatchInputs(10)
+	output, err := kmsClient.EncryptBatch(context.Background(), &EncryptBatchInput{
+		Inputs:  inputs,
+		Options: BatchOptions{MaxBatchSize: 4},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "10 items should be sent in 3 requests")
+
+	for i, r := range output.Results {
+		if i == 3 {
+			assert.EqualError(t, r.Err, "request failed: key disabled")
+			continue
+		}
+		assert.NoError(t, r.Err)
+		assert.Equal(t, string(inputs[i].Payload), r.Output.Result.EncryptedPayload)
+	}
+}
+
+func TestBatchRouteLegacyAlgorithm(t *testing.T) {
+
+	var algorithms []Algorithm
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Items []struct {
+				Algorithm Algorithm `json:"algorithm"`
+			} `json:"items"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		var response batchResponse
+		response.Success = true
+		for _, item := range body.Items {
+			algorithms = append(algorithms, item.Algorithm)
+			raw, _ := json.Marshal(EncryptOutput{Success: true})
+			response.Result.Items = append(response.Result.Items, raw)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	endpoints := Endpoints{
+		BaseURL:           mockServer.URL,
+		EncryptBatchRoute: encryptBatchRoute,
+		DecryptBatchRoute: decryptBatchRoute,
+	}
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+	encryptInput := &EncryptInput{KeyID: "key", VaultID: "vault", Algorithm: "3", Payload: []byte("Lorem ipsum")}
+	_, err := kmsClient.EncryptBatch(context.Background(), &EncryptBatchInput{Inputs: []*EncryptInput{encryptInput}})
+	assert.NoError(t, err)
+
+	decryptInput := &DecryptInput{KeyID: "key", VaultID: "vault", Algorithm: "3", Payload: "TG9yZW0gaXBzdW0="}
+	_, err = kmsClient.DecryptBatch(context.Background(), &DecryptBatchInput{Inputs: []*DecryptInput{decryptInput}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Algorithm{AlgorithmRSAOAEP256, AlgorithmRSAOAEP256}, algorithms, "legacy identifiers are translated as on the single-item routes")
+	assert.Equal(t, Algorithm("3"), encryptInput.Algorithm, "the caller's inputs are left as is")
+	assert.Equal(t, Algorithm("3"), decryptInput.Algorithm)
+}
+
+func TestEncryptBatchCancelled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer mockServer.Close()
+
+	endpoints := Endpoints{
+		BaseURL:      mockServer.URL,
+		EncryptRoute: encryptRoute,
+	}
+
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+	inputs := newBatchInputs(50)
+	output, err := kmsClient.EncryptBatch(ctx, &EncryptBatchInput{
+		Inputs:  inputs,
+		Options: BatchOptions{Concurrency: 2},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, output.Results, len(inputs))
+	for _, r := range output.Results {
+		assert.Error(t, r.Err)
+	}
+}
+
+func TestRunBatchBoundsReordering(t *testing.T) {
+
+	const concurrency = 2
+
+	inputs := make(chan int, 20)
+	for i := 0; i < cap(inputs); i++ {
+		inputs <- i
+	}
+	close(inputs)
+
+	release := make(chan struct{})
+	var calls int32
+
+	results := runBatch(context.Background(), inputs, 1, concurrency, func(_ context.Context, items []int) ([]int, []error) {
+		atomic.AddInt32(&calls, 1)
+		if items[0] == 0 {
+			<-release
+		}
+		return items, make([]error, len(items))
+	})
+
+	// While the first group is blocked, only the groups that can be held for
+	// reordering are processed
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&calls), int32(concurrency+1))
+	close(release)
+
+	next := 0
+	for r := range results {
+		assert.Equal(t, next, r.index)
+		assert.Equal(t, next, r.output)
+		next++
+	}
+	assert.Equal(t, cap(inputs), next)
+}
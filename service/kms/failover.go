@@ -0,0 +1,371 @@
+package kms
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+)
+
+// Defaults of FailoverConfig
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+)
+
+// Names of the failover handlers
+const (
+	selectEndpointHandlerName = "kms.SelectEndpoint"
+	failoverHandlerName       = "kms.Failover"
+	recordEndpointHandlerName = "kms.RecordEndpoint"
+)
+
+// Errors of the failover: ErrNoEndpointAvailable is returned when the circuits
+// of all the endpoints are open; ErrCircuitOpen is the reason of the
+// FailoverEvent when the circuit of an endpoint is open.
+var (
+	ErrNoEndpointAvailable = errors.New("no endpoint available: all circuits are open")
+	ErrCircuitOpen         = errors.New("circuit open")
+)
+
+// nonIdempotentOperations are never replayed against another endpoint once
+// they may have reached a server
+var nonIdempotentOperations = map[string]bool{
+	opImport: true,
+}
+
+// FailoverConfig configures the circuit breakers of the endpoints listed in
+// Endpoints.BaseURLs. The circuit of an endpoint opens after FailureThreshold
+// consecutive failures (network errors, timeouts and 5xx responses): the
+// endpoint is skipped for OpenTimeout, then a single request probes it
+// (half-open) and closes the circuit if it succeeds.
+type FailoverConfig struct {
+	FailureThreshold int           `mapstructure:"failure-threshold"`
+	OpenTimeout      time.Duration `mapstructure:"open-timeout"`
+
+	// OnFailover is called when the requests move to another endpoint,
+	// including back to a preferred one (optional)
+	OnFailover func(FailoverEvent) `mapstructure:"-"`
+	// OnBreakerStateChange is called when a circuit changes state (optional)
+	OnBreakerStateChange func(BreakerEvent) `mapstructure:"-"`
+}
+
+// FailoverEvent reports that the requests moved from an endpoint to another
+type FailoverEvent struct {
+	Operation string // Operation of the first request sent to To
+	From      string
+	To        string
+	Err       error // Failure of From, nil when moving back to a preferred endpoint
+}
+
+// BreakerState is the state of the circuit breaker of an endpoint
+type BreakerState int
+
+// States of a circuit breaker
+const (
+	BreakerClosed   BreakerState = iota // The requests are sent to the endpoint
+	BreakerOpen                         // The endpoint is skipped
+	BreakerHalfOpen                     // A single request probes the endpoint
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerEvent reports a change of state of the circuit of an endpoint
+type BreakerEvent struct {
+	BaseURL string
+	From    BreakerState
+	To      BreakerState
+}
+
+// baseURL returns the preferred base URL
+func (e *Endpoints) baseURL() string {
+	if urls := e.baseURLs(); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// baseURLs returns BaseURL followed by BaseURLs
+func (e *Endpoints) baseURLs() []string {
+	if e.BaseURL == "" {
+		return e.BaseURLs
+	}
+	return append([]string{e.BaseURL}, e.BaseURLs...)
+}
+
+// endpointSet holds the circuit breakers of the endpoints, shared by the
+// requests of a KMS client
+type endpointSet struct {
+	urls     []string
+	breakers []*breaker
+	config   FailoverConfig
+	now      func() time.Time
+
+	mu     sync.Mutex
+	active int // Endpoint of the last request
+}
+
+func newEndpointSet(urls []string, config FailoverConfig, now func() time.Time) *endpointSet {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultOpenTimeout
+	}
+
+	s := &endpointSet{urls: urls, config: config, now: now}
+	for range urls {
+		s.breakers = append(s.breakers, &breaker{})
+	}
+	return s
+}
+
+// newRequest returns a request sent to the endpoints of the client
+func (k *KMS) newRequest(op *request.Operation, params interface{}, output interface{}) *request.Request {
+	req := k.NewRequest(op, params, output)
+	switch {
+	case k.endpointSet != nil:
+		k.endpointSet.attach(req)
+	case len(k.Endpoints.BaseURLs) > 0 && req.Error == nil:
+		// KMS built as a literal: there are no breakers to share
+		req.Error = errors.New("Endpoints.BaseURLs requires a client created by NewClient, NewClientWithLogger or NewClientWithConfig")
+	}
+	return req
+}
+
+// attempt is the failover state of a request
+type attempt struct {
+	set     *endpointSet
+	current int    // Endpoint of the attempt in progress, -1 if none
+	tried   []bool // Endpoints that failed
+	lastErr error
+}
+
+// attach adds the handlers sending req to the first available endpoint and
+// failing over to the next ones
+func (s *endpointSet) attach(req *request.Request) {
+	a := &attempt{set: s, current: -1, tried: make([]bool, len(s.urls))}
+
+	req.Handlers.Sign.PushFrontNamed(request.NamedHandler{Name: selectEndpointHandlerName, Fn: a.selectEndpoint})
+	req.Handlers.Retry.PushFrontNamed(request.NamedHandler{Name: failoverHandlerName, Fn: a.failover})
+	req.Handlers.Complete.PushFrontNamed(request.NamedHandler{Name: recordEndpointHandlerName, Fn: func(r *request.Request) {
+		a.record(r)
+	}})
+}
+
+// selectEndpoint sends the attempt to the first endpoint in order which has
+// not failed and whose circuit allows it
+func (a *attempt) selectEndpoint(r *request.Request) {
+	s := a.set
+	now := s.now()
+
+	a.current = -1
+	for i, b := range s.breakers {
+		if a.tried[i] {
+			continue
+		}
+		allowed, change := b.allow(now, s.config.OpenTimeout)
+		s.notifyBreaker(i, change)
+		if allowed {
+			a.current = i
+			break
+		}
+		if a.lastErr == nil {
+			a.lastErr = ErrCircuitOpen
+		}
+	}
+
+	if a.current < 0 {
+		r.Error = ErrNoEndpointAvailable
+		return
+	}
+
+	u, err := url.Parse(s.urls[a.current] + r.Operation.Route)
+	if err != nil {
+		a.set.breakers[a.current].cancel()
+		a.current = -1
+		r.Error = errors.Wrap(err, "invalid endpoint")
+		return
+	}
+	u.RawQuery = r.HTTPRequest.URL.RawQuery
+	r.HTTPRequest.URL = u
+	r.HTTPRequest.Host = ""
+
+	s.mu.Lock()
+	from := s.active
+	s.active = a.current
+	s.mu.Unlock()
+
+	if from != a.current && s.config.OnFailover != nil {
+		event := FailoverEvent{Operation: r.Operation.Name, From: s.urls[from], To: s.urls[a.current]}
+		if a.current > from {
+			event.Err = a.lastErr
+		}
+		s.config.OnFailover(event)
+	}
+}
+
+// failover records the failed attempt and, if the endpoint failed, retries
+// the request on the next endpoint. The non-idempotent operations are only
+// retried if the connection could not be established.
+func (a *attempt) failover(r *request.Request) {
+	failed := a.current >= 0 && endpointFailure(r)
+	a.record(r)
+	if !failed || r.HTTPRequest.Context().Err() != nil {
+		return
+	}
+	if nonIdempotentOperations[r.Operation.Name] && !dialError(r.Error) {
+		return
+	}
+
+	for i := range a.tried {
+		if !a.tried[i] {
+			r.Retryable = true
+			return
+		}
+	}
+}
+
+// record reports the outcome of the attempt in progress to the circuit breaker
+// of its endpoint
+func (a *attempt) record(r *request.Request) {
+	if a.current < 0 {
+		return
+	}
+	i := a.current
+	a.current = -1
+
+	b := a.set.breakers[i]
+	switch {
+	case endpointFailure(r):
+		a.tried[i] = true
+		a.lastErr = r.Error
+		a.set.notifyBreaker(i, b.failure(a.set.now(), a.set.config.FailureThreshold))
+	case r.HTTPResponse == nil && r.Error != nil:
+		// Not sent, or canceled by the caller: the health is unknown
+		b.cancel()
+	case r.HTTPResponse != nil && r.HTTPResponse.StatusCode == http.StatusTooManyRequests:
+		// Throttled: the endpoint is up but does not show that it can serve
+		b.cancel()
+	default:
+		a.set.notifyBreaker(i, b.success())
+	}
+}
+
+func (s *endpointSet) notifyBreaker(i int, change *BreakerEvent) {
+	if change != nil && s.config.OnBreakerStateChange != nil {
+		change.BaseURL = s.urls[i]
+		s.config.OnBreakerStateChange(*change)
+	}
+}
+
+// endpointFailure reports whether the attempt failed because of its endpoint:
+// network error, timeout or 5xx response. A request canceled by the caller
+// does not count.
+func endpointFailure(r *request.Request) bool {
+	if r.Error == nil {
+		return false
+	}
+	if r.HTTPResponse != nil {
+		return r.HTTPResponse.StatusCode >= http.StatusInternalServerError
+	}
+
+	var urlErr *url.Error
+	return errors.As(r.Error, &urlErr) && !errors.Is(r.Error, context.Canceled)
+}
+
+// dialError reports whether err occurred while connecting to the server, i.e.
+// before the request could be sent
+func dialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// breaker is the circuit breaker of an endpoint
+type breaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // Consecutive failures
+	openedAt time.Time // When the circuit opened
+	probing  bool      // A half-open probe is in flight
+}
+
+// allow reports whether a request can be sent to the endpoint
+func (b *breaker) allow(now time.Time, openTimeout time.Duration) (bool, *BreakerEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < openTimeout {
+			return false, nil
+		}
+		b.probing = true
+		return true, b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, nil
+		}
+		b.probing = true
+	}
+	return true, nil
+}
+
+// success closes the circuit
+func (b *breaker) success() *BreakerEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	return b.setState(BreakerClosed)
+}
+
+// failure opens the circuit after threshold consecutive failures, or if the
+// probe failed
+func (b *breaker) failure(now time.Time, threshold int) *BreakerEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		b.openedAt = now
+		return b.setState(BreakerOpen)
+	}
+	return nil
+}
+
+// cancel ends an attempt whose outcome is unknown
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// setState changes the state and returns the change, nil if the state is
+// unchanged. b.mu must be held.
+func (b *breaker) setState(state BreakerState) *BreakerEvent {
+	if b.state == state {
+		return nil
+	}
+	event := &BreakerEvent{From: b.state, To: state}
+	b.state = state
+	return event
+}
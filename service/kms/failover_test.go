@@ -0,0 +1,292 @@
+package kms
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const importRoute = "/api/services/app/Keys/Import"
+
+// node is a mock DuoKey node which can be made unavailable
+type node struct {
+	*httptest.Server
+	status int32 // Status of the replies, 0 if healthy
+	calls  int32
+}
+
+func newNode(t *testing.T) *node {
+	n := &node{}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n.calls, 1)
+		if status := atomic.LoadInt32(&n.status); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+
+		payload, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case encryptRoute:
+			body, err := mockEncrypt(payload)
+			require.NoError(t, err)
+			w.Write(body)
+		case importRoute:
+			w.Write([]byte(`{"success":true,"result":{"keyid":"imported"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return n
+}
+
+func (n *node) setStatus(status int) {
+	atomic.StoreInt32(&n.status, int32(status))
+}
+
+func (n *node) Calls() int {
+	return int(atomic.LoadInt32(&n.calls))
+}
+
+// eventRecorder records the failover and breaker events
+type eventRecorder struct {
+	mu        sync.Mutex
+	failovers []FailoverEvent
+	breakers  []BreakerEvent
+}
+
+func (e *eventRecorder) config(threshold int, openTimeout time.Duration) FailoverConfig {
+	return FailoverConfig{
+		FailureThreshold: threshold,
+		OpenTimeout:      openTimeout,
+		OnFailover: func(event FailoverEvent) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.failovers = append(e.failovers, event)
+		},
+		OnBreakerStateChange: func(event BreakerEvent) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.breakers = append(e.breakers, event)
+		},
+	}
+}
+
+func newFailoverClient(urls []string, failover FailoverConfig) *KMS {
+	endpoints := Endpoints{
+		BaseURLs:     urls,
+		Failover:     failover,
+		EncryptRoute: encryptRoute,
+		ImportRoute:  importRoute,
+	}
+	creds := credentials.Config{HeaderTenantID: "Abp.TenantId", TenantID: 1}
+
+	return newClientWithMockServer(creds, endpoints, &http.Client{Timeout: time.Second})
+}
+
+func TestFailover(t *testing.T) {
+
+	primary, secondary := newNode(t), newNode(t)
+	defer primary.Close()
+	defer secondary.Close()
+
+	events := &eventRecorder{}
+	kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, events.config(2, 100*time.Millisecond))
+	input := &EncryptInput{KeyID: "key", VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	_, err := kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	assert.Equal(t, 1, primary.Calls())
+
+	// The requests fail over to the secondary node, until the circuit of the
+	// primary one opens
+	primary.setStatus(http.StatusServiceUnavailable)
+	for i := 0; i < 4; i++ {
+		_, err = kmsClient.Encrypt(input)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, primary.Calls(), "skipped once the circuit is open")
+	assert.Equal(t, 4, secondary.Calls())
+
+	require.NotEmpty(t, events.failovers)
+	first := events.failovers[0]
+	assert.Equal(t, primary.URL, first.From)
+	assert.Equal(t, secondary.URL, first.To)
+	var errResp *request.ErrorResponse
+	require.ErrorAs(t, first.Err, &errResp)
+	assert.Equal(t, http.StatusServiceUnavailable, errResp.StatusCode)
+	assert.Equal(t, []BreakerEvent{{BaseURL: primary.URL, From: BreakerClosed, To: BreakerOpen}}, events.breakers)
+
+	// Once the primary node is back, a probe closes its circuit
+	primary.setStatus(0)
+	time.Sleep(150 * time.Millisecond)
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	assert.Equal(t, 4, primary.Calls())
+
+	last := events.failovers[len(events.failovers)-1]
+	assert.Equal(t, FailoverEvent{Operation: opEncrypt, From: secondary.URL, To: primary.URL}, last)
+	assert.Equal(t, []BreakerEvent{
+		{BaseURL: primary.URL, From: BreakerClosed, To: BreakerOpen},
+		{BaseURL: primary.URL, From: BreakerOpen, To: BreakerHalfOpen},
+		{BaseURL: primary.URL, From: BreakerHalfOpen, To: BreakerClosed},
+	}, events.breakers)
+}
+
+func TestFailoverSharedBreakers(t *testing.T) {
+
+	primary, secondary := newNode(t), newNode(t)
+	defer primary.Close()
+	defer secondary.Close()
+	primary.setStatus(http.StatusServiceUnavailable)
+	input := &EncryptInput{KeyID: "key", VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	// A copy of the client shares its circuit breakers
+	kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, FailoverConfig{FailureThreshold: 1, OpenTimeout: time.Hour})
+	copied := *kmsClient
+	_, err := kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	_, err = copied.Encrypt(input)
+	require.NoError(t, err)
+	assert.Equal(t, 1, primary.Calls(), "skipped by the copy once the circuit is open")
+
+	// A client built as a literal has no breakers to share
+	literal := &KMS{Client: kmsClient.Client, Endpoints: kmsClient.Endpoints}
+	_, err = literal.Encrypt(input)
+	assert.ErrorContains(t, err, "Endpoints.BaseURLs requires a client created by NewClient")
+	assert.Equal(t, 1, primary.Calls())
+	assert.Equal(t, 2, secondary.Calls())
+}
+
+func TestFailoverThrottled(t *testing.T) {
+
+	primary, secondary := newNode(t), newNode(t)
+	defer primary.Close()
+	defer secondary.Close()
+	primary.setStatus(http.StatusServiceUnavailable)
+
+	events := &eventRecorder{}
+	kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, events.config(1, 10*time.Millisecond))
+	input := &EncryptInput{KeyID: "key", VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	_, err := kmsClient.Encrypt(input)
+	require.NoError(t, err)
+
+	// A throttled probe does not close the circuit: the next request probes
+	// the endpoint again
+	primary.setStatus(http.StatusTooManyRequests)
+	time.Sleep(20 * time.Millisecond)
+	_, err = kmsClient.Encrypt(input)
+	var errResp *request.ErrorResponse
+	require.ErrorAs(t, err, &errResp)
+	assert.Equal(t, http.StatusTooManyRequests, errResp.StatusCode)
+	events.mu.Lock()
+	assert.Len(t, events.breakers, 2, "still half-open")
+	events.mu.Unlock()
+
+	primary.setStatus(0)
+	_, err = kmsClient.Encrypt(input)
+	require.NoError(t, err)
+	assert.Equal(t, 3, primary.Calls())
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	assert.Equal(t, []BreakerEvent{
+		{BaseURL: primary.URL, From: BreakerClosed, To: BreakerOpen},
+		{BaseURL: primary.URL, From: BreakerOpen, To: BreakerHalfOpen},
+		{BaseURL: primary.URL, From: BreakerHalfOpen, To: BreakerClosed},
+	}, events.breakers)
+}
+
+func TestFailoverNonIdempotent(t *testing.T) {
+
+	secondary := newNode(t)
+	defer secondary.Close()
+
+	t.Run("Not replayed once sent", func(t *testing.T) {
+		primary := newNode(t)
+		defer primary.Close()
+		primary.setStatus(http.StatusBadGateway)
+
+		kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, FailoverConfig{})
+		_, err := kmsClient.Import(&ImportInput{VaultID: "vault", Payload: []byte("key")})
+
+		var errResp *request.ErrorResponse
+		require.ErrorAs(t, err, &errResp)
+		assert.Equal(t, http.StatusBadGateway, errResp.StatusCode)
+		assert.Zero(t, secondary.Calls())
+	})
+
+	t.Run("Replayed if the connection failed", func(t *testing.T) {
+		primary := newNode(t)
+		primary.Close()
+
+		kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, FailoverConfig{})
+		output, err := kmsClient.Import(&ImportInput{VaultID: "vault", Payload: []byte("key")})
+		require.NoError(t, err)
+		assert.Equal(t, "imported", output.Result.KeyID)
+		assert.Equal(t, 1, secondary.Calls())
+	})
+}
+
+func TestFailoverNoEndpointAvailable(t *testing.T) {
+
+	primary, secondary := newNode(t), newNode(t)
+	defer primary.Close()
+	defer secondary.Close()
+	primary.setStatus(http.StatusInternalServerError)
+	secondary.setStatus(http.StatusInternalServerError)
+
+	kmsClient := newFailoverClient([]string{primary.URL, secondary.URL}, FailoverConfig{FailureThreshold: 1, OpenTimeout: time.Hour})
+	input := &EncryptInput{KeyID: "key", VaultID: "vault", Payload: []byte("Lorem ipsum")}
+
+	_, err := kmsClient.Encrypt(input)
+	var errResp *request.ErrorResponse
+	require.ErrorAs(t, err, &errResp, "the error of the last endpoint")
+
+	_, err = kmsClient.Encrypt(input)
+	assert.True(t, errors.Is(err, ErrNoEndpointAvailable))
+	assert.Equal(t, 1, primary.Calls())
+	assert.Equal(t, 1, secondary.Calls())
+}
+
+func TestBreaker(t *testing.T) {
+
+	start := time.Unix(0, 0)
+	b := &breaker{}
+
+	allowed, _ := b.allow(start, time.Minute)
+	assert.True(t, allowed)
+	assert.Nil(t, b.failure(start, 2))
+	assert.Equal(t, &BreakerEvent{From: BreakerClosed, To: BreakerOpen}, b.failure(start, 2))
+
+	allowed, _ = b.allow(start.Add(30*time.Second), time.Minute)
+	assert.False(t, allowed, "open")
+
+	// A single probe at a time
+	allowed, change := b.allow(start.Add(time.Minute), time.Minute)
+	assert.True(t, allowed)
+	assert.Equal(t, &BreakerEvent{From: BreakerOpen, To: BreakerHalfOpen}, change)
+	allowed, _ = b.allow(start.Add(time.Minute), time.Minute)
+	assert.False(t, allowed)
+
+	// A canceled probe lets another one through
+	b.cancel()
+	allowed, _ = b.allow(start.Add(time.Minute), time.Minute)
+	assert.True(t, allowed)
+
+	// A failed probe opens the circuit again
+	assert.Equal(t, &BreakerEvent{From: BreakerHalfOpen, To: BreakerOpen}, b.failure(start.Add(time.Minute), 2))
+	allowed, _ = b.allow(start.Add(90*time.Second), time.Minute)
+	assert.False(t, allowed)
+}
@@ -0,0 +1,422 @@
+// Package kmscache provides a client-side cache of data keys for envelope
+// encryption. Data keys are generated locally and wrapped by DuoKey; the
+// cache reuses generated keys and decrypted (unwrapped) keys to avoid a
+// round trip to the DuoKey server for every message.
+package kmscache
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/duokey"
+	"github.com/duokey/duokey-sdk-go/internal/sensitive"
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/duokey/duokey-sdk-go/service/kms/kmsiface"
+)
+
+const defaultKeySize = 32 // AES-256
+
+// Config stores the limits of the cache. A zero limit means no limit, except
+// for MaxEntries which defaults to DefaultMaxEntries.
+type Config struct {
+	MaxAge      time.Duration // Maximum lifetime of an entry
+	MaxMessages uint64        // Maximum number of messages encrypted with a generated key
+	MaxBytes    uint64        // Maximum number of bytes encrypted with a generated key
+	MaxEntries  int           // Maximum number of entries (least recently used are evicted)
+
+	// Logger receives cache misses and evictions (optional)
+	Logger duokey.Logger
+	// OnEvent is called on every cache hit, miss and eviction (optional). It
+	// is called without holding the cache lock and may use the cache.
+	OnEvent func(Event)
+}
+
+// DefaultMaxEntries is used when Config.MaxEntries is not set
+const DefaultMaxEntries = 1000
+
+// EventType identifies a cache event
+type EventType int
+
+const (
+	EventHit EventType = iota
+	EventMiss
+	EventEviction
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventEviction:
+		return "eviction"
+	}
+	return "unknown"
+}
+
+// Event is reported to Config.OnEvent. Operation is either "GenerateDataKey"
+// or "DecryptDataKey".
+type Event struct {
+	Type      EventType
+	Operation string
+	KeyID     string
+	VaultID   string
+}
+
+// Stats contains the cache counters since its creation
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+const (
+	opGenerateDataKey = "GenerateDataKey"
+	opDecryptDataKey  = "DecryptDataKey"
+)
+
+// GenerateDataKeyInput describes the data key to generate (or to reuse).
+// PlaintextLength is the number of bytes the caller will encrypt with the
+// data key; it is accounted against Config.MaxBytes.
+type GenerateDataKeyInput struct {
+	KeyID           string
+	VaultID         string
+	Algorithm       kms.Algorithm
+	Context         map[string]string
+	KeySize         int // In bytes, 32 by default
+	PlaintextLength uint64
+}
+
+// DataKey contains a plaintext data key and the same key encrypted by DuoKey.
+// EncryptedKey, Iv and Tag must be stored along with the data in order to
+// recover the key with DecryptDataKey.
+type DataKey struct {
+	Plaintext    []byte
+	EncryptedKey string
+	Iv           string
+	Tag          string
+	KeyID        string
+	VaultID      string
+	Algorithm    kms.Algorithm
+}
+
+// Cache wraps a KMS client and caches data keys. It is safe for concurrent use.
+type Cache struct {
+	api    kmsiface.KMSAPI
+	config Config
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Front is the most recently used entry
+	stats   Stats
+	events  []Event // Recorded under c.mu, reported by unlock
+
+	now func() time.Time
+}
+
+type entry struct {
+	id        string
+	operation string
+	keyID     string
+	vaultID   string
+	plaintext []byte
+	dataKey   DataKey // Generated keys only
+	created   time.Time
+	messages  uint64
+	bytes     uint64
+}
+
+// New returns a cache of data keys in front of api.
+func New(api kmsiface.KMSAPI, config Config) *Cache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultMaxEntries
+	}
+
+	return &Cache{
+		api:     api,
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// GenerateDataKey returns a data key wrapped by the given DuoKey key. A cached
+// key is returned as long as it is within the configured limits; otherwise a
+// new key is generated locally and encrypted by DuoKey. The caller should zero
+// DataKey.Plaintext once it is no longer needed.
+func (c *Cache) GenerateDataKey(ctx context.Context, input *GenerateDataKeyInput) (*DataKey, error) {
+	if input == nil {
+		input = &GenerateDataKeyInput{}
+	}
+
+	id := cacheID(opGenerateDataKey, input.KeyID, input.VaultID, string(input.Algorithm.Normalize()), contextString(input.Context))
+
+	c.mu.Lock()
+	if e := c.get(id); e != nil && c.withinUsageLimits(e, input.PlaintextLength) {
+		e.messages++
+		e.bytes += input.PlaintextLength
+		dataKey := e.dataKey
+		dataKey.Plaintext = sensitive.Clone(e.plaintext)
+		c.record(EventHit, opGenerateDataKey, input.KeyID, input.VaultID)
+		c.unlock()
+		return &dataKey, nil
+	}
+	c.record(EventMiss, opGenerateDataKey, input.KeyID, input.VaultID)
+	c.unlock()
+
+	size := input.KeySize
+	if size <= 0 {
+		size = defaultKeySize
+	}
+
+	plaintext := make([]byte, size)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, fmt.Errorf("failed to generate a data key: %w", err)
+	}
+
+	// Copy the context: the KMS client adds the mandatory context to the map
+	eInput := &kms.EncryptInput{
+		KeyID:     input.KeyID,
+		VaultID:   input.VaultID,
+		Algorithm: input.Algorithm,
+		Context:   sensitive.CopyContext(input.Context),
+		Payload:   plaintext,
+	}
+
+	eOutput, err := c.api.EncryptWithContext(ctx, eInput)
+	if err != nil {
+		sensitive.Zero(plaintext)
+		return nil, err
+	}
+
+	dataKey := DataKey{
+		EncryptedKey: eOutput.Result.EncryptedPayload,
+		Iv:           eOutput.Result.Iv,
+		Tag:          eOutput.Result.Tag,
+		KeyID:        input.KeyID,
+		VaultID:      input.VaultID,
+		Algorithm:    eOutput.Result.Algorithm,
+	}
+
+	// A key that is exhausted by its first message is not cached
+	if (c.config.MaxMessages > 0 && c.config.MaxMessages <= 1) ||
+		(c.config.MaxBytes > 0 && input.PlaintextLength >= c.config.MaxBytes) {
+		dataKey.Plaintext = plaintext
+		return &dataKey, nil
+	}
+
+	c.mu.Lock()
+	c.put(&entry{
+		id:        id,
+		operation: opGenerateDataKey,
+		keyID:     input.KeyID,
+		vaultID:   input.VaultID,
+		plaintext: plaintext,
+		dataKey:   dataKey,
+		created:   c.now(),
+		messages:  1,
+		bytes:     input.PlaintextLength,
+	})
+	c.unlock()
+
+	dataKey.Plaintext = sensitive.Clone(plaintext)
+
+	return &dataKey, nil
+}
+
+// DecryptDataKey returns the plaintext of an encrypted data key. Keys already
+// decrypted are served from the cache until they exceed Config.MaxAge or are
+// evicted. The caller should zero the returned slice once it is no longer
+// needed.
+func (c *Cache) DecryptDataKey(ctx context.Context, input *kms.DecryptInput) ([]byte, error) {
+	if input == nil {
+		input = &kms.DecryptInput{}
+	}
+
+	id := cacheID(opDecryptDataKey, input.KeyID, input.VaultID, string(input.Algorithm.Normalize()),
+		input.Payload, input.Iv, input.Tag, string(input.AAD), contextString(input.Context))
+
+	c.mu.Lock()
+	if e := c.get(id); e != nil {
+		plaintext := sensitive.Clone(e.plaintext)
+		c.record(EventHit, opDecryptDataKey, input.KeyID, input.VaultID)
+		c.unlock()
+		return plaintext, nil
+	}
+	c.record(EventMiss, opDecryptDataKey, input.KeyID, input.VaultID)
+	c.unlock()
+
+	dInput := *input
+	dInput.Context = sensitive.CopyContext(input.Context)
+
+	dOutput, err := c.api.DecryptWithContext(ctx, &dInput)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := sensitive.Clone(dOutput.Result.Payload)
+	sensitive.Zero(dOutput.Result.Payload)
+
+	c.mu.Lock()
+	c.put(&entry{
+		id:        id,
+		operation: opDecryptDataKey,
+		keyID:     input.KeyID,
+		vaultID:   input.VaultID,
+		plaintext: plaintext,
+		created:   c.now(),
+	})
+	c.unlock()
+
+	return sensitive.Clone(plaintext), nil
+}
+
+// Stats returns the cache counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+
+	return stats
+}
+
+// Clear evicts all entries and zeroes the cached keys.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// get returns a live entry and marks it as recently used. Expired entries are
+// evicted. Must be called with c.mu held.
+func (c *Cache) get(id string) *entry {
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+
+	e := elem.Value.(*entry)
+	if c.config.MaxAge > 0 && c.now().Sub(e.created) > c.config.MaxAge {
+		c.evict(elem)
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return e
+}
+
+// withinUsageLimits checks whether a generated key can encrypt one more
+// message of the given length. An exhausted entry is evicted. Must be called
+// with c.mu held.
+func (c *Cache) withinUsageLimits(e *entry, length uint64) bool {
+	if (c.config.MaxMessages > 0 && e.messages+1 > c.config.MaxMessages) ||
+		(c.config.MaxBytes > 0 && e.bytes+length > c.config.MaxBytes) {
+		c.evict(c.entries[e.id])
+		return false
+	}
+
+	return true
+}
+
+// put adds an entry, replacing any entry with the same ID, and evicts the
+// least recently used entries above Config.MaxEntries. Must be called with
+// c.mu held.
+func (c *Cache) put(e *entry) {
+	if elem, ok := c.entries[e.id]; ok {
+		c.evict(elem)
+	}
+
+	c.entries[e.id] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.config.MaxEntries {
+		c.evict(c.lru.Back())
+	}
+}
+
+// evict removes an entry and zeroes its key. Must be called with c.mu held.
+func (c *Cache) evict(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.id)
+	sensitive.Zero(e.plaintext)
+
+	c.record(EventEviction, e.operation, e.keyID, e.vaultID)
+}
+
+// record updates the counters and queues the event. Must be called with c.mu
+// held; the event is reported by unlock.
+func (c *Cache) record(eventType EventType, operation, keyID, vaultID string) {
+	switch eventType {
+	case EventHit:
+		c.stats.Hits++
+	case EventMiss:
+		c.stats.Misses++
+	case EventEviction:
+		c.stats.Evictions++
+	}
+
+	if c.config.Logger != nil || c.config.OnEvent != nil {
+		c.events = append(c.events, Event{Type: eventType, Operation: operation, KeyID: keyID, VaultID: vaultID})
+	}
+}
+
+// unlock releases c.mu and then reports the queued events, so that the logger
+// and Config.OnEvent may call back into the cache.
+func (c *Cache) unlock() {
+	events := c.events
+	c.events = nil
+	c.mu.Unlock()
+
+	for _, event := range events {
+		if c.config.Logger != nil && event.Type != EventHit {
+			c.config.Logger.Infof("data key cache %s (%s)", event.Type, event.Operation)
+		}
+		if c.config.OnEvent != nil {
+			c.config.OnEvent(event)
+		}
+	}
+}
+
+// cacheID hashes the fields identifying an entry. Each field is prefixed by
+// its length to avoid collisions.
+func cacheID(fields ...string) string {
+	h := sha256.New()
+	for _, field := range fields {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write([]byte(field))
+	}
+	return string(h.Sum(nil))
+}
+
+// contextString serializes a context in a deterministic way
+func contextString(context map[string]string) string {
+	keys := make([]string, 0, len(context))
+	for key := range context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		fields = append(fields, key, context[key])
+	}
+
+	return cacheID(fields...)
+}
@@ -0,0 +1,160 @@
+package kmscache
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/duokey/duokey-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubKMS wraps the data keys with base64 and counts the calls. The other
+// operations are not implemented.
+type stubKMS struct {
+	kmsiface.KMSAPI
+	encryptCalls int
+	decryptCalls int
+}
+
+func (s *stubKMS) Encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	return s.EncryptWithContext(context.Background(), input)
+}
+
+func (s *stubKMS) EncryptWithContext(_ context.Context, input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	s.encryptCalls++
+	output := &kms.EncryptOutput{Success: true}
+	output.Result.KeyID = input.KeyID
+	output.Result.EncryptedPayload = base64.StdEncoding.EncodeToString(input.Payload)
+	return output, nil
+}
+
+func (s *stubKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	return s.DecryptWithContext(context.Background(), input)
+}
+
+func (s *stubKMS) DecryptWithContext(_ context.Context, input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	s.decryptCalls++
+	payload, err := base64.StdEncoding.DecodeString(input.Payload)
+	if err != nil {
+		return nil, err
+	}
+	output := &kms.DecryptOutput{Success: true}
+	output.Result.KeyID = input.KeyID
+	output.Result.Payload = payload
+	return output, nil
+}
+
+func TestGenerateDataKeyLimits(t *testing.T) {
+
+	testCases := []struct {
+		name        string
+		config      Config
+		messages    int
+		length      uint64
+		wantCalls   int
+		wantEntries int
+	}{
+		{name: "No limit", config: Config{}, messages: 10, length: 100, wantCalls: 1, wantEntries: 1},
+		{name: "Max messages", config: Config{MaxMessages: 3}, messages: 10, length: 100, wantCalls: 4, wantEntries: 1},
+		{name: "Max bytes", config: Config{MaxBytes: 250}, messages: 10, length: 100, wantCalls: 5, wantEntries: 1},
+		{name: "Message above max bytes", config: Config{MaxBytes: 50}, messages: 3, length: 100, wantCalls: 3},
+		{name: "Message of max bytes", config: Config{MaxBytes: 100}, messages: 3, length: 100, wantCalls: 3},
+		{name: "Single message", config: Config{MaxMessages: 1}, messages: 3, length: 100, wantCalls: 3},
+	}
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+			stub := &stubKMS{}
+			cache := New(stub, testCase.config)
+
+			for i := 0; i < testCase.messages; i++ {
+				_, err := cache.GenerateDataKey(context.Background(), &GenerateDataKeyInput{
+					KeyID:           "key",
+					VaultID:         "vault",
+					PlaintextLength: testCase.length,
+				})
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, testCase.wantCalls, stub.encryptCalls)
+			assert.Equal(t, uint64(testCase.wantCalls), cache.Stats().Misses)
+			assert.Equal(t, testCase.wantEntries, cache.Stats().Entries, "keys exhausted by their first message are not cached")
+		})
+	}
+}
+
+func TestDecryptDataKey(t *testing.T) {
+
+	stub := &stubKMS{}
+	var events []Event
+	cache := New(stub, Config{MaxAge: time.Minute, OnEvent: func(e Event) { events = append(events, e) }})
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	dataKey, err := cache.GenerateDataKey(context.Background(), &GenerateDataKeyInput{KeyID: "key", VaultID: "vault"})
+	assert.NoError(t, err)
+	assert.Len(t, dataKey.Plaintext, defaultKeySize)
+
+	input := &kms.DecryptInput{KeyID: "key", VaultID: "vault", Payload: dataKey.EncryptedKey}
+
+	for i := 0; i < 3; i++ {
+		plaintext, err := cache.DecryptDataKey(context.Background(), input)
+		assert.NoError(t, err)
+		assert.Equal(t, dataKey.Plaintext, plaintext)
+	}
+	assert.Equal(t, 1, stub.decryptCalls)
+
+	// The entry expires after MaxAge
+	now = now.Add(2 * time.Minute)
+	_, err = cache.DecryptDataKey(context.Background(), input)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stub.decryptCalls)
+
+	assert.Equal(t, []EventType{EventMiss, EventMiss, EventHit, EventHit, EventEviction, EventMiss},
+		eventTypes(events))
+}
+
+func TestEvictionZeroesKeys(t *testing.T) {
+
+	cache := New(&stubKMS{}, Config{MaxEntries: 1})
+
+	_, err := cache.GenerateDataKey(context.Background(), &GenerateDataKeyInput{KeyID: "key1", VaultID: "vault"})
+	assert.NoError(t, err)
+
+	first := cache.lru.Front().Value.(*entry).plaintext
+
+	_, err = cache.GenerateDataKey(context.Background(), &GenerateDataKeyInput{KeyID: "key2", VaultID: "vault"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, make([]byte, defaultKeySize), first, "the evicted key should be zeroed")
+	assert.Equal(t, Stats{Misses: 2, Evictions: 1, Entries: 1}, cache.Stats())
+}
+
+func TestEventCallbackReentrancy(t *testing.T) {
+
+	var stats []Stats
+	var cache *Cache
+	cache = New(&stubKMS{}, Config{MaxEntries: 1, OnEvent: func(Event) { stats = append(stats, cache.Stats()) }})
+
+	for _, keyID := range []string{"key1", "key2", "key2"} {
+		_, err := cache.GenerateDataKey(context.Background(), &GenerateDataKeyInput{KeyID: keyID, VaultID: "vault"})
+		assert.NoError(t, err)
+	}
+	cache.Clear()
+
+	assert.Len(t, stats, 5, "the callback should be able to call back into the cache")
+	assert.Equal(t, Stats{Hits: 1, Misses: 2, Evictions: 2}, cache.Stats())
+}
+
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return types
+}
@@ -7,7 +7,8 @@ import (
 )
 
 // KMSAPI provides an interface to enable mocking the kms.KMS service
-// client's API calls. This makes unit testing easier.
+// client's API calls. This makes unit testing easier. A ready-made
+// implementation can be found in the mock package.
 type KMSAPI interface {
 	Import(*kms.ImportInput) (*kms.ImportOutput, error)
 	ImportWithContext(context.Context, *kms.ImportInput) (*kms.ImportOutput, error)
@@ -15,6 +16,14 @@ type KMSAPI interface {
 	EncryptWithContext(context.Context, *kms.EncryptInput) (*kms.EncryptOutput, error)
 	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
 	DecryptWithContext(context.Context, *kms.DecryptInput) (*kms.DecryptOutput, error)
+	GetKeyId(*kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error)
+	GetKeyIdWithContext(context.Context, *kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error)
+	ReEncrypt(*kms.ReEncryptInput) (*kms.ReEncryptOutput, error)
+	ReEncryptWithContext(context.Context, *kms.ReEncryptInput) (*kms.ReEncryptOutput, error)
+	EncryptBatch(context.Context, *kms.EncryptBatchInput) (*kms.EncryptBatchOutput, error)
+	EncryptBatchChannel(context.Context, <-chan *kms.EncryptInput, kms.BatchOptions) <-chan kms.EncryptBatchResult
+	DecryptBatch(context.Context, *kms.DecryptBatchInput) (*kms.DecryptBatchOutput, error)
+	DecryptBatchChannel(context.Context, <-chan *kms.DecryptInput, kms.BatchOptions) <-chan kms.DecryptBatchResult
 }
 
 // Ensure that KMS implements the KMSAPI interface
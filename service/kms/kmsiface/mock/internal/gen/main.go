@@ -0,0 +1,122 @@
+// Command gen generates the methods of mock.KMS from the kmsiface.KMSAPI
+// interface. It is run by go generate in the mock package.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/duokey/duokey-sdk-go/service/kms/kmsiface"
+)
+
+const header = `// Code generated by internal/gen from kmsiface.KMSAPI. DO NOT EDIT.
+
+package mock
+
+import (
+	"context"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/duokey/duokey-sdk-go/service/kms/kmsiface"
+)
+
+// KMS is a configurable implementation of kmsiface.KMSAPI
+type KMS struct {
+	Mock
+}
+
+// Ensure that KMS implements the KMSAPI interface
+var _ kmsiface.KMSAPI = (*KMS)(nil)
+
+// New returns a mock without expectations
+func New() *KMS {
+	return &KMS{}
+}
+`
+
+func main() {
+	output := flag.String("output", "kms.go", "output file")
+	flag.Parse()
+
+	api := reflect.TypeOf((*kmsiface.KMSAPI)(nil)).Elem()
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+
+	for i := 0; i < api.NumMethod(); i++ {
+		writeMethod(&buf, api.Method(i))
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("gen: %v\n%s", err, buf.String())
+	}
+
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.Fatalf("gen: %v", err)
+	}
+}
+
+func writeMethod(buf *bytes.Buffer, method reflect.Method) {
+	t := method.Type
+	name := method.Name
+
+	var params, args, inTypes, outTypes, results []string
+	for i := 0; i < t.NumIn(); i++ {
+		params = append(params, fmt.Sprintf("arg%d %s", i, t.In(i)))
+		args = append(args, fmt.Sprintf("arg%d", i))
+		inTypes = append(inTypes, t.In(i).String())
+	}
+	for i := 0; i < t.NumOut(); i++ {
+		outTypes = append(outTypes, t.Out(i).String())
+		results = append(results, fmt.Sprintf("r%d", i))
+	}
+
+	signature := fmt.Sprintf("func(%s) (%s)", strings.Join(inTypes, ", "), strings.Join(outTypes, ", "))
+	namedResults := make([]string, len(results))
+	for i := range results {
+		namedResults[i] = results[i] + " " + outTypes[i]
+	}
+
+	// Expectation helpers
+	fmt.Fprintf(buf, "\n// Expect%s scripts the results of %s\n", name, name)
+	fmt.Fprintf(buf, "func (m *KMS) Expect%s(%s) *Expectation {\n", name, strings.Join(namedResults, ", "))
+	fmt.Fprintf(buf, "\treturn m.Expect(%q, %s)\n}\n", name, strings.Join(results, ", "))
+
+	fmt.Fprintf(buf, "\n// Expect%sFunc makes %s call fn\n", name, name)
+	fmt.Fprintf(buf, "func (m *KMS) Expect%sFunc(fn %s) *Expectation {\n", name, signature)
+	fmt.Fprintf(buf, "\treturn m.ExpectFunc(%q, fn)\n}\n", name)
+
+	// Implementation of the operation
+	fmt.Fprintf(buf, "\n// %s implements kmsiface.KMSAPI\n", name)
+	fmt.Fprintf(buf, "func (m *KMS) %s(%s) (%s) {\n", name, strings.Join(params, ", "), strings.Join(namedResults, ", "))
+	fmt.Fprintf(buf, "\te := m.Called(%q, %s)\n\n\tswitch {\n", name, strings.Join(args, ", "))
+
+	fmt.Fprintf(buf, "\tcase e == nil:\n")
+	if last := t.NumOut() - 1; last >= 0 && t.Out(last) == reflect.TypeOf((*error)(nil)).Elem() {
+		fmt.Fprintf(buf, "\t\tr%d = unexpectedCall(%q)\n", last, name)
+	}
+
+	fmt.Fprintf(buf, "\tcase e.fn != nil:\n\t\treturn e.fn.(%s)(%s)\n", signature, strings.Join(args, ", "))
+
+	fmt.Fprintf(buf, "\tdefault:\n")
+	for i := range results {
+		fmt.Fprintf(buf, "\t\tr%d, _ = e.result(%d).(%s)\n", i, i, outTypes[i])
+	}
+	fmt.Fprintf(buf, "\t}\n")
+
+	for i := 0; i < t.NumOut(); i++ {
+		if t.Out(i).Kind() == reflect.Chan {
+			// A nil channel would block the caller forever
+			fmt.Fprintf(buf, "\n\tif r%d == nil {\n\t\tc := make(chan %s)\n\t\tclose(c)\n\t\tr%d = c\n\t}\n", i, t.Out(i).Elem(), i)
+		}
+	}
+
+	fmt.Fprintf(buf, "\n\treturn\n}\n")
+}
@@ -0,0 +1,409 @@
+// Code generated by internal/gen from kmsiface.KMSAPI. DO NOT EDIT.
+
+package mock
+
+import (
+	"context"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/duokey/duokey-sdk-go/service/kms/kmsiface"
+)
+
+// KMS is a configurable implementation of kmsiface.KMSAPI
+type KMS struct {
+	Mock
+}
+
+// Ensure that KMS implements the KMSAPI interface
+var _ kmsiface.KMSAPI = (*KMS)(nil)
+
+// New returns a mock without expectations
+func New() *KMS {
+	return &KMS{}
+}
+
+// ExpectDecrypt scripts the results of Decrypt
+func (m *KMS) ExpectDecrypt(r0 *kms.DecryptOutput, r1 error) *Expectation {
+	return m.Expect("Decrypt", r0, r1)
+}
+
+// ExpectDecryptFunc makes Decrypt call fn
+func (m *KMS) ExpectDecryptFunc(fn func(*kms.DecryptInput) (*kms.DecryptOutput, error)) *Expectation {
+	return m.ExpectFunc("Decrypt", fn)
+}
+
+// Decrypt implements kmsiface.KMSAPI
+func (m *KMS) Decrypt(arg0 *kms.DecryptInput) (r0 *kms.DecryptOutput, r1 error) {
+	e := m.Called("Decrypt", arg0)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("Decrypt")
+	case e.fn != nil:
+		return e.fn.(func(*kms.DecryptInput) (*kms.DecryptOutput, error))(arg0)
+	default:
+		r0, _ = e.result(0).(*kms.DecryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectDecryptBatch scripts the results of DecryptBatch
+func (m *KMS) ExpectDecryptBatch(r0 *kms.DecryptBatchOutput, r1 error) *Expectation {
+	return m.Expect("DecryptBatch", r0, r1)
+}
+
+// ExpectDecryptBatchFunc makes DecryptBatch call fn
+func (m *KMS) ExpectDecryptBatchFunc(fn func(context.Context, *kms.DecryptBatchInput) (*kms.DecryptBatchOutput, error)) *Expectation {
+	return m.ExpectFunc("DecryptBatch", fn)
+}
+
+// DecryptBatch implements kmsiface.KMSAPI
+func (m *KMS) DecryptBatch(arg0 context.Context, arg1 *kms.DecryptBatchInput) (r0 *kms.DecryptBatchOutput, r1 error) {
+	e := m.Called("DecryptBatch", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("DecryptBatch")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.DecryptBatchInput) (*kms.DecryptBatchOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.DecryptBatchOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectDecryptBatchChannel scripts the results of DecryptBatchChannel
+func (m *KMS) ExpectDecryptBatchChannel(r0 <-chan kms.DecryptBatchResult) *Expectation {
+	return m.Expect("DecryptBatchChannel", r0)
+}
+
+// ExpectDecryptBatchChannelFunc makes DecryptBatchChannel call fn
+func (m *KMS) ExpectDecryptBatchChannelFunc(fn func(context.Context, <-chan *kms.DecryptInput, kms.BatchOptions) <-chan kms.DecryptBatchResult) *Expectation {
+	return m.ExpectFunc("DecryptBatchChannel", fn)
+}
+
+// DecryptBatchChannel implements kmsiface.KMSAPI
+func (m *KMS) DecryptBatchChannel(arg0 context.Context, arg1 <-chan *kms.DecryptInput, arg2 kms.BatchOptions) (r0 <-chan kms.DecryptBatchResult) {
+	e := m.Called("DecryptBatchChannel", arg0, arg1, arg2)
+
+	switch {
+	case e == nil:
+	case e.fn != nil:
+		return e.fn.(func(context.Context, <-chan *kms.DecryptInput, kms.BatchOptions) <-chan kms.DecryptBatchResult)(arg0, arg1, arg2)
+	default:
+		r0, _ = e.result(0).(<-chan kms.DecryptBatchResult)
+	}
+
+	if r0 == nil {
+		c := make(chan kms.DecryptBatchResult)
+		close(c)
+		r0 = c
+	}
+
+	return
+}
+
+// ExpectDecryptWithContext scripts the results of DecryptWithContext
+func (m *KMS) ExpectDecryptWithContext(r0 *kms.DecryptOutput, r1 error) *Expectation {
+	return m.Expect("DecryptWithContext", r0, r1)
+}
+
+// ExpectDecryptWithContextFunc makes DecryptWithContext call fn
+func (m *KMS) ExpectDecryptWithContextFunc(fn func(context.Context, *kms.DecryptInput) (*kms.DecryptOutput, error)) *Expectation {
+	return m.ExpectFunc("DecryptWithContext", fn)
+}
+
+// DecryptWithContext implements kmsiface.KMSAPI
+func (m *KMS) DecryptWithContext(arg0 context.Context, arg1 *kms.DecryptInput) (r0 *kms.DecryptOutput, r1 error) {
+	e := m.Called("DecryptWithContext", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("DecryptWithContext")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.DecryptInput) (*kms.DecryptOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.DecryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectEncrypt scripts the results of Encrypt
+func (m *KMS) ExpectEncrypt(r0 *kms.EncryptOutput, r1 error) *Expectation {
+	return m.Expect("Encrypt", r0, r1)
+}
+
+// ExpectEncryptFunc makes Encrypt call fn
+func (m *KMS) ExpectEncryptFunc(fn func(*kms.EncryptInput) (*kms.EncryptOutput, error)) *Expectation {
+	return m.ExpectFunc("Encrypt", fn)
+}
+
+// Encrypt implements kmsiface.KMSAPI
+func (m *KMS) Encrypt(arg0 *kms.EncryptInput) (r0 *kms.EncryptOutput, r1 error) {
+	e := m.Called("Encrypt", arg0)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("Encrypt")
+	case e.fn != nil:
+		return e.fn.(func(*kms.EncryptInput) (*kms.EncryptOutput, error))(arg0)
+	default:
+		r0, _ = e.result(0).(*kms.EncryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectEncryptBatch scripts the results of EncryptBatch
+func (m *KMS) ExpectEncryptBatch(r0 *kms.EncryptBatchOutput, r1 error) *Expectation {
+	return m.Expect("EncryptBatch", r0, r1)
+}
+
+// ExpectEncryptBatchFunc makes EncryptBatch call fn
+func (m *KMS) ExpectEncryptBatchFunc(fn func(context.Context, *kms.EncryptBatchInput) (*kms.EncryptBatchOutput, error)) *Expectation {
+	return m.ExpectFunc("EncryptBatch", fn)
+}
+
+// EncryptBatch implements kmsiface.KMSAPI
+func (m *KMS) EncryptBatch(arg0 context.Context, arg1 *kms.EncryptBatchInput) (r0 *kms.EncryptBatchOutput, r1 error) {
+	e := m.Called("EncryptBatch", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("EncryptBatch")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.EncryptBatchInput) (*kms.EncryptBatchOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.EncryptBatchOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectEncryptBatchChannel scripts the results of EncryptBatchChannel
+func (m *KMS) ExpectEncryptBatchChannel(r0 <-chan kms.EncryptBatchResult) *Expectation {
+	return m.Expect("EncryptBatchChannel", r0)
+}
+
+// ExpectEncryptBatchChannelFunc makes EncryptBatchChannel call fn
+func (m *KMS) ExpectEncryptBatchChannelFunc(fn func(context.Context, <-chan *kms.EncryptInput, kms.BatchOptions) <-chan kms.EncryptBatchResult) *Expectation {
+	return m.ExpectFunc("EncryptBatchChannel", fn)
+}
+
+// EncryptBatchChannel implements kmsiface.KMSAPI
+func (m *KMS) EncryptBatchChannel(arg0 context.Context, arg1 <-chan *kms.EncryptInput, arg2 kms.BatchOptions) (r0 <-chan kms.EncryptBatchResult) {
+	e := m.Called("EncryptBatchChannel", arg0, arg1, arg2)
+
+	switch {
+	case e == nil:
+	case e.fn != nil:
+		return e.fn.(func(context.Context, <-chan *kms.EncryptInput, kms.BatchOptions) <-chan kms.EncryptBatchResult)(arg0, arg1, arg2)
+	default:
+		r0, _ = e.result(0).(<-chan kms.EncryptBatchResult)
+	}
+
+	if r0 == nil {
+		c := make(chan kms.EncryptBatchResult)
+		close(c)
+		r0 = c
+	}
+
+	return
+}
+
+// ExpectEncryptWithContext scripts the results of EncryptWithContext
+func (m *KMS) ExpectEncryptWithContext(r0 *kms.EncryptOutput, r1 error) *Expectation {
+	return m.Expect("EncryptWithContext", r0, r1)
+}
+
+// ExpectEncryptWithContextFunc makes EncryptWithContext call fn
+func (m *KMS) ExpectEncryptWithContextFunc(fn func(context.Context, *kms.EncryptInput) (*kms.EncryptOutput, error)) *Expectation {
+	return m.ExpectFunc("EncryptWithContext", fn)
+}
+
+// EncryptWithContext implements kmsiface.KMSAPI
+func (m *KMS) EncryptWithContext(arg0 context.Context, arg1 *kms.EncryptInput) (r0 *kms.EncryptOutput, r1 error) {
+	e := m.Called("EncryptWithContext", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("EncryptWithContext")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.EncryptInput) (*kms.EncryptOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.EncryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectGetKeyId scripts the results of GetKeyId
+func (m *KMS) ExpectGetKeyId(r0 *kms.GetKeyIdOutput, r1 error) *Expectation {
+	return m.Expect("GetKeyId", r0, r1)
+}
+
+// ExpectGetKeyIdFunc makes GetKeyId call fn
+func (m *KMS) ExpectGetKeyIdFunc(fn func(*kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error)) *Expectation {
+	return m.ExpectFunc("GetKeyId", fn)
+}
+
+// GetKeyId implements kmsiface.KMSAPI
+func (m *KMS) GetKeyId(arg0 *kms.GetKeyIdInput) (r0 *kms.GetKeyIdOutput, r1 error) {
+	e := m.Called("GetKeyId", arg0)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("GetKeyId")
+	case e.fn != nil:
+		return e.fn.(func(*kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error))(arg0)
+	default:
+		r0, _ = e.result(0).(*kms.GetKeyIdOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectGetKeyIdWithContext scripts the results of GetKeyIdWithContext
+func (m *KMS) ExpectGetKeyIdWithContext(r0 *kms.GetKeyIdOutput, r1 error) *Expectation {
+	return m.Expect("GetKeyIdWithContext", r0, r1)
+}
+
+// ExpectGetKeyIdWithContextFunc makes GetKeyIdWithContext call fn
+func (m *KMS) ExpectGetKeyIdWithContextFunc(fn func(context.Context, *kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error)) *Expectation {
+	return m.ExpectFunc("GetKeyIdWithContext", fn)
+}
+
+// GetKeyIdWithContext implements kmsiface.KMSAPI
+func (m *KMS) GetKeyIdWithContext(arg0 context.Context, arg1 *kms.GetKeyIdInput) (r0 *kms.GetKeyIdOutput, r1 error) {
+	e := m.Called("GetKeyIdWithContext", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("GetKeyIdWithContext")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.GetKeyIdOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectImport scripts the results of Import
+func (m *KMS) ExpectImport(r0 *kms.ImportOutput, r1 error) *Expectation {
+	return m.Expect("Import", r0, r1)
+}
+
+// ExpectImportFunc makes Import call fn
+func (m *KMS) ExpectImportFunc(fn func(*kms.ImportInput) (*kms.ImportOutput, error)) *Expectation {
+	return m.ExpectFunc("Import", fn)
+}
+
+// Import implements kmsiface.KMSAPI
+func (m *KMS) Import(arg0 *kms.ImportInput) (r0 *kms.ImportOutput, r1 error) {
+	e := m.Called("Import", arg0)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("Import")
+	case e.fn != nil:
+		return e.fn.(func(*kms.ImportInput) (*kms.ImportOutput, error))(arg0)
+	default:
+		r0, _ = e.result(0).(*kms.ImportOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectImportWithContext scripts the results of ImportWithContext
+func (m *KMS) ExpectImportWithContext(r0 *kms.ImportOutput, r1 error) *Expectation {
+	return m.Expect("ImportWithContext", r0, r1)
+}
+
+// ExpectImportWithContextFunc makes ImportWithContext call fn
+func (m *KMS) ExpectImportWithContextFunc(fn func(context.Context, *kms.ImportInput) (*kms.ImportOutput, error)) *Expectation {
+	return m.ExpectFunc("ImportWithContext", fn)
+}
+
+// ImportWithContext implements kmsiface.KMSAPI
+func (m *KMS) ImportWithContext(arg0 context.Context, arg1 *kms.ImportInput) (r0 *kms.ImportOutput, r1 error) {
+	e := m.Called("ImportWithContext", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("ImportWithContext")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.ImportInput) (*kms.ImportOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.ImportOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectReEncrypt scripts the results of ReEncrypt
+func (m *KMS) ExpectReEncrypt(r0 *kms.ReEncryptOutput, r1 error) *Expectation {
+	return m.Expect("ReEncrypt", r0, r1)
+}
+
+// ExpectReEncryptFunc makes ReEncrypt call fn
+func (m *KMS) ExpectReEncryptFunc(fn func(*kms.ReEncryptInput) (*kms.ReEncryptOutput, error)) *Expectation {
+	return m.ExpectFunc("ReEncrypt", fn)
+}
+
+// ReEncrypt implements kmsiface.KMSAPI
+func (m *KMS) ReEncrypt(arg0 *kms.ReEncryptInput) (r0 *kms.ReEncryptOutput, r1 error) {
+	e := m.Called("ReEncrypt", arg0)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("ReEncrypt")
+	case e.fn != nil:
+		return e.fn.(func(*kms.ReEncryptInput) (*kms.ReEncryptOutput, error))(arg0)
+	default:
+		r0, _ = e.result(0).(*kms.ReEncryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
+
+// ExpectReEncryptWithContext scripts the results of ReEncryptWithContext
+func (m *KMS) ExpectReEncryptWithContext(r0 *kms.ReEncryptOutput, r1 error) *Expectation {
+	return m.Expect("ReEncryptWithContext", r0, r1)
+}
+
+// ExpectReEncryptWithContextFunc makes ReEncryptWithContext call fn
+func (m *KMS) ExpectReEncryptWithContextFunc(fn func(context.Context, *kms.ReEncryptInput) (*kms.ReEncryptOutput, error)) *Expectation {
+	return m.ExpectFunc("ReEncryptWithContext", fn)
+}
+
+// ReEncryptWithContext implements kmsiface.KMSAPI
+func (m *KMS) ReEncryptWithContext(arg0 context.Context, arg1 *kms.ReEncryptInput) (r0 *kms.ReEncryptOutput, r1 error) {
+	e := m.Called("ReEncryptWithContext", arg0, arg1)
+
+	switch {
+	case e == nil:
+		r1 = unexpectedCall("ReEncryptWithContext")
+	case e.fn != nil:
+		return e.fn.(func(context.Context, *kms.ReEncryptInput) (*kms.ReEncryptOutput, error))(arg0, arg1)
+	default:
+		r0, _ = e.result(0).(*kms.ReEncryptOutput)
+		r1, _ = e.result(1).(error)
+	}
+
+	return
+}
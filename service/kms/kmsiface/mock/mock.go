@@ -0,0 +1,178 @@
+// Package mock provides a configurable implementation of kmsiface.KMSAPI for
+// unit tests. The mock records every call, returns the outputs and errors
+// scripted for each operation and checks that the expectations were met.
+//
+//	m := mock.New()
+//	m.ExpectEncrypt(&kms.EncryptOutput{Success: true}, nil).Once()
+//	m.ExpectDecrypt(nil, errors.New("boom"))
+//
+//	runCodeUnderTest(m)
+//
+//	m.AssertExpectations(t)
+//
+// A call without expectation fails with ErrUnexpectedCall and is reported by
+// AssertExpectations.
+package mock
+
+//go:generate go run ./internal/gen -output kms.go
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnexpectedCall is returned by an operation called without expectation.
+var ErrUnexpectedCall = errors.New("mock: unexpected call")
+
+// TestingT is the subset of testing.T used to report failed expectations.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Call records the arguments of a call to the mock.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Expectation scripts the results of an operation. Expectations for the same
+// operation are consumed in the order they were defined: an expectation
+// limited with Times or Once is skipped once exhausted, an unlimited one
+// answers all the following calls.
+type Expectation struct {
+	method  string
+	results []interface{}
+	fn      interface{}
+	times   int // 0 means any number of times
+	calls   int
+}
+
+// Times limits the expectation to n calls. AssertExpectations fails if the
+// operation was called less than n times.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+// Once is equivalent to Times(1).
+func (e *Expectation) Once() *Expectation {
+	return e.Times(1)
+}
+
+// result returns the i-th scripted result or nil
+func (e *Expectation) result(i int) interface{} {
+	if i < len(e.results) {
+		return e.results[i]
+	}
+	return nil
+}
+
+func (e *Expectation) exhausted() bool {
+	return e.times > 0 && e.calls >= e.times
+}
+
+// Mock is the generic part of the generated mocks. It is safe for concurrent use.
+type Mock struct {
+	mu           sync.Mutex
+	calls        []Call
+	expectations map[string][]*Expectation
+	unexpected   []Call
+}
+
+// Expect scripts the results returned by method. The number and types of
+// results must match the signature of the operation.
+func (m *Mock) Expect(method string, results ...interface{}) *Expectation {
+	return m.expect(&Expectation{method: method, results: results})
+}
+
+// ExpectFunc makes method call fn, which must have the signature of the
+// operation.
+func (m *Mock) ExpectFunc(method string, fn interface{}) *Expectation {
+	return m.expect(&Expectation{method: method, fn: fn})
+}
+
+func (m *Mock) expect(e *Expectation) *Expectation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.expectations == nil {
+		m.expectations = make(map[string][]*Expectation)
+	}
+	m.expectations[e.method] = append(m.expectations[e.method], e)
+
+	return e
+}
+
+// Called records a call and returns the matching expectation, or nil if the
+// call was not expected.
+func (m *Mock) Called(method string, args ...interface{}) *Expectation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	call := Call{Method: method, Args: args}
+	m.calls = append(m.calls, call)
+
+	for _, e := range m.expectations[method] {
+		if !e.exhausted() {
+			e.calls++
+			return e
+		}
+	}
+
+	m.unexpected = append(m.unexpected, call)
+
+	return nil
+}
+
+// Calls returns the calls made to method, or all the calls if method is empty.
+func (m *Mock) Calls(method string) []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var calls []Call
+	for _, call := range m.calls {
+		if method == "" || call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// AssertExpectations checks that every expectation limited with Times was
+// fully consumed, that the other expectations were used at least once and
+// that no unexpected call was made.
+func (m *Mock) AssertExpectations(t TestingT) bool {
+	t.Helper()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ok := true
+
+	for method, expectations := range m.expectations {
+		for _, e := range expectations {
+			switch {
+			case e.times > 0 && e.calls < e.times:
+				t.Errorf("mock: %s called %d time(s), expected %d", method, e.calls, e.times)
+				ok = false
+			case e.times == 0 && e.calls == 0:
+				t.Errorf("mock: %s was expected but not called", method)
+				ok = false
+			}
+		}
+	}
+
+	for _, call := range m.unexpected {
+		t.Errorf("mock: unexpected call to %s", call.Method)
+		ok = false
+	}
+
+	return ok
+}
+
+// unexpectedCall returns the error of a call without expectation
+func unexpectedCall(method string) error {
+	return fmt.Errorf("%w to %s", ErrUnexpectedCall, method)
+}
@@ -0,0 +1,83 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/duokey/duokey-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder collects the failures reported by AssertExpectations
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestScriptedResults(t *testing.T) {
+
+	m := New()
+
+	first := &kms.EncryptOutput{Success: true}
+	m.ExpectEncrypt(first, nil).Once()
+	m.ExpectEncrypt(nil, errors.New("boom"))
+
+	out, err := m.Encrypt(&kms.EncryptInput{KeyID: "key"})
+	assert.NoError(t, err)
+	assert.Same(t, first, out)
+
+	for i := 0; i < 2; i++ {
+		_, err = m.Encrypt(&kms.EncryptInput{KeyID: "key"})
+		assert.EqualError(t, err, "boom")
+	}
+
+	m.ExpectGetKeyIdWithContextFunc(func(_ context.Context, input *kms.GetKeyIdInput) (*kms.GetKeyIdOutput, error) {
+		out := &kms.GetKeyIdOutput{}
+		out.Result.Key.Id = input.ExternalID
+		return out, nil
+	})
+
+	kOut, err := m.GetKeyIdWithContext(context.Background(), &kms.GetKeyIdInput{ExternalID: "external"})
+	assert.NoError(t, err)
+	assert.Equal(t, "external", kOut.Result.Key.Id)
+
+	calls := m.Calls("Encrypt")
+	assert.Len(t, calls, 3)
+	assert.Equal(t, "key", calls[0].Args[0].(*kms.EncryptInput).KeyID)
+	assert.Len(t, m.Calls(""), 4)
+
+	assert.True(t, m.AssertExpectations(t))
+}
+
+func TestExpectationFailures(t *testing.T) {
+
+	m := New()
+	m.ExpectDecrypt(&kms.DecryptOutput{}, nil).Times(2)
+	m.ExpectImport(&kms.ImportOutput{}, nil)
+
+	_, err := m.Decrypt(&kms.DecryptInput{})
+	assert.NoError(t, err)
+
+	_, err = m.ReEncrypt(&kms.ReEncryptInput{})
+	assert.ErrorIs(t, err, ErrUnexpectedCall)
+
+	// A channel operation without expectation returns a closed channel
+	_, open := <-m.EncryptBatchChannel(context.Background(), nil, kms.BatchOptions{})
+	assert.False(t, open)
+
+	r := &recorder{}
+	assert.False(t, m.AssertExpectations(r))
+	assert.ElementsMatch(t, []string{
+		"mock: Decrypt called 1 time(s), expected 2",
+		"mock: Import was expected but not called",
+		"mock: unexpected call to ReEncrypt",
+		"mock: unexpected call to EncryptBatchChannel",
+	}, r.errors)
+}
@@ -1,25 +1,48 @@
 package kms
 
 import (
+	"time"
+
 	"github.com/duokey/duokey-sdk-go/duokey"
 	"github.com/duokey/duokey-sdk-go/duokey/client"
 	"github.com/duokey/duokey-sdk-go/duokey/credentials"
 )
 
-// KMS implements the KMSAPI interface
+// KMS implements the KMSAPI interface. The circuit breakers of
+// Endpoints.BaseURLs are created by NewClient, NewClientWithLogger and
+// NewClientWithConfig: the requests of a KMS built as a literal with
+// Endpoints.BaseURLs fail.
 type KMS struct {
 	*client.Client
 	*Endpoints
+
+	endpointSet *endpointSet // nil if Endpoints.BaseURLs is not set
 }
 
 // Endpoints of the crypto services (all routes of the DuoKey REST API
 // are customizable)
 type Endpoints struct {
-	BaseURL       string `mapstructure:"base-url"`
+	BaseURL string `mapstructure:"base-url"`
+
+	// BaseURLs lists the base URLs in order of preference after BaseURL,
+	// e.g. a primary and a disaster recovery site. If set, each endpoint has
+	// a circuit breaker and the requests fail over to the next endpoint (see
+	// FailoverConfig). The non-idempotent operations (Import) are not
+	// replayed against another endpoint once sent.
+	BaseURLs []string       `mapstructure:"base-urls"`
+	Failover FailoverConfig `mapstructure:"failover"`
+
 	EncryptRoute  string `mapstructure:"encrypt-route"`
 	DecryptRoute  string `mapstructure:"decrypt-route"`
 	ImportRoute   string `mapstructure:"import-route"`
 	GetKeyIdRoute string `mapstructure:"getkeyid-route"`
+
+	// Server-side re-encryption route (optional, see ReEncrypt)
+	ReEncryptRoute string `mapstructure:"reencrypt-route"`
+
+	// Server-side batch routes (optional, see BatchOptions)
+	EncryptBatchRoute string `mapstructure:"encrypt-batch-route"`
+	DecryptBatchRoute string `mapstructure:"decrypt-batch-route"`
 }
 
 // New checks the credentials and returns a KMS client with the default logger.
@@ -34,5 +57,27 @@ func NewClientWithLogger(credentials credentials.Config, endpoints Endpoints, lo
 		return nil, err
 	}
 
-	return &KMS{Client: client, Endpoints: &endpoints}, nil
+	return newKMS(client, endpoints), nil
+}
+
+// NewClientWithConfig checks the credentials and returns a KMS client
+// configured with config (logger, token refresh, ...). See client.NewWithConfig.
+// Unless config.TokenRefresh.Disabled is set, the token is refreshed in the
+// background: call Close once the client is no longer needed.
+func NewClientWithConfig(config duokey.Config, endpoints Endpoints) (*KMS, error) {
+	client, err := client.NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKMS(client, endpoints), nil
+}
+
+// newKMS returns a KMS client sending the requests of client to endpoints
+func newKMS(client *client.Client, endpoints Endpoints) *KMS {
+	k := &KMS{Client: client, Endpoints: &endpoints}
+	if len(endpoints.BaseURLs) > 0 {
+		k.endpointSet = newEndpointSet(endpoints.baseURLs(), endpoints.Failover, time.Now)
+	}
+	return k
 }
@@ -5,23 +5,27 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/duokey/duokey-sdk-go/duokey"
 	"github.com/duokey/duokey-sdk-go/duokey/client"
 	"github.com/duokey/duokey-sdk-go/duokey/credentials"
+	"github.com/duokey/duokey-sdk-go/duokey/request"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
-	encryptRoute = "/api/services/app/Keys/CreateEncryptRequest"
-	decryptRoute = "/api/services/app/Keys/CreateDecryptRequest"
+	encryptRoute   = "/api/services/app/Keys/CreateEncryptRequest"
+	decryptRoute   = "/api/services/app/Keys/CreateDecryptRequest"
+	reEncryptRoute = "/api/services/app/Keys/CreateReEncryptRequest"
 )
 
 func mockDecrypt(body []byte) ([]byte, error) {
@@ -32,35 +36,18 @@ func mockDecrypt(body []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	/*
-		maxLen := base64.StdEncoding.DecodedLen(len(jsonData.Payload))
-		b64decoded := make([]byte, maxLen)
-
-		len, err := base64.StdEncoding.Decode(b64decoded, jsonData.Payload)
-		if err != nil {
-			return nil, err
-		}
-
-		if len < maxLen {
-			b64decoded = b64decoded[:len]
-		}
-	*/
-
-	output := DecryptOutput{
-		Success: true,
-		Result: struct {
-			KeyID     string `json:"keyid" validate:"nonzero"`
-			Algorithm string `json:"algorithm"`
-			Payload   []byte `json:"payload" validate:"nonzero"`
-			ID        uint32 `json:"id"`
-		}{
-			KeyID:   jsonData.KeyID,
-			Payload: []byte(jsonData.Payload),
-		},
+	b64decoded, err := base64.StdEncoding.DecodeString(jsonData.Payload)
+	if err != nil {
+		return nil, err
 	}
 
+	output := DecryptOutput{Success: true}
+	output.Result.KeyID = jsonData.KeyID
+	output.Result.Payload = b64decoded
+	output.Result.AAD = jsonData.AAD
+
 	reply := &bytes.Buffer{}
-	err := json.NewEncoder(reply).Encode(output)
+	err = json.NewEncoder(reply).Encode(output)
 	return reply.Bytes(), err
 }
 
@@ -75,19 +62,10 @@ func mockEncrypt(body []byte) ([]byte, error) {
 	b64encoded := make([]byte, base64.StdEncoding.EncodedLen(len(jsonData.Payload)))
 	base64.StdEncoding.Encode(b64encoded, jsonData.Payload)
 
-	output := EncryptOutput{
-		Success: true,
-		Result: struct {
-			KeyID            string `json:"keyid" validate:"nonzero"`
-			Algorithm        string `json:"algorithm"`
-			EncryptedPayload string `json:"encryptedPayload" validate:"nonzero"`
-			ID               uint32 `json:"id"`
-			Iv               string `json:"initializationVector"`
-		}{
-			KeyID:            jsonData.KeyID,
-			EncryptedPayload: string(jsonData.Payload),
-		},
-	}
+	output := EncryptOutput{Success: true}
+	output.Result.KeyID = jsonData.KeyID
+	output.Result.EncryptedPayload = string(b64encoded)
+	output.Result.AAD = jsonData.AAD
 
 	reply := &bytes.Buffer{}
 	err := json.NewEncoder(reply).Encode(output)
@@ -101,11 +79,98 @@ func newClientWithMockServer(credentials credentials.Config, endpoints Endpoints
 	}
 	client := client.Client{Config: config}
 
-	return &KMS{Endpoints: &endpoints, Client: &client}
+	return newKMS(&client, endpoints)
 }
 
 func TestInputValidation(t *testing.T) {
 
+	aesKey := &KeyData{Id: "aes", Type: "AES", IsEnabled: true, IsEncrypt: true, IsDecrypt: true}
+	rsaKey := &KeyData{Id: "rsa", Type: "RSA", IsEnabled: true, IsEncrypt: true, IsDecrypt: false}
+
+	testCases := []struct {
+		name    string
+		input   interface{}
+		wantErr bool
+	}{
+		{name: "No algorithm",
+			input:   &EncryptInput{KeyID: "aes", VaultID: "vault"},
+			wantErr: false,
+		},
+		{name: "Missing key ID",
+			input:   &EncryptInput{VaultID: "vault", Algorithm: AlgorithmAESGCM},
+			wantErr: true,
+		},
+		{name: "Unknown algorithm",
+			input:   &EncryptInput{KeyID: "aes", VaultID: "vault", Algorithm: "ROT13"},
+			wantErr: true,
+		},
+		{name: "AES-GCM on an AES key",
+			input:   &EncryptInput{KeyID: "aes", VaultID: "vault", Algorithm: AlgorithmAESGCM, Key: aesKey},
+			wantErr: false,
+		},
+		{name: "AES-GCM on an RSA key",
+			input:   &EncryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: AlgorithmAESGCM, Key: rsaKey},
+			wantErr: true,
+		},
+		{name: "Legacy identifier on an RSA key",
+			input:   &EncryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: "3", Key: rsaKey},
+			wantErr: false,
+		},
+		{name: "Decryption not allowed",
+			input:   &DecryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: AlgorithmRSAOAEP256, Key: rsaKey},
+			wantErr: true,
+		},
+		{name: "AES-GCM decryption without Iv",
+			input:   &DecryptInput{KeyID: "aes", VaultID: "vault", Algorithm: AlgorithmAESGCM, Key: aesKey},
+			wantErr: true,
+		},
+		{name: "AES-GCM decryption with Iv",
+			input:   &DecryptInput{KeyID: "aes", VaultID: "vault", Algorithm: AlgorithmAESGCM, Iv: "aXY=", Key: aesKey},
+			wantErr: false,
+		},
+		{name: "AAD with AES-GCM",
+			input:   &EncryptInput{KeyID: "aes", VaultID: "vault", Algorithm: AlgorithmAESGCM, AAD: []byte("record-42")},
+			wantErr: false,
+		},
+		{name: "AAD with RSA-OAEP-256",
+			input:   &EncryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: AlgorithmRSAOAEP256, AAD: []byte("record-42")},
+			wantErr: true,
+		},
+		{name: "Tag with RSA-OAEP-256",
+			input:   &DecryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: AlgorithmRSAOAEP256, Tag: "dGFn"},
+			wantErr: true,
+		},
+	}
+
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, Endpoints{}, http.DefaultClient)
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+
+			var err error
+
+			switch input := testCase.input.(type) {
+			case *EncryptInput:
+				req, _ := kmsClient.encryptRequest(input)
+				err = req.Error
+			case *DecryptInput:
+				req, _ := kmsClient.decryptRequest(input)
+				err = req.Error
+			}
+
+			if testCase.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	eInput := &EncryptInput{KeyID: "rsa", VaultID: "vault", Algorithm: "3"}
+	req, _ := kmsClient.encryptRequest(eInput)
+	assert.Equal(t, AlgorithmRSAOAEP256, req.Parameters.(*EncryptInput).Algorithm, "Legacy identifiers should be translated")
+	assert.Equal(t, Algorithm("3"), eInput.Algorithm, "The caller's input should not be modified")
 }
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -171,6 +236,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		KeyID:   uuid.New().String(),
 		VaultID: uuid.New().String(),
 		Payload: []byte("Lorem ipsum"),
+		AAD:     []byte("record-42"),
 	}
 
 	eOutput, err := kmsClient.Encrypt(eInput)
@@ -182,6 +248,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		KeyID:   eOutput.Result.KeyID,
 		VaultID: eInput.VaultID,
 		Payload: eOutput.Result.EncryptedPayload,
+		AAD:     eOutput.Result.AAD,
 	}
 
 	dOutput, err := kmsClient.Decrypt(dInput)
@@ -190,6 +257,212 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 
 	assert.Equal(t, eInput.Payload, dOutput.Result.Payload, "The two plaintexts should be the same.")
+	assert.Equal(t, eInput.AAD, dOutput.Result.AAD, "The AAD should be returned.")
+}
+
+func TestDecryptAuthenticationFailure(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"success":false,"error":"The computed authentication tag did not match the input authentication tag."}`))
+	}))
+	defer mockServer.Close()
+
+	endpoints := Endpoints{
+		BaseURL:      mockServer.URL,
+		DecryptRoute: decryptRoute,
+	}
+
+	kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+	_, err := kmsClient.Decrypt(&DecryptInput{
+		KeyID:     uuid.New().String(),
+		VaultID:   uuid.New().String(),
+		Algorithm: AlgorithmAESGCM,
+		Payload:   "TG9yZW0gaXBzdW0=",
+		Iv:        "aXY=",
+		AAD:       []byte("wrong record"),
+	})
+
+	assert.ErrorIs(t, err, ErrAuthenticationFailed)
+}
+
+func TestDecryptError(t *testing.T) {
+
+	envelope := func(message string) []byte {
+		body, _ := json.Marshal(map[string]interface{}{"success": false, "error": message})
+		return body
+	}
+
+	testCases := []struct {
+		name        string
+		err         error
+		serverError string
+		want        bool
+	}{
+		{
+			name: ".NET",
+			err:  &request.ErrorResponse{StatusCode: http.StatusBadRequest, Body: envelope("The computed authentication tag did not match the input authentication tag.")},
+			want: true,
+		},
+		{
+			name: "Java",
+			err:  &request.ErrorResponse{StatusCode: http.StatusInternalServerError, Body: envelope("javax.crypto.AEADBadTagException: Tag mismatch!")},
+			want: true,
+		},
+		{
+			name: "Bouncy Castle",
+			err:  &request.ErrorResponse{StatusCode: http.StatusInternalServerError, Body: envelope("org.bouncycastle.crypto.InvalidCipherTextException: mac check in GCM failed")},
+			want: true,
+		},
+		{
+			name:        "Envelope",
+			err:         errors.New("invalid response"),
+			serverError: "The computed authentication tag did not match the input authentication tag.",
+			want:        true,
+		},
+		{
+			name: "Invalid token",
+			err:  &request.ErrorResponse{StatusCode: http.StatusUnauthorized, Body: envelope("Invalid authentication token")},
+		},
+		{
+			name: "Missing tag",
+			err:  &request.ErrorResponse{StatusCode: http.StatusBadRequest, Body: envelope("The authentication tag is required")},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var serverError *string
+			if testCase.serverError != "" {
+				serverError = &testCase.serverError
+			}
+			err := decryptError(testCase.err, serverError)
+			assert.Equal(t, testCase.want, errors.Is(err, ErrAuthenticationFailed))
+			assert.ErrorIs(t, err, testCase.err)
+		})
+	}
+
+	assert.NoError(t, decryptError(nil, nil))
+}
+
+func TestReEncrypt(t *testing.T) {
+
+	testCases := []struct {
+		name       string
+		route      string
+		wantRoutes []string
+	}{
+		{name: "Server-side", route: reEncryptRoute, wantRoutes: []string{reEncryptRoute}},
+		{name: "Client-side", route: "", wantRoutes: []string{decryptRoute, encryptRoute}},
+	}
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+
+			var routes []string
+
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body []byte
+				var err error
+
+				payload, _ := ioutil.ReadAll(r.Body)
+				routes = append(routes, r.RequestURI)
+
+				switch r.RequestURI {
+				case encryptRoute:
+					body, err = mockEncrypt(payload)
+				case decryptRoute:
+					body, err = mockDecrypt(payload)
+				case reEncryptRoute:
+					var input ReEncryptInput
+					err = json.Unmarshal(payload, &input)
+					output := ReEncryptOutput{Success: true}
+					output.Result.KeyID = input.DestinationKeyID
+					output.Result.SourceKeyID = input.SourceKeyID
+					output.Result.EncryptedPayload = input.Payload
+					body, _ = json.Marshal(output)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(body)
+			}))
+			defer mockServer.Close()
+
+			endpoints := Endpoints{
+				BaseURL:        mockServer.URL,
+				EncryptRoute:   encryptRoute,
+				DecryptRoute:   decryptRoute,
+				ReEncryptRoute: testCase.route,
+			}
+
+			kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+			output, err := kmsClient.ReEncrypt(&ReEncryptInput{
+				SourceKeyID:        "old",
+				SourceVaultID:      "vault",
+				DestinationKeyID:   "new",
+				DestinationVaultID: "vault",
+				Payload:            "TG9yZW0gaXBzdW0=",
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.wantRoutes, routes)
+			assert.Equal(t, "new", output.Result.KeyID)
+			assert.Equal(t, "old", output.Result.SourceKeyID)
+			assert.Equal(t, "TG9yZW0gaXBzdW0=", output.Result.EncryptedPayload)
+		})
+	}
+}
+
+func TestReEncryptValidation(t *testing.T) {
+
+	testCases := []struct {
+		name  string
+		route string
+	}{
+		{name: "Server-side", route: reEncryptRoute},
+		{name: "Client-side", route: ""},
+	}
+
+	for _, testCase := range testCases {
+
+		t.Run(testCase.name, func(t *testing.T) {
+
+			var calls int32
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+			}))
+			defer mockServer.Close()
+
+			endpoints := Endpoints{
+				BaseURL:        mockServer.URL,
+				EncryptRoute:   encryptRoute,
+				DecryptRoute:   decryptRoute,
+				ReEncryptRoute: testCase.route,
+			}
+
+			kmsClient := newClientWithMockServer(credentials.Config{HeaderTenantID: "Abp.TenantId"}, endpoints, mockServer.Client())
+
+			_, err := kmsClient.ReEncrypt(&ReEncryptInput{
+				SourceKeyID:          "old",
+				SourceVaultID:        "vault",
+				DestinationKeyID:     "new",
+				DestinationVaultID:   "vault",
+				DestinationAlgorithm: AlgorithmRSAOAEP,
+				DestinationAAD:       []byte("header"),
+				Payload:              "TG9yZW0gaXBzdW0=",
+			})
+
+			assert.EqualError(t, err, "bad request: algorithm RSA-OAEP does not support additional authenticated data")
+			assert.Zero(t, atomic.LoadInt32(&calls), "rejected before the network call")
+		})
+	}
 }
 
 func TestEncryptWithTimeout(t *testing.T) {
@@ -295,7 +568,7 @@ func TestEncryptWithTimeout(t *testing.T) {
 				if err != nil {
 					t.Errorf("Unexpected error: " + err.Error())
 				} else {
-					assert.Equal(t, []byte("TG9yZW0gaXBzdW0gZG9sb3Igc2l0IGFtZXQsIGNvbnNlY3RldHVyIGFkaXBpc2NpbmcgZWxpdCwgc2VkIGRvIGVpdXNtb2QgdGVtcG9yIGluY2lkaWR1bnQgdXQgbGFib3JlIGV0IGRvbG9yZSBtYWduYSBhbGlxdWEu"), eOutput.Result.EncryptedPayload)
+					assert.Equal(t, "TG9yZW0gaXBzdW0gZG9sb3Igc2l0IGFtZXQsIGNvbnNlY3RldHVyIGFkaXBpc2NpbmcgZWxpdCwgc2VkIGRvIGVpdXNtb2QgdGVtcG9yIGluY2lkaWR1bnQgdXQgbGFib3JlIGV0IGRvbG9yZSBtYWduYSBhbGlxdWEu", eOutput.Result.EncryptedPayload)
 				}
 			}
 		})